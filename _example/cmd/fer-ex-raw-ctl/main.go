@@ -104,21 +104,11 @@ func runHelloWorld(w io.Writer, r io.Reader, datac chan Data) {
 
 	errc := make(chan error)
 	go func() {
-		cfg := cfg
-		cfg.ID = "sink1"
-		errc <- fer.RunDevice(ctx, cfg, dev1, r, w)
-	}()
-
-	go func() {
-		cfg := cfg
-		cfg.ID = "processor"
-		errc <- fer.RunDevice(ctx, cfg, dev2, r, w)
-	}()
-
-	go func() {
-		cfg := cfg
-		cfg.ID = "sampler1"
-		errc <- fer.RunDevice(ctx, cfg, dev3, r, w)
+		errc <- fer.RunTopology(ctx, cfg, map[string]fer.Device{
+			"sink1":     dev1,
+			"processor": dev2,
+			"sampler1":  dev3,
+		}, w)
 	}()
 
 	i := 0
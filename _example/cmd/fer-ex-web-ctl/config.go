@@ -9,6 +9,7 @@ import (
 	"strconv"
 
 	"github.com/alice-go/fer/config"
+	"github.com/alice-go/fer/mq/ws"
 	"golang.org/x/xerrors"
 )
 
@@ -25,16 +26,25 @@ func getTCPPort() (string, error) {
 	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
 }
 
-func getSPSConfig(transport string) (config.Config, error) {
+// getSPSConfig returns the configuration of the sampler, processor and sink
+// devices, and of the web device publishing the dashboard of the run on a
+// ws:// channel.
+// host is the host (and port) of the web server, as seen by the browser.
+// getSPSConfig also returns the URL of the dashboard channel for this browser.
+func getSPSConfig(transport, host string) (config.Config, string, error) {
 	var cfg config.Config
 
 	port1, err := getTCPPort()
 	if err != nil {
-		return cfg, xerrors.Errorf("error getting free TCP port: %w", err)
+		return cfg, "", xerrors.Errorf("error getting free TCP port: %w", err)
 	}
 	port2, err := getTCPPort()
 	if err != nil {
-		return cfg, xerrors.Errorf("error getting free TCP port: %w", err)
+		return cfg, "", xerrors.Errorf("error getting free TCP port: %w", err)
+	}
+	port3, err := getTCPPort()
+	if err != nil {
+		return cfg, "", xerrors.Errorf("error getting free TCP port: %w", err)
 	}
 
 	cfg = config.Config{
@@ -97,9 +107,32 @@ func getSPSConfig(transport string) (config.Config, error) {
 						},
 					},
 				},
+				{
+					ID: "web",
+					Channels: []config.Channel{
+						{
+							Name: "data",
+							Sockets: []config.Socket{
+								{
+									Type:    "pub",
+									Method:  "bind",
+									Address: "ws://*:" + port3 + "/data",
+									Options: map[string]interface{}{
+										ws.OptionOrigins: []string{"http://" + host},
+									},
+								},
+							},
+						},
+					},
+				},
 			},
 		},
 	}
 
-	return cfg, nil
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	url := "ws://" + net.JoinHostPort(hostname, port3) + "/data"
+	return cfg, url, nil
 }
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -145,6 +146,49 @@ func (dev *sink) Run(ctl fer.Controller) error {
 	}
 }
 
+// dashboard publishes the state of the run to the web browsers connected to
+// its ws:// channel, as JSON messages.
+type dashboard struct {
+	cfg    config.Device
+	datac  chan fer.Msg
+	states chan Data
+	done   chan struct{}
+}
+
+func (dev *dashboard) Configure(cfg config.Device) error {
+	dev.cfg = cfg
+	return nil
+}
+
+func (dev *dashboard) Init(ctl fer.Controller) error {
+	datac, err := ctl.Chan("data", 0)
+	if err != nil {
+		return err
+	}
+
+	dev.datac = datac
+	return nil
+}
+
+func (dev *dashboard) Run(ctl fer.Controller) error {
+	for {
+		select {
+		case state, ok := <-dev.states:
+			if !ok {
+				close(dev.done)
+				return nil
+			}
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			dev.datac <- fer.Msg{Data: data}
+		case <-ctl.Done():
+			return nil
+		}
+	}
+}
+
 // token is the data exchanged between devices.
 type token struct {
 	msg []byte
@@ -7,7 +7,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
 	"flag"
 	"fmt"
 	"image/color"
@@ -18,22 +17,19 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/alice-go/fer"
+	"github.com/alice-go/fer/config"
 	"github.com/pkg/profile"
 	"go-hep.org/x/hep/hbook"
 	"go-hep.org/x/hep/hplot"
-	"golang.org/x/net/websocket"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 	"gonum.org/v1/plot/vg/draw"
 	"gonum.org/v1/plot/vg/vgsvg"
 )
 
-const cookieName = "FER_WEB_SRV"
-
 var (
 	addr      = flag.String("addr", ":8080", "web server address")
 	timeout   = flag.Duration("timeout", 20*time.Second, "timeout for fer-pods")
@@ -41,175 +37,33 @@ var (
 	doprof    = flag.Bool("cpu-prof", false, "enable CPU profiling")
 )
 
-type server struct {
-	mu      sync.RWMutex
-	cookies map[string]*http.Cookie
-	datac   map[string]chan Data
-}
-
 func main() {
 	flag.Parse()
 
 	if *doprof {
 		defer profile.Start(profile.CPUProfile).Stop()
 	}
-	srv := newServer()
 
-	http.HandleFunc("/", srv.wrap(srv.rootHandler))
-	http.HandleFunc("/run", srv.wrap(srv.runHandler))
-	http.Handle("/data", websocket.Handler(srv.dataHandler))
+	http.HandleFunc("/", rootHandler)
+	http.HandleFunc("/run", runHandler)
 	log.Panic(http.ListenAndServe(*addr, nil))
 }
 
-func newServer() *server {
-	srv := server{
-		cookies: make(map[string]*http.Cookie),
-		datac:   make(map[string]chan Data),
-	}
-	go srv.run()
-	return &srv
-}
-
-func (srv *server) run() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		srv.gc()
-	}
-}
-
-func (srv *server) gc() {
-	srv.mu.Lock()
-	defer srv.mu.Unlock()
-	for name, cookie := range srv.cookies {
-		now := time.Now()
-		if now.After(cookie.Expires) {
-			close(srv.datac[name])
-			delete(srv.datac, name)
-			delete(srv.cookies, name)
-			cookie.MaxAge = -1
-		}
-	}
-}
-
-func (srv *server) wrap(fn http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		err := srv.setCookie(w, r)
-		if err != nil {
-			log.Printf("error retrieving cookie: %v\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		fn(w, r)
-	}
-}
-
-func (srv *server) setCookie(w http.ResponseWriter, r *http.Request) error {
-	srv.mu.Lock()
-	defer srv.mu.Unlock()
-	cookie, err := r.Cookie(cookieName)
-	if err != nil && err != http.ErrNoCookie {
-		return err
-	}
-
-	if cookie != nil {
-		if v, ok := srv.datac[cookie.Value]; v == nil || !ok {
-			srv.datac[cookie.Value] = make(chan Data, 1024)
-			srv.cookies[cookie.Value] = cookie
-		}
-		return nil
-	}
-
-	secret := make([]byte, 256)
-	_, err = rand.Read(secret)
-	if err != nil {
-		return err
-	}
-
-	cookie = &http.Cookie{
-		Name:    cookieName,
-		Value:   string(secret),
-		Expires: time.Now().Add(24 * time.Hour),
-	}
-	srv.datac[cookie.Value] = make(chan Data, 1024)
-	srv.cookies[cookie.Value] = cookie
-	http.SetCookie(w, cookie)
-	return nil
-}
-
-func (srv *server) cookie(r *http.Request) (*http.Cookie, error) {
-	srv.mu.RLock()
-	defer srv.mu.RUnlock()
-	cookie, err := r.Cookie(cookieName)
-	if err != nil {
-		return nil, err
-	}
-
-	if cookie == nil {
-		return nil, http.ErrNoCookie
-	}
-	return srv.cookies[cookie.Value], nil
-}
-
-func (srv *server) data(r *http.Request) (chan Data, error) {
-	srv.mu.RLock()
-	defer srv.mu.RUnlock()
-	cookie, err := srv.cookie(r)
-	if err != nil {
-		return nil, err
-	}
-	return srv.datac[cookie.Value], nil
-}
-
-func (srv *server) rootHandler(w http.ResponseWriter, r *http.Request) {
+func rootHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, homePage)
 }
 
-func (srv *server) runHandler(w http.ResponseWriter, r *http.Request) {
-	stdin := new(bytes.Buffer)
-	stdout := ioutil.Discard
-	datac, err := srv.data(r)
+// runHandler starts a run and replies with the URL of its dashboard, the
+// ws:// channel of the web device.
+func runHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, url, err := getSPSConfig(*transport, r.Host)
 	if err != nil {
-		log.Printf("error retrieving data channel: %v\n", err)
+		log.Printf("error creating configuration: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	runHelloWorld(stdout, stdin, datac)
-	fmt.Fprintf(w, "ok\n")
-}
-
-func (srv *server) dataHandler(ws *websocket.Conn) {
-	defer ws.Close()
-
-	datac, err := srv.data(ws.Request())
-	if err != nil {
-		log.Printf("error retrieving data channel: %v\n", err)
-		return
-	}
-
-	lines := make([]string, 0, 30)
-	h := hbook.NewH1D(100, 0, 500)
-	state := Data{}
-	for data := range datac {
-		if data.quit {
-			return
-		}
-		if n := len(lines); n == cap(lines) {
-			copy(lines[2:n-1], lines[3:n])
-			lines = lines[:n-1]
-			lines[1] = "[...]"
-		}
-		lines = append(lines, data.Lines)
-		h.Fill(float64(data.delta)*1e-3, 1)
-		state.Lines = strings.Join(lines, "<br>")
-		state.Plot = plotToF(h)
-
-		err := websocket.JSON.Send(ws, state)
-		if err != nil {
-			log.Printf("error sending data: %v", err)
-		}
-	}
+	go runHelloWorld(ioutil.Discard, new(bytes.Buffer), cfg)
+	fmt.Fprintf(w, "%s\n", url)
 }
 
 func plotToF(h *hbook.H1D) string {
@@ -238,28 +92,26 @@ func renderSVG(p *hplot.Plot) string {
 	return string(out.Bytes())
 }
 
+// Data is the state of a run, as displayed by the dashboard.
 type Data struct {
 	Lines string `json:"lines"`
 	Plot  string `json:"plot"`
-	delta int64
-	quit  bool
 }
 
-func runHelloWorld(w io.Writer, r io.Reader, datac chan Data) {
-	cfg, err := getSPSConfig(*transport)
-	if err != nil {
-		log.Printf("error: %v\n", err)
-		return
-	}
-
+func runHelloWorld(w io.Writer, r io.Reader, cfg config.Config) {
 	dev1 := &sink{out: make(chan token, 1), quit: make(chan int, 1)}
 	dev2 := &processor{quit: make(chan int, 1)}
 	dev3 := &sampler{quit: make(chan int, 1)}
+	web := &dashboard{states: make(chan Data, 16), done: make(chan struct{})}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 
-	errc := make(chan error)
+	// the dashboard outlives the other devices, to publish their summary.
+	webctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	errc := make(chan error, 4)
 	go func() {
 		cfg := cfg
 		cfg.ID = "sink1"
@@ -278,6 +130,29 @@ func runHelloWorld(w io.Writer, r io.Reader, datac chan Data) {
 		errc <- fer.RunDevice(ctx, cfg, dev3, r, w)
 	}()
 
+	go func() {
+		cfg := cfg
+		cfg.ID = "web"
+		cfg.Transport = "ws"
+		errc <- fer.RunDevice(webctx, cfg, web, r, w)
+	}()
+
+	lines := make([]string, 0, 30)
+	h := hbook.NewH1D(100, 0, 500)
+	publish := func(line string) {
+		if n := len(lines); n == cap(lines) {
+			copy(lines[2:n-1], lines[3:n])
+			lines = lines[:n-1]
+			lines[1] = "[...]"
+		}
+		lines = append(lines, line)
+		select {
+		case web.states <- Data{Lines: strings.Join(lines, "<br>"), Plot: plotToF(h)}:
+		default:
+			// the dashboard lags behind: drop this state.
+		}
+	}
+
 	i := 0
 loop:
 	for {
@@ -292,18 +167,21 @@ loop:
 			i++
 			if i%500 == 0 {
 				delta := out.end.Sub(out.beg)
-				datac <- Data{
-					Lines: string(out.msg),
-					delta: delta.Nanoseconds(),
-				}
+				h.Fill(float64(delta.Nanoseconds())*1e-3, 1)
+				publish(string(out.msg))
 			}
 		}
 	}
-	datac <- Data{Lines: fmt.Sprintf("%8d msgs processed by %q", dev3.n, dev3.cfg.Name())}
-	datac <- Data{Lines: fmt.Sprintf("%8d msgs processed by %q", dev2.n, dev2.cfg.Name())}
-	datac <- Data{Lines: fmt.Sprintf("%8d msgs processed by %q", dev1.n, dev1.cfg.Name())}
-	datac <- Data{Lines: "DONE"}
-	datac <- Data{quit: true}
+	publish(fmt.Sprintf("%8d msgs processed by %q", dev3.n, dev3.cfg.Name()))
+	publish(fmt.Sprintf("%8d msgs processed by %q", dev2.n, dev2.cfg.Name()))
+	publish(fmt.Sprintf("%8d msgs processed by %q", dev1.n, dev1.cfg.Name()))
+	publish("DONE")
+
+	close(web.states)
+	select {
+	case <-web.done:
+	case <-time.After(time.Second):
+	}
 }
 
 const homePage = `<html>
@@ -325,21 +203,23 @@ const homePage = `<html>
 	};
 
 	function run() {
-		var sock = new WebSocket("ws://"+location.host+"/data");
-		sock.onopen = function(){};
-		sock.onclose = function(){console.log("closing...");};
-		sock.onmessage = function(event) {
-			var data = JSON.parse(event.data);
-			update(data);
-		};
 		$.ajax({
 			url: "/run",
 			method: "POST",
 			processData: false,
 			contentData: false,
-			success: function() {},
+			success: function(url) {
+				var sock = new WebSocket(url.trim());
+				sock.binaryType = "arraybuffer";
+				sock.onopen = function(){};
+				sock.onclose = function(){console.log("closing...");};
+				sock.onmessage = function(event) {
+					var data = JSON.parse(new TextDecoder().decode(event.data));
+					update(data);
+				};
+			},
 			error: function(err) {
-				alert("/basic failed: "+JSON.stringify(err));
+				alert("/run failed: "+JSON.stringify(err));
 			}
 		});
 	};
@@ -0,0 +1,9 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	_ "github.com/alice-go/fer/mq/gochan" // load go-chan plugin
+)
@@ -0,0 +1,105 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// fer-ctl drives fer devices via their remote control server.
+//
+// Usage: fer-ctl -addr tcp://host:port CMD [CMD...]
+//
+// where CMD is one of:
+//  - state: prints the current state of the device,
+//  - watch: prints the state changes of the device, until it exits,
+//  - a device command (init-device, init-task, run, pause, stop,
+//    reset-task, reset-device, end).
+//
+// e.g.:
+//
+//  $> my-device --id dev1 --mq-config ./config.json --control tcp://localhost:7777 &
+//  $> fer-ctl -addr tcp://localhost:7777 init-device init-task run
+//  fer-ctl: INIT_DEVICE -> DEVICE READY
+//  fer-ctl: INIT_TASK -> READY
+//  fer-ctl: RUN -> RUNNING
+//  $> fer-ctl -addr tcp://localhost:7777 state
+//  fer-ctl: RUNNING
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alice-go/fer"
+)
+
+func main() {
+	addr := flag.String("addr", "", "address of the device control server (tcp://host:port, unix:///path)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `fer-ctl drives fer devices via their remote control server.
+
+Usage: fer-ctl -addr tcp://host:port CMD [CMD...]
+
+where CMD is one of:
+ - state: prints the current state of the device,
+ - watch: prints the state changes of the device, until it exits,
+ - a device command (init-device, init-task, run, pause, stop,
+   reset-task, reset-device, end).
+
+Options:
+`)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if *addr == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	log.SetFlags(0)
+	log.SetPrefix("fer-ctl: ")
+
+	cli, err := fer.DialControl(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Close()
+
+	for _, arg := range flag.Args() {
+		switch arg {
+		case "state":
+			st, err := cli.State()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("%v", st)
+
+		case "watch":
+			evts, err := cli.Subscribe()
+			if err != nil {
+				log.Fatal(err)
+			}
+			for ev := range evts {
+				log.Printf(
+					"%s: %v -> %v (%v)",
+					ev.Time.Format(time.RFC3339Nano), ev.Old, ev.New, ev.Cmd,
+				)
+			}
+
+		default:
+			var cmd fer.Cmd
+			err := cmd.UnmarshalText([]byte(strings.Replace(arg, "-", "_", -1)))
+			if err != nil {
+				log.Fatalf("invalid command %q", arg)
+			}
+			st, err := cli.Exec(cmd)
+			if err != nil {
+				log.Fatalf("could not execute %v: %v", cmd, err)
+			}
+			log.Printf("%v -> %v", cmd, st)
+		}
+	}
+}
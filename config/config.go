@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"time"
 )
 
 // Parse parses the command-line flags from os.Args[1:]. Must be called after
@@ -19,15 +20,21 @@ func Parse() (Config, error) {
 		id      = flag.String("id", "", "device ID")
 		trans   = flag.String("transport", "zeromq", "transport mechanism to use (zeromq, nanomsg, go-chan, ...)")
 		mq      = flag.String("mq-config", "", "path to JSON file holding device configuration")
-		control = flag.String("control", "interactive", "starts device in interactive/static mode")
+		control = flag.String("control", "interactive", "starts device in interactive/static mode, controlled via tcp://host:port or unix:///path, or driven by script:<file>")
+		timeout = flag.Duration("shutdown-timeout", 10*time.Second, "timeout for the orderly shutdown of the device upon SIGINT/SIGTERM")
+		sev     = flag.String("severity", "info", "minimum severity of log records (trace, debug, info, warn, error)")
+		logfmt  = flag.String("log-format", "text", "format of log records (text, json, ...)")
 	)
 
 	flag.Parse()
 
 	cfg := Config{
-		ID:        *id,
-		Transport: *trans,
-		Control:   *control,
+		ID:              *id,
+		Transport:       *trans,
+		Control:         *control,
+		ShutdownTimeout: *timeout,
+		Severity:        *sev,
+		LogFormat:       *logfmt,
 	}
 
 	f, err := os.Open(*mq)
@@ -49,7 +56,14 @@ type Config struct {
 	Options   Options `json:"fairMQOptions"`
 	ID        string  `json:"fer_id,omitempty"`
 	Transport string  `json:"fer_transport,omitempty"` // zeromq, nanomsg, chan
-	Control   string  `json:"fer_control,omitempty"`
+	Control   string  `json:"fer_control,omitempty"`   // interactive, static, tcp://host:port, unix:///path, script:<file>
+
+	// ShutdownTimeout is the time allotted to the orderly shutdown of a
+	// device upon reception of SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `json:"fer_shutdown_timeout,omitempty"`
+
+	Severity  string `json:"fer_severity,omitempty"`   // trace, debug, info, warn, error
+	LogFormat string `json:"fer_log_format,omitempty"` // text, json, ...
 }
 
 // Options holds the configuration of a Fer MQ program.
@@ -135,12 +149,28 @@ type Channel struct {
 	Name    string   `json:"name"`
 	Sockets []Socket `json:"sockets,omitempty"`
 
-	Type        string `json:"type,omitempty"`    // Type is the type of a Socket (PUB/SUB/PUSH/PULL/...)
-	Method      string `json:"method,omitempty"`  // Method to operate the socket (connect/bind)
-	Address     string `json:"address,omitempty"` // Address is the socket end-point
-	SendBufSize int    `json:"sndBufSize,omitempty"`
-	RecvBufSize int    `json:"rcvBufSize,omitempty"`
+	Type        string `json:"type,omitempty"`       // Type is the type of a Socket (PUB/SUB/PUSH/PULL/...)
+	Method      string `json:"method,omitempty"`     // Method to operate the socket (connect/bind)
+	Address     string `json:"address,omitempty"`    // Address is the socket end-point
+	SendBufSize int    `json:"sndBufSize,omitempty"` // SendBufSize is the send high-water mark of the sockets without one, in messages
+	RecvBufSize int    `json:"rcvBufSize,omitempty"` // RecvBufSize is the receive high-water mark of the sockets without one, in messages
 	RateLogging int    `json:"rateLogging,omitempty"`
+
+	// ErrorPolicy describes how errors occuring while sending or receiving
+	// data are handled:
+	//  - "fail" (default): the device is moved to the ERROR state,
+	//  - "log": the error is logged and the channel keeps on going,
+	//  - "deliver": receive errors are delivered to the device as Msg.Err
+	//    (send errors are logged.)
+	ErrorPolicy string `json:"errorPolicy,omitempty"`
+
+	// Fan describes how the messages of a channel with multiple sockets
+	// are dispatched:
+	//  - "" (default): each socket is reachable via its own Go channel,
+	//  - "in": messages received from all sockets are delivered on a
+	//    single Go channel,
+	//  - "out": each message is sent on all sockets.
+	Fan string `json:"fan,omitempty"`
 }
 
 func (ch Channel) isZero() bool {
@@ -160,6 +190,8 @@ func (ch *Channel) UnmarshalJSON(data []byte) error {
 		SendBufSize int    `json:"sndBufSize,omitempty"`
 		RecvBufSize int    `json:"rcvBufSize,omitempty"`
 		RateLogging int    `json:"rateLogging,omitempty"`
+		ErrorPolicy string `json:"errorPolicy,omitempty"`
+		Fan         string `json:"fan,omitempty"`
 	}
 
 	err := json.Unmarshal(data, &raw)
@@ -168,7 +200,7 @@ func (ch *Channel) UnmarshalJSON(data []byte) error {
 	}
 	ch.Name = raw.Name
 	ch.Sockets = ch.Sockets[:0]
-	if (raw.Socket != Socket{}) {
+	if !raw.Socket.isZero() {
 		ch.Sockets = append(ch.Sockets, raw.Socket)
 	}
 	ch.Sockets = append(ch.Sockets, raw.Sockets...)
@@ -179,28 +211,124 @@ func (ch *Channel) UnmarshalJSON(data []byte) error {
 	ch.SendBufSize = raw.SendBufSize
 	ch.RecvBufSize = raw.RecvBufSize
 	ch.RateLogging = raw.RateLogging
+	ch.ErrorPolicy = raw.ErrorPolicy
+	ch.Fan = raw.Fan
+
+	if ch.SendBufSize <= 0 && ch.RecvBufSize <= 0 {
+		return nil
+	}
+
+	// sockets without buffer sizes of their own use those of the channel,
+	// rather than the defaults of Socket.
+	var set struct {
+		Socket  bufSizesSet   `json:"socket"`
+		Sockets []bufSizesSet `json:"sockets"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return err
+	}
+	sets := set.Sockets
+	if !raw.Socket.isZero() {
+		sets = append([]bufSizesSet{set.Socket}, sets...)
+	}
+	for i, v := range sets {
+		if v.SendBufSize == nil && ch.SendBufSize > 0 {
+			ch.Sockets[i].SendBufSize = ch.SendBufSize
+		}
+		if v.RecvBufSize == nil && ch.RecvBufSize > 0 {
+			ch.Sockets[i].RecvBufSize = ch.RecvBufSize
+		}
+	}
 	return nil
 }
 
+// bufSizesSet records the buffer sizes set by the JSON configuration of a
+// socket.
+type bufSizesSet struct {
+	SendBufSize *int `json:"sndBufSize"`
+	RecvBufSize *int `json:"rcvBufSize"`
+}
+
 // Socket holds the configuration of a socket.
+//
+// SendBufSize and RecvBufSize set the "send-hwm" and "recv-hwm" options of
+// the socket.
+// Transports without high-water marks, such as the default (zeromq)
+// transport, ignore them.
 type Socket struct {
-	Type        string `json:"type"`    // Type is the type of a Socket (PUB/SUB/PUSH/PULL/...)
-	Method      string `json:"method"`  // Method to operate the socket (connect/bind)
-	Address     string `json:"address"` // Address is the socket end-point
-	SendBufSize int    `json:"sndBufSize"`
-	RecvBufSize int    `json:"rcvBufSize"`
+	Type        string `json:"type"`       // Type is the type of a Socket (PUB/SUB/PUSH/PULL/...)
+	Method      string `json:"method"`     // Method to operate the socket (connect/bind)
+	Address     string `json:"address"`    // Address is the socket end-point
+	SendBufSize int    `json:"sndBufSize"` // SendBufSize is the send high-water mark, in messages
+	RecvBufSize int    `json:"rcvBufSize"` // RecvBufSize is the receive high-water mark, in messages
 	RateLogging int    `json:"rateLogging"`
+
+	// Options holds the options of the socket, by name (see the mq.Option
+	// constants, e.g. "linger", "recv-timeout" or "tcp-keepalive".)
+	// Durations are given as strings (e.g. "100ms") or numbers of
+	// milliseconds.
+	Options map[string]interface{} `json:"options,omitempty"`
+
+	// Subscriptions holds the topics a sub socket is subscribed to.
+	// Topics are matched against the beginning of the (first part of the)
+	// messages.
+	// Sub sockets without subscriptions receive all the messages.
+	Subscriptions []string `json:"subscriptions,omitempty"`
+
+	// TLS certificates of sockets of transports securing their connections
+	// with TLS (e.g. "tls".)
+	// Peers authenticate each other: their certificates must be signed by
+	// one of the authorities of TLSCA.
+	TLSCert string `json:"tlsCert,omitempty"` // TLSCert is the path of the PEM certificate of the socket.
+	TLSKey  string `json:"tlsKey,omitempty"`  // TLSKey is the path of the PEM private key of the socket.
+	TLSCA   string `json:"tlsCA,omitempty"`   // TLSCA is the path of the PEM certificates of the trusted authorities.
+
+	// PLAIN authentication of sockets of transports supporting it
+	// (e.g. "zeromq".)
+	// Bound sockets with PlainServer set only accept the peers presenting
+	// their PlainUsername and PlainPassword credentials.
+	// Connecting sockets present their credentials to their peers.
+	PlainServer   bool   `json:"plainServer,omitempty"`
+	PlainUsername string `json:"plainUsername,omitempty"`
+	PlainPassword string `json:"plainPassword,omitempty"`
+
+	// Allow lists the IP addresses and networks (e.g. "10.0.0.0/8") of the
+	// peers allowed to connect to a bound socket.
+	// All peers are allowed when empty.
+	Allow []string `json:"allow,omitempty"`
+}
+
+func (sck Socket) isZero() bool {
+	return sck.Type == "" && sck.Method == "" && sck.Address == "" &&
+		sck.SendBufSize == 0 && sck.RecvBufSize == 0 && sck.RateLogging == 0 &&
+		len(sck.Options) == 0 && len(sck.Subscriptions) == 0 &&
+		sck.TLSCert == "" && sck.TLSKey == "" && sck.TLSCA == "" &&
+		!sck.PlainServer && sck.PlainUsername == "" && sck.PlainPassword == "" &&
+		len(sck.Allow) == 0
 }
 
 // UnmarshalJSON implements the json.Unmarshaler interface.
 func (sck *Socket) UnmarshalJSON(data []byte) error {
 	var raw struct {
-		Type        string `json:"type"`
-		Method      string `json:"method"`
-		Address     string `json:"address"`
-		SendBufSize int    `json:"sndBufSize"`
-		RecvBufSize int    `json:"rcvBufSize"`
-		RateLogging int    `json:"rateLogging"`
+		Type        string                 `json:"type"`
+		Method      string                 `json:"method"`
+		Address     string                 `json:"address"`
+		SendBufSize int                    `json:"sndBufSize"`
+		RecvBufSize int                    `json:"rcvBufSize"`
+		RateLogging int                    `json:"rateLogging"`
+		Options     map[string]interface{} `json:"options"`
+
+		Subscriptions []string `json:"subscriptions"`
+
+		TLSCert string `json:"tlsCert"`
+		TLSKey  string `json:"tlsKey"`
+		TLSCA   string `json:"tlsCA"`
+
+		PlainServer   bool     `json:"plainServer"`
+		PlainUsername string   `json:"plainUsername"`
+		PlainPassword string   `json:"plainPassword"`
+		Allow         []string `json:"allow"`
 	}
 
 	err := json.Unmarshal(data, &raw)
@@ -214,6 +342,15 @@ func (sck *Socket) UnmarshalJSON(data []byte) error {
 	sck.SendBufSize = raw.SendBufSize
 	sck.RecvBufSize = raw.RecvBufSize
 	sck.RateLogging = raw.RateLogging
+	sck.Options = raw.Options
+	sck.Subscriptions = raw.Subscriptions
+	sck.TLSCert = raw.TLSCert
+	sck.TLSKey = raw.TLSKey
+	sck.TLSCA = raw.TLSCA
+	sck.PlainServer = raw.PlainServer
+	sck.PlainUsername = raw.PlainUsername
+	sck.PlainPassword = raw.PlainPassword
+	sck.Allow = raw.Allow
 
 	if sck.SendBufSize == 0 {
 		sck.SendBufSize = 1000
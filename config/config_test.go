@@ -7,6 +7,7 @@ package config
 import (
 	"bytes"
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -191,3 +192,109 @@ func TestConfigParser(t *testing.T) {
 		//fmt.Printf("cfg[%s]=%#v\n", n, cfg)
 	}
 }
+
+func TestSocketOptions(t *testing.T) {
+	var sck Socket
+	err := json.Unmarshal([]byte(`{
+		"type": "sub",
+		"method": "connect",
+		"address": "tcp://localhost:5555",
+		"options": {"linger": "100ms", "recv-timeout": 500, "tcp-keepalive": false}
+	}`), &sck)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"linger":        "100ms",
+		"recv-timeout":  500.0,
+		"tcp-keepalive": false,
+	}
+	if !reflect.DeepEqual(sck.Options, want) {
+		t.Fatalf("invalid options: got=%v, want=%v", sck.Options, want)
+	}
+
+	var ch Channel
+	err = json.Unmarshal([]byte(`{"name": "data", "socket": {"options": {"linger": 0}}}`), &ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Sockets) != 1 || ch.Sockets[0].Options["linger"] != 0.0 {
+		t.Fatalf("invalid channel sockets: %+v", ch.Sockets)
+	}
+}
+
+func TestChannelBufSizes(t *testing.T) {
+	var ch Channel
+	err := json.Unmarshal([]byte(`{
+		"name": "data",
+		"sndBufSize": 10,
+		"socket": {"type": "push"},
+		"sockets": [
+			{"type": "push", "sndBufSize": 20},
+			{"type": "push", "rcvBufSize": 30}
+		]
+	}`), &ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sockets without buffer sizes use those of the channel, if any.
+	want := [][2]int{{10, 1000}, {20, 1000}, {10, 30}}
+	if len(ch.Sockets) != len(want) {
+		t.Fatalf("invalid channel sockets: %+v", ch.Sockets)
+	}
+	for i, sck := range ch.Sockets {
+		if got := [2]int{sck.SendBufSize, sck.RecvBufSize}; got != want[i] {
+			t.Errorf("socket[%d]: invalid buffer sizes: got=%v, want=%v", i, got, want[i])
+		}
+	}
+}
+
+func TestSocketTLS(t *testing.T) {
+	var ch Channel
+	err := json.Unmarshal([]byte(`{
+		"name": "data",
+		"socket": {
+			"tlsCert": "/etc/fer/cert.pem",
+			"tlsKey": "/etc/fer/key.pem",
+			"tlsCA": "/etc/fer/ca.pem"
+		}
+	}`), &ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Sockets) != 1 {
+		t.Fatalf("invalid channel sockets: %+v", ch.Sockets)
+	}
+	sck := ch.Sockets[0]
+	if sck.TLSCert != "/etc/fer/cert.pem" || sck.TLSKey != "/etc/fer/key.pem" || sck.TLSCA != "/etc/fer/ca.pem" {
+		t.Fatalf("invalid TLS certificates: %+v", sck)
+	}
+}
+
+func TestSocketPlain(t *testing.T) {
+	var ch Channel
+	err := json.Unmarshal([]byte(`{
+		"name": "data",
+		"socket": {
+			"plainServer": true,
+			"plainUsername": "fer",
+			"plainPassword": "secret",
+			"allow": ["127.0.0.1", "10.0.0.0/8"]
+		}
+	}`), &ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Sockets) != 1 {
+		t.Fatalf("invalid channel sockets: %+v", ch.Sockets)
+	}
+	sck := ch.Sockets[0]
+	if !sck.PlainServer || sck.PlainUsername != "fer" || sck.PlainPassword != "secret" {
+		t.Fatalf("invalid PLAIN credentials: %+v", sck)
+	}
+	if want := []string{"127.0.0.1", "10.0.0.0/8"}; !reflect.DeepEqual(sck.Allow, want) {
+		t.Fatalf("invalid allow-list: got=%q, want=%q", sck.Allow, want)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// console implements the interactive control mode of a device.
+// It reads commands, one per line, and drives the device accordingly.
+// The output of the commands is written to out, regardless of the severity
+// and format of the logs of the device; errors are logged.
+type console struct {
+	dev  *device
+	out  io.Writer
+	cmds []consoleCmd
+	hist []string
+}
+
+// consoleCmd describes a command of the interactive console.
+type consoleCmd struct {
+	name  string // name is the name of the command.
+	short string // short is the single-letter shortcut of the command.
+	help  string
+	run   func(c *console) (quit bool, err error)
+}
+
+func newConsole(dev *device, w io.Writer) *console {
+	c := &console{dev: dev, out: w}
+	c.cmds = []consoleCmd{
+		{name: "help", short: "h", help: "print this help message", run: (*console).help},
+		{name: "init", help: "initialize the device and its task (-> READY)", run: (*console).initialize},
+		{name: "init-device", short: "i", help: "initialize the device (-> DEVICE READY)", run: execCmd(CmdInitDevice)},
+		{name: "init-task", short: "j", help: "initialize the task of the device (-> READY)", run: execCmd(CmdInitTask)},
+		{name: "run", short: "r", help: "run or resume the device (-> RUNNING)", run: execCmd(CmdRun)},
+		{name: "pause", short: "p", help: "pause the device (-> PAUSED)", run: execCmd(CmdPause)},
+		{name: "stop", short: "s", help: "stop the device (-> READY)", run: execCmd(CmdStop)},
+		{name: "reset", help: "reset the task and the device (-> IDLE)", run: (*console).reset},
+		{name: "reset-task", short: "t", help: "reset the task of the device (-> DEVICE READY)", run: execCmd(CmdResetTask)},
+		{name: "reset-device", short: "d", help: "reset the device (-> IDLE)", run: execCmd(CmdResetDevice)},
+		{name: "end", short: "q", help: "stop, reset and end the device (-> EXITING)", run: (*console).end},
+		{name: "state", help: "print the current state of the device", run: (*console).state},
+		{name: "channels", help: "print the channels of the device", run: (*console).channels},
+		{name: "stats", help: "print the number of messages and bytes sent and received per channel", run: (*console).stats},
+		{name: "history", help: "print the history of commands (use !N or !! to re-run a command)", run: (*console).history},
+	}
+	return c
+}
+
+func (dev *device) input(ctx context.Context, r io.Reader, w io.Writer) {
+	err := newConsole(dev, w).run(r)
+	if err != nil {
+		dev.msg.Errorf("could not read interactive commands: %v\n", err)
+	}
+}
+
+func (c *console) run(r io.Reader) error {
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" {
+			continue
+		}
+		select {
+		case <-c.dev.exit:
+			// the device exited: no command can be run anymore.
+			return nil
+		default:
+		}
+		if c.eval(line) {
+			return nil
+		}
+	}
+	return scan.Err()
+}
+
+// eval evaluates a command line and returns whether the console should quit.
+func (c *console) eval(line string) bool {
+	if strings.HasPrefix(line, "!") {
+		v, err := c.recall(line)
+		if err != nil {
+			c.dev.msg.Errorf("%v\n", err)
+			return false
+		}
+		c.printf("%s\n", v)
+		line = v
+	}
+
+	cmd, ok := c.lookup(line)
+	if !ok {
+		c.dev.msg.Errorf("unknown command %q (type \"help\" for the list of commands)\n", line)
+		return false
+	}
+	c.hist = append(c.hist, line)
+
+	quit, err := cmd.run(c)
+	if err != nil {
+		c.dev.msg.Errorf("%s: %v\n", cmd.name, err)
+	}
+	return quit
+}
+
+func (c *console) lookup(name string) (consoleCmd, bool) {
+	name = strings.ToLower(name)
+	for _, cmd := range c.cmds {
+		if name == cmd.name || (cmd.short != "" && name == cmd.short) {
+			return cmd, true
+		}
+	}
+	if name == "quit" || name == "exit" {
+		return c.lookup("end")
+	}
+	if name == "?" {
+		return c.lookup("help")
+	}
+	return consoleCmd{}, false
+}
+
+// recall returns the command line from history designated by v
+// ("!!" for the last command, "!N" for the N-th command.)
+func (c *console) recall(v string) (string, error) {
+	if len(c.hist) == 0 {
+		return "", xerrors.Errorf("no command in history")
+	}
+	if v == "!!" {
+		return c.hist[len(c.hist)-1], nil
+	}
+	i, err := strconv.Atoi(v[1:])
+	if err != nil || i < 1 || i > len(c.hist) {
+		return "", xerrors.Errorf("invalid history recall %q (valid range: !1-!%d)", v, len(c.hist))
+	}
+	return c.hist[i-1], nil
+}
+
+// exec executes the provided sequence of commands, stopping at the first
+// command not allowed in the current state of the device.
+func (c *console) exec(cmds ...Cmd) error {
+	for _, cmd := range cmds {
+		st := c.dev.State()
+		if transitions[st][cmd] == StateInvalid {
+			return xerrors.Errorf("command %v is not allowed in state %v", cmd, st)
+		}
+		err := c.dev.exec(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	c.printf("state: %v\n", c.dev.State())
+	return nil
+}
+
+// printf writes the output of a command to the console.
+func (c *console) printf(format string, v ...interface{}) {
+	fmt.Fprintf(c.out, format, v...)
+}
+
+func execCmd(cmd Cmd) func(c *console) (bool, error) {
+	return func(c *console) (bool, error) {
+		return false, c.exec(cmd)
+	}
+}
+
+func (c *console) help() (bool, error) {
+	c.printf("interactive commands:\n")
+	for _, cmd := range c.cmds {
+		name := cmd.name
+		if cmd.short != "" {
+			name += " (" + cmd.short + ")"
+		}
+		c.printf("  %-18s %s\n", name, cmd.help)
+	}
+	return false, nil
+}
+
+func (c *console) initialize() (bool, error) {
+	switch st := c.dev.State(); st {
+	case StateIdle:
+		return false, c.exec(CmdInitDevice, CmdInitTask)
+	case StateDeviceReady:
+		return false, c.exec(CmdInitTask)
+	default:
+		return false, xerrors.Errorf("cannot initialize device in state %v", st)
+	}
+}
+
+func (c *console) reset() (bool, error) {
+	switch st := c.dev.State(); st {
+	case StateReady:
+		return false, c.exec(CmdResetTask, CmdResetDevice)
+	case StateDeviceReady:
+		return false, c.exec(CmdResetDevice)
+	default:
+		return false, xerrors.Errorf("cannot reset device in state %v", st)
+	}
+}
+
+func (c *console) end() (bool, error) {
+	return true, c.dev.shutdown()
+}
+
+func (c *console) state() (bool, error) {
+	c.printf("state: %v\n", c.dev.State())
+	return false, nil
+}
+
+func (c *console) channels() (bool, error) {
+	for _, name := range c.dev.chanNames() {
+		for i, ch := range c.dev.chans[name] {
+			sck := ch.socket()
+			c.printf("%s[%d]: %s %s %s\n", name, i, sck.Type, sck.Method, sck.Address)
+		}
+	}
+	return false, nil
+}
+
+func (c *console) stats() (bool, error) {
+	for _, st := range c.dev.Stats() {
+		c.printf(
+			"%s[%d]: in: %d msgs (%d bytes), out: %d msgs (%d bytes)\n",
+			st.Channel, st.Socket,
+			st.MsgsIn, st.BytesIn,
+			st.MsgsOut, st.BytesOut,
+		)
+	}
+	return false, nil
+}
+
+func (c *console) history() (bool, error) {
+	for i, v := range c.hist {
+		c.printf("%4d  %s\n", i+1, v)
+	}
+	return false, nil
+}
+
+// chanNames returns the sorted list of channel names of the device.
+func (dev *device) chanNames() []string {
+	names := make([]string, 0, len(dev.chans))
+	for name := range dev.chans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// syncWriter serializes the writes to w, shared by the console and the log
+// sink of a device.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
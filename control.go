@@ -0,0 +1,283 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// ctlRequest is a request sent to the control server of a device.
+//
+// The control protocol is made of line-delimited JSON values:
+//  {"op": "exec", "cmd": "INIT_DEVICE"}
+//  {"op": "state"}
+//  {"op": "subscribe"}
+// Each request is answered with a ctlReply holding the state of the device
+// and the error that may have occured.
+// After a "subscribe" request, the state changes of the device are streamed
+// back as ctlReply values with a non-nil Event field.
+type ctlRequest struct {
+	Op  string `json:"op"`
+	Cmd *Cmd   `json:"cmd,omitempty"`
+}
+
+// ctlReply is the reply of the control server of a device.
+type ctlReply struct {
+	State State        `json:"state"`
+	Err   string       `json:"error,omitempty"`
+	Event *StateChange `json:"event,omitempty"`
+}
+
+// isControlAddr returns whether the provided control mode is the address
+// of a control server.
+func isControlAddr(ctl string) bool {
+	_, _, err := splitControlAddr(ctl)
+	return err == nil
+}
+
+// splitControlAddr splits a control server address of the form
+// "tcp://host:port" or "unix:///path/to/socket" into its network and
+// address components.
+func splitControlAddr(addr string) (network, address string, err error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "", "", xerrors.Errorf("fer: invalid control address %q", addr)
+	}
+	network = addr[:i]
+	address = addr[i+len("://"):]
+	switch network {
+	case "tcp", "unix":
+		return network, address, nil
+	}
+	return "", "", xerrors.Errorf("fer: invalid control address network %q (address=%q)", network, addr)
+}
+
+// serveControl serves the remote control of the device on the provided
+// listener, until the device exits.
+func (dev *device) serveControl(l net.Listener) {
+	go func() {
+		<-dev.exit
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go dev.serveControlConn(conn)
+	}
+}
+
+func (dev *device) serveControlConn(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		dec = json.NewDecoder(conn)
+
+		// busy is held while a request is being processed, so a closing
+		// subscription does not cut off the last reply.
+		busy       sync.Mutex
+		subscribed bool // guarded by busy
+
+		mu  sync.Mutex
+		enc = json.NewEncoder(conn)
+	)
+
+	send := func(rep ctlReply) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(rep)
+	}
+
+	// the connection is closed when the device exits, after the reply to
+	// the request being processed, if any.
+	// Subscribed connections are closed once the last state changes have
+	// been sent instead.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-dev.exit:
+			busy.Lock()
+			if !subscribed {
+				conn.Close()
+			}
+			busy.Unlock()
+		case <-done:
+		}
+	}()
+
+	var unsub func()
+	defer func() {
+		if unsub != nil {
+			unsub()
+		}
+	}()
+
+	for {
+		var req ctlRequest
+		err := dec.Decode(&req)
+		if err != nil {
+			return
+		}
+
+		busy.Lock()
+		switch req.Op {
+		case "exec":
+			if req.Cmd == nil {
+				err = xerrors.Errorf("fer: missing command to execute")
+				break
+			}
+			err = dev.exec(*req.Cmd)
+		case "state":
+		case "subscribe":
+			if unsub != nil {
+				err = xerrors.Errorf("fer: already subscribed")
+				break
+			}
+			var evts <-chan StateChange
+			evts, unsub = dev.Subscribe()
+			subscribed = true
+			go func() {
+				for ev := range evts {
+					ev := ev
+					err := send(ctlReply{State: ev.New, Event: &ev})
+					if err != nil {
+						return
+					}
+				}
+				// the device exited.
+				busy.Lock()
+				conn.Close()
+				busy.Unlock()
+			}()
+		default:
+			err = xerrors.Errorf("fer: invalid control operation %q", req.Op)
+		}
+
+		rep := ctlReply{State: dev.State()}
+		if err != nil {
+			rep.Err = err.Error()
+		}
+		err = send(rep)
+		busy.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ControlClient is a client to the remote control server of a device.
+//
+// A device serves remote control requests when it is started with a control
+// mode of the form "tcp://host:port" or "unix:///path/to/socket".
+type ControlClient struct {
+	conn net.Conn
+
+	mu   sync.Mutex // serializes requests
+	enc  *json.Encoder
+	reps chan ctlReply
+
+	// evts queues the state changes of the device, so a subscriber that
+	// does not drain them never blocks the replies to later requests.
+	evts *subscriber
+	once sync.Once
+}
+
+// DialControl connects to the control server of a device at the provided
+// address.
+func DialControl(addr string) (*ControlClient, error) {
+	network, address, err := splitControlAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, xerrors.Errorf("fer: could not dial control server: %w", err)
+	}
+
+	cli := &ControlClient{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		reps: make(chan ctlReply),
+		evts: newSubscriber(),
+	}
+	go cli.read()
+	return cli, nil
+}
+
+// Close closes the connection to the control server.
+// The state changes not yet delivered to the subscriber are discarded.
+func (cli *ControlClient) Close() error {
+	cli.once.Do(func() { close(cli.evts.quit) })
+	return cli.conn.Close()
+}
+
+func (cli *ControlClient) read() {
+	defer close(cli.reps)
+	defer cli.evts.close()
+
+	scan := bufio.NewScanner(cli.conn)
+	for scan.Scan() {
+		var rep ctlReply
+		err := json.Unmarshal(scan.Bytes(), &rep)
+		if err != nil {
+			return
+		}
+		if rep.Event != nil {
+			cli.evts.notify(*rep.Event)
+			continue
+		}
+		cli.reps <- rep
+	}
+}
+
+func (cli *ControlClient) do(req ctlRequest) (State, error) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	err := cli.enc.Encode(req)
+	if err != nil {
+		return StateInvalid, xerrors.Errorf("fer: could not send control request: %w", err)
+	}
+
+	rep, ok := <-cli.reps
+	if !ok {
+		return StateInvalid, xerrors.Errorf("fer: control connection closed")
+	}
+	if rep.Err != "" {
+		return rep.State, xerrors.New(rep.Err)
+	}
+	return rep.State, nil
+}
+
+// Exec sends a command to the device and returns the state of the device
+// after the command was processed.
+func (cli *ControlClient) Exec(cmd Cmd) (State, error) {
+	return cli.do(ctlRequest{Op: "exec", Cmd: &cmd})
+}
+
+// State returns the current state of the device.
+func (cli *ControlClient) State() (State, error) {
+	return cli.do(ctlRequest{Op: "state"})
+}
+
+// Subscribe returns a channel on which the state changes of the device are
+// delivered.
+// The channel is closed when the connection to the device is closed.
+func (cli *ControlClient) Subscribe() (<-chan StateChange, error) {
+	_, err := cli.do(ctlRequest{Op: "subscribe"})
+	if err != nil {
+		return nil, err
+	}
+	return cli.evts.out, nil
+}
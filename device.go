@@ -5,13 +5,15 @@
 package fer
 
 import (
-	"bufio"
 	"context"
 	"io"
-	"log"
+	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alice-go/fer/config"
 	"github.com/alice-go/fer/mq"
@@ -20,52 +22,129 @@ import (
 )
 
 type channel struct {
-	cfg config.Channel
-	sck mq.Socket
-	cmd chan Cmd
-	msg chan Msg
-	log *log.Logger
+	cfg    config.Channel
+	idx    int // idx is the index of the channel's socket in cfg.Sockets.
+	sck    mq.Socket
+	cmd    chan Cmd
+	msg    chan Msg
+	reqs   chan request // reqs holds the requests of req/dealer and rep/router channels.
+	log    *logger
+	stats  *chanStats
+	policy errPolicy
+	dev    *device
+	done   chan struct{} // done is closed once the channel's socket is closed.
+
+	// outs are the channels a fan-out channel sends each message to.
+	outs []*channel
+}
+
+// errPolicy describes how a channel handles the errors occuring while sending
+// or receiving data.
+type errPolicy int
+
+const (
+	policyFail    errPolicy = iota // move the device to the ERROR state.
+	policyLog                      // log the error and continue.
+	policyDeliver                  // deliver receive errors to the device as Msg.Err.
+)
+
+func errPolicyFrom(name string) (errPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "fail":
+		return policyFail, nil
+	case "log":
+		return policyLog, nil
+	case "deliver":
+		return policyDeliver, nil
+	}
+	return policyFail, xerrors.Errorf("fer: invalid channel error policy (value=%q)", name)
 }
 
 func (ch *channel) Name() string {
 	return ch.cfg.Name
 }
 
+// socket returns the configuration of the channel's socket.
+func (ch *channel) socket() config.Socket {
+	return ch.cfg.Sockets[ch.idx]
+}
+
 func (ch *channel) Send(data []byte) (int, error) {
 	err := ch.sck.Send(data)
+	if err == nil {
+		atomic.AddInt64(&ch.stats.msgsOut, 1)
+		atomic.AddInt64(&ch.stats.bytesOut, int64(len(data)))
+	}
 	return len(data), err
 }
 
 func (ch *channel) Recv() ([]byte, error) {
-	return ch.sck.Recv()
+	data, err := ch.sck.Recv()
+	if err == nil {
+		atomic.AddInt64(&ch.stats.msgsIn, 1)
+		atomic.AddInt64(&ch.stats.bytesIn, int64(len(data)))
+	}
+	return data, err
 }
 
 func (ch *channel) run(ctx context.Context) {
+	quit := make(chan struct{})
+	defer close(ch.done)
+	defer ch.sck.Close()
+	defer close(quit)
+
+	if dt := ch.rateLogging(); dt > 0 {
+		go ch.logRates(dt, quit)
+	}
+
 	typ := ch.sck.Type()
 	// ch.log.Printf("--- run [%v]\n", typ)
-	switch typ {
-	case mq.Pub, mq.Push, mq.Sub:
+	if isSender(typ) && (ch.cfg.Fan != fanOut || ch.idx == 0) {
+		outs := ch.outs
+		if outs == nil {
+			outs = []*channel{ch}
+		}
 		go func() {
-			for msg := range ch.msg {
-				if len(msg.Data) <= 0 {
-					continue
-				}
-				_, err := ch.Send(msg.Data)
-				if err != nil {
-					ch.log.Fatalf("send error: %v\n", err)
+			for {
+				select {
+				case msg := <-ch.msg:
+					if len(msg.Data) <= 0 && len(msg.Parts) == 0 {
+						continue
+					}
+					for _, out := range outs {
+						err := out.send(msg)
+						if err != nil && !out.handle(quit, "send", err) {
+							return
+						}
+					}
+				case <-quit:
+					return
 				}
 			}
 		}()
 	}
 
 	switch typ {
-	case mq.Pub, mq.Pull, mq.Sub:
+	case mq.Req, mq.Dealer:
+		go ch.requests(quit)
+	case mq.Rep, mq.Router:
+		go ch.replies(quit)
+	}
+
+	if isReceiver(typ) {
 		go func() {
 			for {
-				data, err := ch.Recv()
-				ch.msg <- Msg{data, err}
-				if err != nil {
-					ch.log.Fatalf("recv error: %v\n", err)
+				msg := ch.recv()
+				if msg.Err != nil {
+					if !ch.handle(quit, "recv", msg.Err) {
+						return
+					}
+					continue
+				}
+				select {
+				case ch.msg <- msg:
+				case <-quit:
+					return
 				}
 			}
 		}()
@@ -84,49 +163,399 @@ func (ch *channel) run(ctx context.Context) {
 	}
 }
 
+// handle handles an error that occured while sending or receiving data,
+// according to the error policy of the channel.
+// handle returns whether the channel should keep on sending or receiving data.
+func (ch *channel) handle(quit chan struct{}, op string, err error) bool {
+	select {
+	case <-quit:
+		// channel is closing.
+		return false
+	default:
+	}
+
+	err = ch.error(op, err)
+
+	switch {
+	case ch.policy == policyDeliver && op == "recv" && isReceiver(ch.sck.Type()):
+		select {
+		case ch.msg <- Msg{Err: err}:
+			return true
+		case <-quit:
+			return false
+		}
+	case ch.policy == policyFail:
+		_ = ch.dev.abort(err)
+		return false
+	default:
+		ch.log.Errorf("%v\n", err)
+		return true
+	}
+}
+
+// error wraps an error that occured while sending or receiving data.
+func (ch *channel) error(op string, err error) error {
+	return &ChannelError{
+		Channel: ch.cfg.Name,
+		Addr:    ch.socket().Address,
+		Op:      op,
+		Err:     err,
+	}
+}
+
+// recv receives a message from the channel's socket.
+// Multipart messages are received with their parts in Msg.Parts.
 func (ch *channel) recv() Msg {
-	data, err := ch.Recv()
-	return Msg{
-		Data: data,
-		Err:  err,
+	parts, err := ch.sck.RecvMulti()
+	if err != nil {
+		return Msg{Err: err}
+	}
+	msg := msgFrom(parts)
+	atomic.AddInt64(&ch.stats.msgsIn, 1)
+	atomic.AddInt64(&ch.stats.bytesIn, int64(msg.size()))
+	return msg
+}
+
+// send sends a message through the channel's socket.
+// Messages with parts are sent as multipart messages.
+func (ch *channel) send(msg Msg) error {
+	if len(msg.Parts) == 0 {
+		_, err := ch.Send(msg.Data)
+		return err
 	}
+	err := ch.sck.SendMulti(msg.Parts)
+	if err == nil {
+		atomic.AddInt64(&ch.stats.msgsOut, 1)
+		atomic.AddInt64(&ch.stats.bytesOut, int64(msg.size()))
+	}
+	return err
 }
 
-func newChannel(drv mq.Driver, cfg config.Channel, dev *device, w io.Writer) (channel, error) {
+// Fan modes of channels with multiple sockets.
+const (
+	fanIn  = "in"  // messages received from all sockets are delivered on one Go channel.
+	fanOut = "out" // messages are sent on all sockets.
+)
+
+// newChannels creates the channels associated with each of the sockets of
+// the provided channel configuration.
+func newChannels(drv mq.Driver, cfg config.Channel, dev *device) ([]channel, error) {
+	if len(cfg.Sockets) == 0 {
+		return nil, xerrors.Errorf("fer: channel %q has no socket", cfg.Name)
+	}
+
+	var isValid func(typ mq.SocketType) bool
+	switch cfg.Fan {
+	case "":
+	case fanIn:
+		isValid = isReceiver
+	case fanOut:
+		isValid = isSender
+	default:
+		return nil, xerrors.Errorf("fer: invalid fan mode for channel %q (value=%q)", cfg.Name, cfg.Fan)
+	}
+
+	// sockets of fan-in/fan-out channels share a Go channel, sized for the
+	// largest buffer.
+	shared := 0
+	for i := range cfg.Sockets {
+		if n := bufSize(cfg, i); n > shared {
+			shared = n
+		}
+	}
+
+	var (
+		chans = make([]channel, len(cfg.Sockets))
+		msg   = make(chan Msg, shared)
+	)
+	for i := range cfg.Sockets {
+		if isValid != nil && !isValid(mq.SocketTypeFrom(cfg.Sockets[i].Type)) {
+			closeChannels(chans[:i])
+			return nil, xerrors.Errorf(
+				"fer: invalid socket type %q for fan-%s channel %q",
+				cfg.Sockets[i].Type, cfg.Fan, cfg.Name,
+			)
+		}
+		ch, err := newChannel(drv, cfg, i, dev)
+		if err != nil {
+			closeChannels(chans[:i])
+			return nil, err
+		}
+		ch.msg = msg
+		if cfg.Fan == "" {
+			ch.msg = make(chan Msg, bufSize(cfg, i))
+		}
+		chans[i] = ch
+	}
+
+	if cfg.Fan == fanOut {
+		for i := range chans {
+			chans[0].outs = append(chans[0].outs, &chans[i])
+		}
+	}
+	return chans, nil
+}
+
+// closeChannels closes the sockets of the provided channels.
+func closeChannels(chans []channel) {
+	for _, ch := range chans {
+		ch.sck.Close()
+	}
+}
+
+func newChannel(drv mq.Driver, cfg config.Channel, i int, dev *device) (channel, error) {
+	log := dev.msg.with("channel", cfg.Name)
+	if len(cfg.Sockets) > 1 {
+		log = log.with("socket", i)
+	}
 	ch := channel{
-		cmd: make(chan Cmd),
-		cfg: cfg,
-		log: log.New(w, dev.name+"."+cfg.Name+": ", 0),
+		cmd:   make(chan Cmd),
+		reqs:  make(chan request),
+		cfg:   cfg,
+		idx:   i,
+		log:   log,
+		stats: new(chanStats),
+		dev:   dev,
+		done:  make(chan struct{}),
+	}
+	policy, err := errPolicyFrom(cfg.ErrorPolicy)
+	if err != nil {
+		return ch, err
 	}
-	// FIXME(sbinet) support multiple sockets to send/recv to/from
-	if len(cfg.Sockets) != 1 {
-		panic("fer: not implemented")
+	ch.policy = policy
+
+	typ := mq.SocketTypeFrom(ch.socket().Type)
+	if isTwoWay(typ) {
+		// a channel has a single Go channel, which can not carry both the
+		// sent and the received messages.
+		return ch, xerrors.Errorf(
+			"fer: invalid socket type %q for channel %q: devices can not both send and receive data on a channel",
+			ch.socket().Type, cfg.Name,
+		)
 	}
-	typ := mq.SocketTypeFrom(cfg.Sockets[0].Type)
 	sck, err := drv.NewSocket(typ)
 	if err != nil {
 		return ch, err
 	}
 	ch.sck = sck
+
+	snd, rcv := bufSizes(cfg, i)
+	for _, opt := range []struct {
+		name string
+		size int
+	}{
+		{mq.OptionSendHWM, snd},
+		{mq.OptionRecvHWM, rcv},
+	} {
+		if opt.size <= 0 {
+			continue
+		}
+		err = sck.SetOption(opt.name, opt.size)
+		var unsupported *mq.UnsupportedOptionError
+		switch {
+		case err == nil:
+		case xerrors.As(err, &unsupported):
+			// not all transports support high-water marks, and sockets
+			// decoded from JSON have default ones: this is only logged
+			// once per device.
+			if !dev.ignored[opt.name] {
+				dev.ignored[opt.name] = true
+				dev.msg.Debugf("ignoring option %s: %v\n", opt.name, err)
+			}
+		default:
+			sck.Close()
+			return ch, xerrors.Errorf("fer: could not set option %q of channel %q: %w", opt.name, cfg.Name, err)
+		}
+	}
+
+	opts := ch.socket().Options
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, err := mq.OptionValue(name, opts[name])
+		if err == nil {
+			err = sck.SetOption(name, v)
+		}
+		var unsupported *mq.UnsupportedOptionError
+		switch {
+		case err == nil:
+		case xerrors.As(err, &unsupported):
+			ch.log.Warnf("ignoring option %s=%v: %v\n", name, opts[name], err)
+		default:
+			sck.Close()
+			return ch, xerrors.Errorf("fer: could not set option %q of channel %q: %w", name, cfg.Name, err)
+		}
+	}
+
+	err = ch.secure()
+	if err != nil {
+		sck.Close()
+		return ch, err
+	}
+
+	err = ch.subscribe(ch.socket().Subscriptions)
+	if err != nil {
+		sck.Close()
+		return ch, err
+	}
 	return ch, nil
 }
 
+// secure configures the TLS certificates, PLAIN credentials and allow-list of
+// the socket, if any.
+// Unlike other options, security options not supported by the transport are
+// an error, rather than leaving the channel unsecured.
+func (ch *channel) secure() error {
+	sck := ch.socket()
+	for _, opt := range []struct {
+		name  string
+		value interface{}
+		set   bool
+	}{
+		{mq.OptionTLSCert, sck.TLSCert, sck.TLSCert != ""},
+		{mq.OptionTLSKey, sck.TLSKey, sck.TLSKey != ""},
+		{mq.OptionTLSCA, sck.TLSCA, sck.TLSCA != ""},
+		{mq.OptionPlainServer, sck.PlainServer, sck.PlainServer},
+		{mq.OptionPlainUsername, sck.PlainUsername, sck.PlainUsername != ""},
+		{mq.OptionPlainPassword, sck.PlainPassword, sck.PlainPassword != ""},
+		{mq.OptionAllow, sck.Allow, len(sck.Allow) > 0},
+	} {
+		if !opt.set {
+			continue
+		}
+		err := ch.sck.SetOption(opt.name, opt.value)
+		if err != nil {
+			return xerrors.Errorf("fer: could not secure channel %q: %w", ch.cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// subscribe replaces the default subscription of sub sockets, to all the
+// messages, with the provided topics.
+func (ch *channel) subscribe(topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	switch typ := ch.sck.Type(); typ {
+	case mq.Sub, mq.XSub:
+	default:
+		return xerrors.Errorf("fer: invalid subscriptions for %v socket of channel %q", typ, ch.cfg.Name)
+	}
+
+	err := ch.sck.SetOption(mq.OptionUnsubscribe, "")
+	if err != nil {
+		return xerrors.Errorf("fer: could not unsubscribe channel %q: %w", ch.cfg.Name, err)
+	}
+	for _, topic := range topics {
+		err = ch.sck.SetOption(mq.OptionSubscribe, topic)
+		if err != nil {
+			return xerrors.Errorf("fer: could not subscribe channel %q to %q: %w", ch.cfg.Name, topic, err)
+		}
+	}
+	return nil
+}
+
+// bufSizes returns the sizes of the send and receive buffers of the i-th
+// socket of a channel.
+// Sockets without buffer sizes of their own use those of the channel.
+func bufSizes(cfg config.Channel, i int) (snd, rcv int) {
+	sck := cfg.Sockets[i]
+	snd, rcv = sck.SendBufSize, sck.RecvBufSize
+	if snd <= 0 {
+		snd = cfg.SendBufSize
+	}
+	if rcv <= 0 {
+		rcv = cfg.RecvBufSize
+	}
+	return snd, rcv
+}
+
+// bufSize returns the capacity of the Go channel associated with the i-th
+// socket of a channel: the size of its send buffer for sending sockets, the
+// size of its receive buffer for receiving sockets.
+func bufSize(cfg config.Channel, i int) int {
+	snd, rcv := bufSizes(cfg, i)
+	typ := mq.SocketTypeFrom(cfg.Sockets[i].Type)
+	switch {
+	case isSender(typ) && snd > 0:
+		return snd
+	case isReceiver(typ) && rcv > 0:
+		return rcv
+	}
+	return 0
+}
+
+// isSender returns whether data is sent through sockets of the provided type.
+func isSender(typ mq.SocketType) bool {
+	switch typ {
+	case mq.Pub, mq.XPub, mq.Push:
+		return true
+	}
+	return false
+}
+
+// isReceiver returns whether data is received from sockets of the provided type.
+func isReceiver(typ mq.SocketType) bool {
+	switch typ {
+	case mq.Sub, mq.XSub, mq.Pull:
+		return true
+	}
+	return false
+}
+
+// isTwoWay returns whether data is both sent and received, outside of a
+// request/reply pattern, through sockets of the provided type.
+func isTwoWay(typ mq.SocketType) bool {
+	switch typ {
+	case mq.Pair, mq.Bus, mq.Star, mq.Surveyor, mq.Respondent:
+		return true
+	}
+	return false
+}
+
 type msgAddr struct {
 	name string
 	id   int
 }
 
+// cmdReq is a command sent to the dispatch loop of a device, together with
+// the channel on which the outcome of the requested transition is reported.
+type cmdReq struct {
+	cmd  Cmd
+	err  error // err is the cause of an ERROR_FOUND command.
+	errc chan error
+}
+
 type device struct {
 	name  string
 	cfg   config.Device
 	chans map[string][]channel
-	done  chan Cmd
 	quit  chan error
-	cmds  chan Cmd
+	exit  chan struct{} // exit is closed when the dispatch loop exits.
+	cmds  chan cmdReq
 	msgs  map[msgAddr]chan Msg
-	msg   *log.Logger
+	msg   *logger
+	ctl   net.Listener // ctl is the listener of the control server, if any.
+
+	// ignored records the high-water mark options not supported by the
+	// transport of the device.
+	ignored map[string]bool
+
+	mu    sync.RWMutex
+	state State
+	subs  map[*subscriber]struct{}
+	done  chan Cmd
+	runc  chan error // runc receives the result of the user's Run method.
+
+	ctx    context.Context    // ctx is the context the device is running with.
+	kill   context.CancelFunc // kill cancels ctx, forcing the dispatch loop to exit.
+	runCtx context.Context    // runCtx is cancelled when the device leaves RUNNING.
+	cancel context.CancelFunc // cancel cancels runCtx.
 
-	mu  sync.Mutex
 	usr Device
 }
 
@@ -143,130 +572,356 @@ func newDevice(ctx context.Context, cfg config.Config, udev Device, r io.Reader,
 	if w == nil {
 		w = os.Stdout
 	}
-	msg := log.New(w, dcfg.Name()+": ", 0)
-	msg.Printf("--- new device: %v\n", dcfg)
+	sev := SeverityInfo
+	if cfg.Severity != "" {
+		err = sev.UnmarshalText([]byte(cfg.Severity))
+		if err != nil {
+			return nil, xerrors.Errorf("fer: could not configure logger of device %q: %w", dcfg.Name(), err)
+		}
+	}
+	w = &syncWriter{w: w}
+	sink, err := openLogSink(cfg.LogFormat, w)
+	if err != nil {
+		return nil, err
+	}
+	msg := newLogger(sink, sev, "device", dcfg.Name())
+	ctx, kill := context.WithCancel(ctx)
 	dev := device{
 		name:  dcfg.Name(),
 		cfg:   dcfg,
 		chans: make(map[string][]channel),
-		done:  nil,
-		quit:  make(chan error),
-		cmds:  make(chan Cmd),
+		quit:  make(chan error, 1),
+		exit:  make(chan struct{}),
+		cmds:  make(chan cmdReq),
 		msgs:  make(map[msgAddr]chan Msg),
 		msg:   msg,
+		state: StateIdle,
+		subs:  make(map[*subscriber]struct{}),
+		ctx:   ctx,
+		kill:  kill,
 		usr:   udev,
+
+		ignored: make(map[string]bool),
 	}
+	dev.runCtx, dev.cancel = context.WithCancel(ctx)
+	dev.cancel()
+	dev.msg.state = dev.State
+	dev.msg.Debugf("--- new device: %v\n", dcfg)
 
 	for _, opt := range dcfg.Channels {
 		// dev.msg.Printf("--- new channel: %v\n", opt)
-		ch, err := newChannel(drv, opt, &dev, w)
+		chans, err := newChannels(drv, opt, &dev)
 		if err != nil {
+			dev.closeChannels()
 			return nil, err
 		}
-		ch.msg = make(chan Msg)
-		dev.chans[opt.Name] = []channel{ch}
-		dev.msgs[msgAddr{name: opt.Name, id: 0}] = ch.msg
+		dev.chans[opt.Name] = chans
+		for i, ch := range chans {
+			dev.msgs[msgAddr{name: opt.Name, id: i}] = ch.msg
+		}
 	}
 
-	go dev.input(ctx, r)
+	switch {
+	case isControlAddr(cfg.Control):
+		network, addr, _ := splitControlAddr(cfg.Control)
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			dev.closeChannels()
+			return nil, xerrors.Errorf("fer: could not create control server: %w", err)
+		}
+		dev.ctl = l
+		go dev.serveControl(l)
+	case isScript(cfg.Control):
+		sc, err := openScript(strings.TrimPrefix(cfg.Control, "script:"))
+		if err != nil {
+			dev.closeChannels()
+			return nil, err
+		}
+		go dev.runScript(ctx, sc, w)
+	case cfg.Control == "", cfg.Control == "interactive", cfg.Control == "static":
+		if r != nil {
+			go dev.input(ctx, r, w)
+		}
+	default:
+		dev.closeChannels()
+		return nil, xerrors.Errorf("fer: invalid control mode %q", cfg.Control)
+	}
 	go dev.dispatch(ctx)
 
 	return &dev, nil
 }
 
+// exec sends a command to the device and waits for the resulting transition
+// to complete.
+func (dev *device) exec(cmd Cmd) error {
+	return dev.send(cmdReq{cmd: cmd})
+}
+
+// abort moves the device to the ERROR state.
+// The device will exit, reporting the provided error.
+func (dev *device) abort(err error) error {
+	return dev.send(cmdReq{cmd: CmdError, err: err})
+}
+
+func (dev *device) send(req cmdReq) error {
+	req.errc = make(chan error, 1)
+	select {
+	case dev.cmds <- req:
+	case <-dev.exit:
+		return xerrors.Errorf("fer: device %q exited (command=%v)", dev.name, req.cmd)
+	}
+	return <-req.errc
+}
+
 func (dev *device) dispatch(ctx context.Context) {
 	var err error
+	defer close(dev.exit)
+	defer dev.unsubscribeAll()
 loop:
 	for {
 		select {
 		case <-ctx.Done():
 			err = ctx.Err()
-			if dev.done != nil {
-				if err == nil {
-					dev.done <- CmdEnd
-				} else {
-					dev.done <- CmdError
-				}
+			if dev.runc != nil {
+				dev.signalRun(CmdError)
+				dev.runc = nil
 			}
+			dev.setState(StateError, CmdError)
 			break loop
-		case cmd := <-dev.cmds:
-			// dev.msg.Printf("received command %v\n", cmd)
-			switch cmd {
-			case CmdInitDevice:
-				dev.initDevice(ctx)
-			case CmdInitTask:
-			case CmdRun:
-				dev.done = make(chan Cmd)
-				go dev.runDevice(ctx)
-			case CmdPause:
-			case CmdStop:
-			case CmdResetTask:
-			case CmdResetDevice:
-			case CmdEnd:
-				if dev.done != nil {
-					dev.done <- cmd
-				}
+
+		case rerr := <-dev.runc:
+			// the user's Run method returned on its own.
+			dev.runc = nil
+			if rerr != nil {
+				dev.signalRun(CmdError)
+				err = xerrors.Errorf("fer: device %q failed to run: %w", dev.name, rerr)
+				dev.setState(StateError, CmdError)
 				break loop
-			case CmdError:
-				if dev.done != nil {
-					dev.done <- cmd
-				}
+			}
+			dev.signalRun(CmdStop)
+			dev.setState(StateReady, CmdStop)
+
+		case req := <-dev.cmds:
+			// dev.msg.Printf("received command %v\n", req.cmd)
+			err = dev.transition(req.cmd, req.err)
+			req.errc <- err
+			switch {
+			case dev.State() == StateError:
 				break loop
-			default:
-				panic(xerrors.Errorf("fer: invalid cmd value (command=%d)", int(cmd)))
+			case dev.State() == StateExiting:
+				err = nil
+				break loop
+			case err != nil:
+				dev.msg.Warnf("%v\n", err)
+				err = nil
 			}
 		}
 	}
-	dev.quit <- err
+	dev.stop(err)
+}
+
+// stop reports the final status of the device's execution.
+// Only the first reported status is taken into account.
+func (dev *device) stop(err error) {
+	select {
+	case dev.quit <- err:
+	default:
+	}
 }
 
-func (dev *device) input(ctx context.Context, r io.Reader) {
+// transition applies the command to the finite state machine of the device,
+// calling the user hooks associated with the traversed states.
+// transition returns an error if the command is not allowed in the current
+// state of the device, or if a user hook failed.
+// cause is the reason for an ERROR_FOUND command, if any.
+func (dev *device) transition(cmd Cmd, cause error) error {
+	cur := dev.State()
+	switch {
+	case cmd == CmdError && cur != StateExiting:
+		if dev.runc != nil {
+			dev.signalRun(cmd)
+			dev.runc = nil
+		}
+		dev.setState(StateError, cmd)
+		if cause != nil {
+			return xerrors.Errorf("fer: device %q received %v (state=%v): %w", dev.name, cmd, cur, cause)
+		}
+		return xerrors.Errorf("fer: device %q received %v (state=%v)", dev.name, cmd, cur)
+	case transitions[cur][cmd] == StateInvalid:
+		return xerrors.Errorf("fer: invalid transition %v from state %v (device=%q)", cmd, cur, dev.name)
+	}
+
 	var err error
-	scan := bufio.NewScanner(r)
-	//scan.Split(bufio.ScanBytes)
-	for scan.Scan() {
-		err = scan.Err()
-		if err != nil {
-			break
+	switch cmd {
+	case CmdInitDevice:
+		dev.setState(StateInitializingDevice, cmd)
+		if usr, ok := dev.usr.(DevIniter); ok {
+			err = usr.Init(dev)
 		}
-		buf := scan.Bytes()
-		if len(buf) == 0 {
-			continue
+	case CmdInitTask:
+		dev.setState(StateInitializingTask, cmd)
+	case CmdRun:
+		dev.startRun()
+	case CmdPause:
+		err = dev.stopRun(cmd)
+		if usr, ok := dev.usr.(DevPauser); ok && err == nil {
+			err = usr.Pause(dev)
 		}
-		switch buf[0] {
-		case 'i':
-			dev.cmds <- CmdInitDevice
-		case 'j':
-			dev.cmds <- CmdInitTask
-		case 'p':
-			dev.cmds <- CmdPause
-		case 'r':
-			dev.cmds <- CmdRun
-		case 's':
-			dev.cmds <- CmdStop
-		case 't':
-			dev.cmds <- CmdResetTask
-		case 'd':
-			dev.cmds <- CmdResetDevice
-		case 'h':
-			// FIXME(sbinet): print interactive state loop help
-		case 'q':
-			dev.cmds <- CmdStop
-			dev.cmds <- CmdResetTask
-			dev.cmds <- CmdResetDevice
-			dev.cmds <- CmdEnd
-			return
-		default:
-			dev.msg.Printf("invalid input [%q]\n", string(buf))
+	case CmdStop:
+		if cur == StateRunning {
+			err = dev.stopRun(cmd)
+		}
+	case CmdResetTask:
+		dev.setState(StateResettingTask, cmd)
+	case CmdResetDevice:
+		dev.setState(StateResettingDevice, cmd)
+		if usr, ok := dev.usr.(DevReseter); ok {
+			err = usr.Reset(dev)
 		}
 	}
 
-	if err == io.EOF {
-		err = nil
+	if err != nil {
+		dev.setState(StateError, cmd)
+		return xerrors.Errorf("fer: device %q failed to %v: %w", dev.name, cmd, err)
 	}
+	dev.setState(transitions[cur][cmd], cmd)
+	return nil
+}
 
-	if err != nil {
-		panic(err)
+// startRun launches the user's Run method in its own goroutine.
+func (dev *device) startRun() {
+	dev.mu.Lock()
+	dev.done = make(chan Cmd, 1)
+	dev.runCtx, dev.cancel = context.WithCancel(dev.ctx)
+	dev.mu.Unlock()
+	dev.runc = make(chan error, 1)
+	go func(runc chan error) {
+		runc <- dev.usr.Run(dev)
+	}(dev.runc)
+}
+
+// signalRun notifies the user's Run method it should return.
+func (dev *device) signalRun(cmd Cmd) {
+	dev.mu.Lock()
+	dev.done <- cmd
+	close(dev.done)
+	dev.cancel()
+	dev.mu.Unlock()
+}
+
+// stopRun notifies the user's Run method it should return and waits for it.
+func (dev *device) stopRun(cmd Cmd) error {
+	dev.signalRun(cmd)
+	err := <-dev.runc
+	dev.runc = nil
+	return err
+}
+
+func (dev *device) State() State {
+	dev.mu.RLock()
+	defer dev.mu.RUnlock()
+	return dev.state
+}
+
+func (dev *device) Subscribe() (<-chan StateChange, func()) {
+	sub := newSubscriber()
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.subs == nil {
+		// device already exited.
+		sub.close()
+		return sub.out, func() {}
+	}
+	dev.subs[sub] = struct{}{}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			dev.mu.Lock()
+			delete(dev.subs, sub)
+			dev.mu.Unlock()
+			close(sub.quit)
+		})
+	}
+	return sub.out, cancel
+}
+
+var errTimeout = xerrors.New("fer: timeout")
+
+// waitState waits until the device reaches the provided state.
+// waitState waits forever if timeout is zero.
+func (dev *device) waitState(ctx context.Context, st State, timeout time.Duration) error {
+	evts, cancel := dev.Subscribe()
+	defer cancel()
+
+	if dev.State() == st {
+		return nil
+	}
+
+	var tmo <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		tmo = timer.C
+	}
+
+	for {
+		select {
+		case ev, ok := <-evts:
+			if !ok {
+				return xerrors.Errorf("fer: device %q exited before reaching state %v", dev.name, st)
+			}
+			if ev.New == st {
+				return nil
+			}
+		case <-tmo:
+			return xerrors.Errorf("could not reach state %v after %v (state=%v): %w", st, timeout, dev.State(), errTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sleep waits for the provided duration, or until the device exits.
+func (dev *device) sleep(ctx context.Context, dt time.Duration) error {
+	timer := time.NewTimer(dt)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-dev.exit:
+		return xerrors.Errorf("fer: device %q exited", dev.name)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unsubscribeAll closes all the subscriptions to the state changes of the
+// device.
+func (dev *device) unsubscribeAll() {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	for sub := range dev.subs {
+		sub.close()
+	}
+	dev.subs = nil
+}
+
+func (dev *device) setState(st State, cmd Cmd) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.state == st {
+		return
+	}
+	ev := StateChange{
+		Old:  dev.state,
+		New:  st,
+		Cmd:  cmd,
+		Time: time.Now(),
+	}
+	dev.state = st
+	for sub := range dev.subs {
+		sub.notify(ev)
 	}
 }
 
@@ -279,53 +934,115 @@ func (dev *device) Chan(name string, i int) (chan Msg, error) {
 }
 
 func (dev *device) Done() chan Cmd {
+	dev.mu.RLock()
+	defer dev.mu.RUnlock()
 	return dev.done
 }
 
-func (dev *device) isController() {}
+func (dev *device) Context() context.Context {
+	dev.mu.RLock()
+	defer dev.mu.RUnlock()
+	return dev.runCtx
+}
 
-func (dev *device) Fatalf(format string, v ...interface{}) {
-	dev.msg.Fatalf(format, v...)
+func (dev *device) Send(ctx context.Context, name string, i int, msg Msg) error {
+	ch, err := dev.Chan(name, i)
+	if err != nil {
+		return err
+	}
+	select {
+	case ch <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (dev *device) Printf(format string, v ...interface{}) {
-	dev.msg.Printf(format, v...)
+func (dev *device) Recv(ctx context.Context, name string, i int) (Msg, error) {
+	ch, err := dev.Chan(name, i)
+	if err != nil {
+		return Msg{}, err
+	}
+	select {
+	case msg := <-ch:
+		return msg, msg.Err
+	case <-ctx.Done():
+		return Msg{}, ctx.Err()
+	}
 }
 
-func (dev *device) initDevice(ctx context.Context) {
-	usr, ok := dev.usr.(DevIniter)
-	if ok {
-		dev.mu.Lock()
-		err := usr.Init(dev)
-		dev.mu.Unlock()
-		if err != nil {
-			dev.quit <- err
-		}
+func (dev *device) SubscribeTopic(name string, i int, topic string) error {
+	ch, err := dev.reqChannel(name, i, mq.Sub, mq.XSub)
+	if err != nil {
+		return err
 	}
+	return ch.sck.SetOption(mq.OptionSubscribe, topic)
 }
 
-func (dev *device) runDevice(ctx context.Context) {
-	//dev.mu.Lock()
-	err := dev.usr.Run(dev)
-	//dev.mu.Unlock()
+func (dev *device) UnsubscribeTopic(name string, i int, topic string) error {
+	ch, err := dev.reqChannel(name, i, mq.Sub, mq.XSub)
 	if err != nil {
-		dev.quit <- err
+		return err
 	}
+	return ch.sck.SetOption(mq.OptionUnsubscribe, topic)
 }
 
+func (dev *device) isController() {}
+
+func (dev *device) Fatalf(format string, v ...interface{}) { dev.msg.Fatalf(format, v...) }
+func (dev *device) Printf(format string, v ...interface{}) { dev.msg.Printf(format, v...) }
+func (dev *device) Tracef(format string, v ...interface{}) { dev.msg.Tracef(format, v...) }
+func (dev *device) Debugf(format string, v ...interface{}) { dev.msg.Debugf(format, v...) }
+func (dev *device) Infof(format string, v ...interface{})  { dev.msg.Infof(format, v...) }
+func (dev *device) Warnf(format string, v ...interface{})  { dev.msg.Warnf(format, v...) }
+func (dev *device) Errorf(format string, v ...interface{}) { dev.msg.Errorf(format, v...) }
+func (dev *device) With(kv ...interface{}) Logger          { return dev.msg.With(kv...) }
+
+// stopDevice stops the channels of the device and waits for their sockets to
+// be closed.
 func (dev *device) stopDevice(ctx context.Context) {
 	for _, chans := range dev.chans {
 		for _, ch := range chans {
-			ch.cmd <- CmdEnd
+			select {
+			case ch.cmd <- CmdEnd:
+			case <-ctx.Done():
+				// channel already stopped.
+			}
+		}
+	}
+	for _, chans := range dev.chans {
+		for _, ch := range chans {
+			<-ch.done
 		}
 	}
 }
 
+// fail tears down a device that could not be started: the device moves to
+// the ERROR state, its dispatch loop, control server and console exit, and
+// the sockets of its channels are closed.
+// fail returns err.
+func (dev *device) fail(err error) error {
+	dev.kill()
+	<-dev.exit
+	if dev.ctl != nil {
+		dev.ctl.Close()
+	}
+	dev.closeChannels()
+	return err
+}
+
+// closeChannels closes the sockets of the channels of the device.
+func (dev *device) closeChannels() {
+	for _, chans := range dev.chans {
+		closeChannels(chans)
+	}
+}
+
 func (dev *device) run(ctx context.Context) error {
 	if usr, ok := dev.usr.(DevConfigurer); ok {
 		err := usr.Configure(dev.cfg)
 		if err != nil {
-			return err
+			return dev.fail(err)
 		}
 	}
 
@@ -334,7 +1051,8 @@ func (dev *device) run(ctx context.Context) error {
 		// dev.msg.Printf("--- init channels [%s]...\n", n)
 		for _, ch := range chans {
 			// dev.msg.Printf("--- init channel[%s][%d]...\n", n, i)
-			sck := ch.cfg.Sockets[0]
+			ch := ch
+			sck := ch.socket()
 			switch strings.ToLower(sck.Method) {
 			case "bind":
 				grp.Go(func() error { return ch.sck.Listen(sck.Address) })
@@ -349,7 +1067,7 @@ func (dev *device) run(ctx context.Context) error {
 	}
 	err := grp.Wait()
 	if err != nil {
-		return err
+		return dev.fail(err)
 	}
 
 	for _, chans := range dev.chans {
@@ -31,6 +31,34 @@
 // messages.
 // This infinite for-loop will also NEED to listen for the Controller.Done()
 // channel to exit that for-loop.
+// Alternatively, the Run method may use the Controller.Context() context,
+// which is cancelled when the device leaves the RUNNING state, together with
+// the Controller.Send and Controller.Recv helpers:
+//
+//  func (dev *myDevice) Run(ctl fer.Controller) error {
+//      ctx := ctl.Context()
+//      for {
+//          msg, err := ctl.Recv(ctx, "data-1", 0)
+//          if err != nil {
+//              return nil
+//          }
+//          err = ctl.Send(ctx, "data-2", 0, msg)
+//          if err != nil {
+//              return nil
+//          }
+//      }
+//  }
+//
+// Devices follow the FairMQ state machine:
+//  IDLE -> DEVICE READY -> READY -> RUNNING -> PAUSED -> READY -> ... -> EXITING
+// The Init method is called when the device is initialized (INIT_DEVICE),
+// the Pause method when the device is paused (PAUSE) and the Reset method
+// when the device is reset (RESET_DEVICE).
+// The Run method is called each time the device enters the RUNNING state and
+// should return when the Controller.Done() channel is notified that the
+// device is paused or stopped.
+// The current state of a device is available via Controller.State() and its
+// transitions can be observed via Controller.Subscribe().
 //
 // e.g.:
 //
@@ -70,11 +98,17 @@
 //  $> ./my-device --help
 //  Usage of my-device:
 //    -control string
-//      	starts device in interactive/static mode (default "interactive")
+//      	starts device in interactive/static mode, controlled via tcp://host:port or unix:///path, or driven by script:<file> (default "interactive")
 //    -id string
 //      	device ID
+//    -log-format string
+//      	format of log records (text, json, ...) (default "text")
 //    -mq-config string
 //      	path to JSON file holding device configuration
+//    -severity string
+//      	minimum severity of log records (trace, debug, info, warn, error) (default "info")
+//    -shutdown-timeout duration
+//      	timeout for the orderly shutdown of the device upon SIGINT/SIGTERM (default 10s)
 //    -transport string
 //      	transport mechanism to use (zeromq, nanomsg, go-chan, ...) (default "zeromq")
 //  $> ./my-device --id my-id --mq-config ./path/to/config.json
@@ -82,14 +116,24 @@ package fer // import "github.com/alice-go/fer"
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/alice-go/fer/config"
 	"golang.org/x/xerrors"
 )
 
 // Main configures and runs a device's execution, managing its state.
+//
+// Upon reception of SIGINT or SIGTERM, Main stops, resets and ends the device
+// and returns nil if the device could be shut down within the configured
+// shutdown timeout, or an error otherwise.
+// A second signal forces the exit of the process, with the exit code 128+n
+// where n is the number of the signal.
 func Main(dev Device) error {
 	cfg, err := config.Parse()
 	if err != nil {
@@ -99,12 +143,17 @@ func Main(dev Device) error {
 	if cfg.Control == "" {
 		cfg.Control = "static"
 	}
-	return runDevice(context.Background(), cfg, dev, os.Stdin, os.Stdout)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	return runDevice(context.Background(), cfg, dev, os.Stdin, os.Stdout, sigc)
 }
 
 // RunDevice runs a device's execution, managing its state.
 func RunDevice(ctx context.Context, cfg config.Config, dev Device, r io.Reader, w io.Writer) error {
-	return runDevice(ctx, cfg, dev, r, w)
+	return runDevice(ctx, cfg, dev, r, w, nil)
 }
 
 // Device is a handle to what users get to run via the Fer toolkit.
@@ -149,22 +198,114 @@ type DevReseter interface {
 // output data channels.
 type Controller interface {
 	Logger
+
+	// Chan returns the Go channel associated with the i-th socket of the
+	// named channel.
+	// All the sockets of a fan-in or fan-out channel share the same Go
+	// channel.
 	Chan(name string, i int) (chan Msg, error)
 	Done() chan Cmd
 
-	isController()
-}
+	// Context returns a context that is cancelled when the device leaves
+	// the RUNNING state.
+	// Outside of the RUNNING state, the returned context is already cancelled.
+	Context() context.Context
+
+	// Send sends a message on the i-th channel with the provided name.
+	// Send returns ctx.Err() if ctx is done before the message could be sent.
+	Send(ctx context.Context, name string, i int, msg Msg) error
+
+	// Recv receives a message from the i-th channel with the provided name.
+	// Recv returns ctx.Err() if ctx is done before a message could be received,
+	// or the error carried by the received message, if any.
+	Recv(ctx context.Context, name string, i int) (Msg, error)
+
+	// Request sends a request on the i-th socket of the named req or dealer
+	// channel and returns the corresponding reply.
+	// Request returns ctx.Err() if ctx is done before the reply is received.
+	// Requests on dealer channels are pipelined: Request may be called
+	// concurrently, without waiting for the replies to the previous requests.
+	// Requests on req channels are sent one at a time.
+	Request(ctx context.Context, name string, i int, req Msg) (Msg, error)
+
+	// Serve handles the requests received on the i-th socket of the named
+	// rep or router channel with h, until ctx is done.
+	// Replies of router channels are routed back to the requesting peer.
+	// Serve returns ctx.Err() when ctx is done, or the error returned by h,
+	// in which case the request is not answered.
+	Serve(ctx context.Context, name string, i int, h Handler) error
+
+	// SubscribeTopic subscribes the i-th socket of the named sub channel to
+	// the provided topic.
+	// Topics are matched against the beginning of the (first part of the)
+	// received messages.
+	SubscribeTopic(name string, i int, topic string) error
+
+	// UnsubscribeTopic unsubscribes the i-th socket of the named sub channel
+	// from the provided topic.
+	// Sub channels are initially subscribed to the "" topic (all messages),
+	// unless their configuration lists their subscriptions.
+	UnsubscribeTopic(name string, i int, topic string) error
+
+	// State returns the current state of the device.
+	State() State
+
+	// Stats returns the number of messages and bytes that went through
+	// each socket of each channel of the device, together with their rates
+	// over the last rateLogging interval of the channel.
+	Stats() []ChannelStats
+
+	// Subscribe returns a channel on which the state changes of the device
+	// are delivered, in order, and a function to cancel the subscription.
+	// The channel is closed when the subscription is cancelled or after
+	// the device exited.
+	Subscribe() (<-chan StateChange, func())
 
-// Logger gives access to printf-like facilities
-type Logger interface {
-	Fatalf(format string, v ...interface{})
-	Printf(format string, v ...interface{})
+	isController()
 }
 
 // Msg is a quantum of data being exchanged between devices.
 type Msg struct {
 	Data []byte // Data is the message payload.
 	Err  error  // Err indicates whether an error occured.
+
+	// Parts are the parts of a multipart message (e.g. a header and
+	// payload parts.)
+	// Messages with parts are sent as multipart messages and their Data
+	// field is ignored.
+	// Received multipart messages hold their parts in Parts and have a nil
+	// Data field.
+	Parts [][]byte
+}
+
+// size returns the number of bytes of the message payload.
+func (msg Msg) size() int {
+	if len(msg.Parts) == 0 {
+		return len(msg.Data)
+	}
+	n := 0
+	for _, part := range msg.Parts {
+		n += len(part)
+	}
+	return n
+}
+
+// ChannelError describes an error that occured while sending or receiving
+// data through a channel.
+type ChannelError struct {
+	Channel string // Channel is the name of the channel.
+	Addr    string // Addr is the address of the channel's socket.
+	Op      string // Op is the operation that failed (send, recv).
+	Err     error  // Err is the error returned by the socket.
+}
+
+func (err *ChannelError) Error() string {
+	return fmt.Sprintf("fer: %s error on channel %q (address=%q): %v", err.Op, err.Channel, err.Addr, err.Err)
+}
+
+// Unwrap returns the error returned by the socket.
+func (err *ChannelError) Unwrap() error {
+	return err.Err
 }
 
 // Cmd describes commands to be sent to a device, via a channel.
@@ -215,20 +356,51 @@ func (cmd Cmd) String() string {
 	panic(xerrors.Errorf("fer: invalid Cmd value (command=%d)", int(cmd)))
 }
 
-func runDevice(ctx context.Context, cfg config.Config, dev Device, r io.Reader, w io.Writer) error {
+// MarshalText implements encoding.TextMarshaler.
+func (cmd Cmd) MarshalText() ([]byte, error) {
+	if cmd > CmdError {
+		return nil, xerrors.Errorf("fer: invalid Cmd value (command=%d)", int(cmd))
+	}
+	return []byte(cmd.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// The matching of the command name is case insensitive.
+func (cmd *Cmd) UnmarshalText(text []byte) error {
+	for v := CmdInitDevice; v <= CmdError; v++ {
+		if strings.EqualFold(v.String(), string(text)) {
+			*cmd = v
+			return nil
+		}
+	}
+	return xerrors.Errorf("fer: invalid Cmd name (value=%q)", text)
+}
+
+func runDevice(ctx context.Context, cfg config.Config, dev Device, r io.Reader, w io.Writer, sigc <-chan os.Signal) error {
 	sys, err := newDevice(ctx, cfg, dev, r, w)
 	if err != nil {
 		return err
 	}
 
-	sys.cmds <- CmdInitDevice
-	sys.cmds <- CmdRun
+	if sigc != nil {
+		timeout := cfg.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		go sys.handleSignals(sigc, timeout)
+	}
 
-	return sys.run(ctx)
-}
+	if isControlAddr(cfg.Control) || isScript(cfg.Control) {
+		// the device is driven by its remote controller or its script.
+		return sys.run(ctx)
+	}
 
-func broadcast(cmd Cmd, devs ...*device) {
-	for _, dev := range devs {
-		dev.cmds <- cmd
+	for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+		err = sys.exec(cmd)
+		if err != nil {
+			return sys.fail(err)
+		}
 	}
+
+	return sys.run(ctx)
 }
@@ -8,25 +8,33 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/alice-go/fer/config"
+	"github.com/alice-go/fer/mq"
+	"github.com/alice-go/fer/mq/stream"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 )
 
-var testDrivers = []string{"zeromq", "nanomsg"}
+var testDrivers = []string{"zeromq", "nanomsg", "go-chan", "shmem"}
 
 func TestSamplerProcessorSink(t *testing.T) {
-	for _, n := range testDrivers {
+	for _, n := range append(testDrivers, InProc) {
 		transport := n
 		t.Run("transport="+transport, func(t *testing.T) {
 
@@ -37,64 +45,51 @@ func TestSamplerProcessorSink(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			stdin := os.Stdin
-			stdout := new(bytes.Buffer)
+			stdout := new(syncBuffer)
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
 
-			grp, ctx := errgroup.WithContext(ctx)
-			newTestDevice := func(id string, dev Device) *device {
-				cfg := cfg
-				cfg.ID = id
-				sys, err := newDevice(ctx, cfg, dev, stdin, stdout)
-				if err != nil {
-					t.Fatalf("error creating device %q: %v\n", id, err)
-				}
-				return sys
-			}
-
 			const N = 1024
 			sumc := make(chan string)
-			dev1 := newTestDevice("sampler1", &sampler{n: N})
-			dev2 := newTestDevice("processor", &processor{})
-			dev3 := newTestDevice("sink1", &sink{sum: sumc, n: N})
-
-			grp.Go(func() error { return dev1.run(ctx) })
-			grp.Go(func() error { return dev2.run(ctx) })
-			grp.Go(func() error { return dev3.run(ctx) })
-
-			broadcast(CmdInitDevice, dev1, dev2, dev3)
-			broadcast(CmdRun, dev1, dev2, dev3)
+			devs := map[string]Device{
+				"sampler1":  &sampler{n: N},
+				"processor": &processor{},
+				"sink1":     &sink{sum: sumc, n: N},
+			}
 
 			sum := make([]string, 0, N)
+			done := make(chan struct{})
 			go func() {
+				defer close(done)
 				for s := range sumc {
 					sum = append(sum, s)
 				}
-				broadcast(CmdEnd, dev1, dev2, dev3)
+				cancel()
 			}()
 
-			err = grp.Wait()
+			err = RunTopology(ctx, cfg, devs, stdout)
 			if err != nil {
 				t.Fatalf("unexpected error value: %v\n", err)
 			}
 
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("sink did not receive all the messages:\n%s", stdout.String())
+			}
+
 			if len(sum) != N {
 				t.Fatalf("got %d. want %d\n", len(sum), N)
 			}
 
 			want := make([]string, 0, N)
 			for i := 0; i < N; i++ {
-				want = append(want, fmt.Sprintf("HELLO-%02[1]d (modified by %[2]s - %02[1]d) - %02[1]d", i, dev2.name))
+				want = append(want, fmt.Sprintf("HELLO-%02[1]d (modified by %[2]s - %02[1]d) - %02[1]d", i, "processor"))
 			}
 			if !reflect.DeepEqual(sum, want) {
 
-				scan := bufio.NewScanner(stdout)
+				scan := bufio.NewScanner(strings.NewReader(stdout.String()))
 				for scan.Scan() {
-					err = scan.Err()
-					if err != nil {
-						break
-					}
 					t.Logf("%v\n", scan.Text())
 				}
 
@@ -102,239 +97,1018 @@ func TestSamplerProcessorSink(t *testing.T) {
 					strings.Join(sum, "\n"),
 					strings.Join(want, "\n"),
 				)
-				if err == io.EOF {
-					err = nil
-				}
+			}
+		})
+	}
+}
+
+func TestMultiSocketChannels(t *testing.T) {
+	for _, n := range append(testDrivers, InProc) {
+		transport := n
+		t.Run("transport="+transport, func(t *testing.T) {
+			t.Parallel()
 
+			var ports [4]string
+			for i := range ports {
+				port, err := getTCPPort()
 				if err != nil {
-					t.Fatalf("error scanning stdout: %v\n", err)
+					t.Fatalf("error getting free TCP port: %v", err)
+				}
+				ports[i] = port
+			}
+			sck := func(typ, method string, i int) config.Socket {
+				host := "localhost"
+				if method == "bind" {
+					host = "*"
+				}
+				return config.Socket{Type: typ, Method: method, Address: "tcp://" + host + ":" + ports[i]}
+			}
+
+			// sampler1 sends its messages to both processors, sink1 receives
+			// the messages of both processors.
+			cfg := config.Config{
+				Transport: transport,
+				Options: config.Options{
+					Devices: []config.Device{
+						{
+							ID: "sampler1",
+							Channels: []config.Channel{{
+								Name:    "data1",
+								Fan:     "out",
+								Sockets: []config.Socket{sck("push", "bind", 0), sck("push", "bind", 1)},
+							}},
+						},
+						{
+							ID: "proc1",
+							Channels: []config.Channel{
+								{Name: "data1", Sockets: []config.Socket{sck("pull", "connect", 0)}},
+								{Name: "data2", Sockets: []config.Socket{sck("push", "connect", 2)}},
+							},
+						},
+						{
+							ID: "proc2",
+							Channels: []config.Channel{
+								{Name: "data1", Sockets: []config.Socket{sck("pull", "connect", 1)}},
+								{Name: "data2", Sockets: []config.Socket{sck("push", "connect", 3)}},
+							},
+						},
+						{
+							ID: "sink1",
+							Channels: []config.Channel{{
+								Name:    "data2",
+								Fan:     "in",
+								Sockets: []config.Socket{sck("pull", "bind", 2), sck("pull", "bind", 3)},
+							}},
+						},
+					},
+				},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			const N = 128
+			sumc := make(chan string)
+			devs := map[string]Device{
+				"sampler1": &sampler{n: N},
+				"proc1":    &processor{},
+				"proc2":    &processor{},
+				"sink1":    &sink{sum: sumc, n: 2 * N},
+			}
+
+			counts := make(map[string]int)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for s := range sumc {
+					for _, name := range []string{"proc1", "proc2"} {
+						if strings.Contains(s, "modified by "+name) {
+							counts[name]++
+						}
+					}
 				}
+				cancel()
+			}()
+
+			stdout := new(syncBuffer)
+			err := RunTopology(ctx, cfg, devs, stdout)
+			if err != nil {
+				t.Fatalf("unexpected error value: %v\n", err)
+			}
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("sink did not receive all the messages:\n%s", stdout.String())
+			}
+
+			if want := map[string]int{"proc1": N, "proc2": N}; !reflect.DeepEqual(counts, want) {
+				t.Fatalf("invalid messages count: got=%v, want=%v", counts, want)
 			}
 		})
 	}
 }
 
-type sampler struct {
-	cfg   config.Device
-	datac chan Msg
-	n     int
-}
+func TestMultiSocketChannelsConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ch   config.Channel
+		want string
+	}{
+		{
+			name: "no-socket",
+			ch:   config.Channel{Name: "data"},
+			want: "fer: channel \"data\" has no socket",
+		},
+		{
+			name: "invalid-fan",
+			ch: config.Channel{
+				Name: "data", Fan: "both",
+				Sockets: []config.Socket{{Type: "push", Method: "bind", Address: "inproc://fan-1"}},
+			},
+			want: "fer: invalid fan mode for channel \"data\" (value=\"both\")",
+		},
+		{
+			name: "fan-in-push",
+			ch: config.Channel{
+				Name: "data", Fan: "in",
+				Sockets: []config.Socket{
+					{Type: "pull", Method: "bind", Address: "inproc://fan-2"},
+					{Type: "push", Method: "bind", Address: "inproc://fan-3"},
+				},
+			},
+			want: "fer: invalid socket type \"push\" for fan-in channel \"data\"",
+		},
+		{
+			name: "fan-out-pull",
+			ch: config.Channel{
+				Name: "data", Fan: "out",
+				Sockets: []config.Socket{{Type: "pull", Method: "bind", Address: "inproc://fan-4"}},
+			},
+			want: "fer: invalid socket type \"pull\" for fan-out channel \"data\"",
+		},
+		{
+			name: "pair",
+			ch: config.Channel{
+				Name:    "data",
+				Sockets: []config.Socket{{Type: "pair", Method: "bind", Address: "inproc://pair-1"}},
+			},
+			want: "fer: invalid socket type \"pair\" for channel \"data\": devices can not both send and receive data on a channel",
+		},
+		{
+			name: "bus",
+			ch: config.Channel{
+				Name:    "data",
+				Sockets: []config.Socket{{Type: "bus", Method: "bind", Address: "inproc://bus-1"}},
+			},
+			want: "fer: invalid socket type \"bus\" for channel \"data\": devices can not both send and receive data on a channel",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.Config{
+				ID:        "dev1",
+				Transport: "nanomsg",
+				Options: config.Options{
+					Devices: []config.Device{{ID: "dev1", Channels: []config.Channel{tc.ch}}},
+				},
+			}
+			_, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+			if err == nil || err.Error() != tc.want {
+				t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+			}
+		})
+	}
 
-func (dev *sampler) Configure(cfg config.Device) error {
-	dev.cfg = cfg
-	return nil
+	cfg := config.Config{
+		ID:        "dev1",
+		Transport: "nanomsg",
+		Options: config.Options{
+			Devices: []config.Device{{ID: "dev1", Channels: []config.Channel{{
+				Name: "data",
+				Sockets: []config.Socket{
+					{Type: "pull", Method: "bind", Address: "inproc://multi-1"},
+					{Type: "pull", Method: "bind", Address: "inproc://multi-2"},
+				},
+			}}}},
+		},
+	}
+	dev, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch0, err := dev.Chan("data", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch1, err := dev.Chan("data", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch0 == ch1 {
+		t.Fatalf("sockets of a channel without fan mode should not share their Go channel")
+	}
+	_, err = dev.Chan("data", 2)
+	if err == nil {
+		t.Fatalf("expected an error retrieving an invalid socket index")
+	}
+	err = dev.exec(CmdEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func (dev *sampler) Init(ctl Controller) error {
-	datac, err := ctl.Chan("data1", 0)
+func TestChannelBufSize(t *testing.T) {
+	cfg := config.Config{
+		ID:        "dev1",
+		Transport: "nanomsg",
+		Options: config.Options{
+			Devices: []config.Device{{ID: "dev1", Channels: []config.Channel{
+				{
+					Name: "in",
+					Sockets: []config.Socket{
+						{Type: "pull", Method: "bind", Address: "inproc://bufsize-1", SendBufSize: 10, RecvBufSize: 20},
+					},
+				},
+				{
+					Name: "out",
+					Fan:  "out",
+					Sockets: []config.Socket{
+						{Type: "push", Method: "bind", Address: "inproc://bufsize-2", SendBufSize: 30, RecvBufSize: 40},
+						{Type: "push", Method: "bind", Address: "inproc://bufsize-3", SendBufSize: 50, RecvBufSize: 60},
+					},
+				},
+				{
+					Name: "rep",
+					Sockets: []config.Socket{
+						{Type: "rep", Method: "bind", Address: "inproc://bufsize-4", SendBufSize: 70, RecvBufSize: 80},
+					},
+				},
+				{
+					// sockets without buffer sizes use those of the channel.
+					Name:        "sub",
+					SendBufSize: 90,
+					RecvBufSize: 100,
+					Sockets: []config.Socket{
+						{Type: "sub", Method: "bind", Address: "inproc://bufsize-5", SendBufSize: 110},
+					},
+				},
+			}}},
+		},
+	}
+	dev, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
+	defer dev.exec(CmdEnd)
 
-	dev.datac = datac
-	return nil
-}
-
-func (dev *sampler) Run(ctl Controller) error {
-	i := 0
-	for {
-		select {
-		case dev.datac <- Msg{Data: []byte(fmt.Sprintf("HELLO-%02d", i))}:
-			i++
-		case <-ctl.Done():
-			return nil
+	for _, tc := range []struct {
+		name string
+		i    int
+		cap  int
+		hwm  [2]int
+	}{
+		{"in", 0, 20, [2]int{10, 20}},
+		{"out", 0, 50, [2]int{30, 40}},
+		{"out", 1, 50, [2]int{50, 60}},
+		{"rep", 0, 0, [2]int{70, 80}},
+		{"sub", 0, 100, [2]int{110, 100}},
+	} {
+		ch := dev.chans[tc.name][tc.i]
+		if got := cap(ch.msg); got != tc.cap {
+			t.Errorf("%s[%d]: invalid Go channel capacity: got=%d, want=%d", tc.name, tc.i, got, tc.cap)
 		}
-		if i >= dev.n {
-			dev.datac = nil
+		for j, opt := range []string{mq.OptionSendHWM, mq.OptionRecvHWM} {
+			v, err := ch.sck.GetOption(opt)
+			if err != nil {
+				t.Fatalf("%s[%d]: could not get option %q: %v", tc.name, tc.i, opt, err)
+			}
+			if v != tc.hwm[j] {
+				t.Errorf("%s[%d]: invalid option %q: got=%v, want=%d", tc.name, tc.i, opt, v, tc.hwm[j])
+			}
 		}
 	}
-	return nil
 }
 
-type processor struct {
-	cfg    config.Device
-	idatac chan Msg
-	odatac chan Msg
-}
+func TestChannelBufSizeUnsupported(t *testing.T) {
+	for _, sev := range []string{"", "debug"} {
+		t.Run("severity="+sev, func(t *testing.T) {
+			ports := make([]string, 2)
+			for i := range ports {
+				port, err := getTCPPort()
+				if err != nil {
+					t.Fatalf("error getting free TCP port: %v", err)
+				}
+				ports[i] = port
+			}
+			cfg := config.Config{
+				ID:        "dev1",
+				Transport: "zeromq",
+				Severity:  sev,
+				Options: config.Options{
+					Devices: []config.Device{{ID: "dev1", Channels: []config.Channel{
+						{
+							Name: "out",
+							Sockets: []config.Socket{
+								{Type: "push", Method: "bind", Address: "tcp://*:" + ports[0], SendBufSize: 10, RecvBufSize: 10},
+							},
+						},
+						{
+							Name: "in",
+							Sockets: []config.Socket{
+								{Type: "pull", Method: "bind", Address: "tcp://*:" + ports[1], SendBufSize: 10, RecvBufSize: 10},
+							},
+						},
+					}}},
+				},
+			}
+			out := new(syncBuffer)
+			dev, err := newDevice(context.Background(), cfg, &hooks{}, nil, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dev.exec(CmdEnd)
 
-func (dev *processor) Configure(cfg config.Device) error {
-	dev.cfg = cfg
-	return nil
+			// unsupported high-water marks are only logged once per device,
+			// at the DEBUG severity.
+			log := out.String()
+			if strings.Contains(log, "[WARN]") {
+				t.Fatalf("unexpected warning in log:\n%s", log)
+			}
+			for _, opt := range []string{mq.OptionSendHWM, mq.OptionRecvHWM} {
+				want := 0
+				if sev == "debug" {
+					want = 1
+				}
+				msg := "[DEBUG] dev1: ignoring option " + opt + ": "
+				if got := strings.Count(log, msg); got != want {
+					t.Fatalf("invalid number of %q in log: got=%d, want=%d\n%s", msg, got, want, log)
+				}
+			}
+		})
+	}
 }
 
-func (dev *processor) Init(ctl Controller) error {
-	idatac, err := ctl.Chan("data1", 0)
+func TestNewDeviceError(t *testing.T) {
+	port, err := getTCPPort()
 	if err != nil {
-		return err
+		t.Fatalf("error getting free TCP port: %v", err)
 	}
-
-	odatac, err := ctl.Chan("data2", 0)
+	l, err := net.Listen("tcp", "localhost:"+port)
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
+	defer l.Close()
 
-	dev.idatac = idatac
-	dev.odatac = odatac
-	return nil
+	chans := []config.Channel{
+		{
+			Name:    "in",
+			Sockets: []config.Socket{{Type: "pull", Method: "bind", Address: "inproc://new-device-1"}},
+		},
+		{
+			Name: "out",
+			Fan:  "out",
+			Sockets: []config.Socket{
+				{Type: "push", Method: "bind", Address: "inproc://new-device-2"},
+				{Type: "push", Method: "bind", Address: "inproc://new-device-3"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		control string
+		edit    func(chans []config.Channel)
+		want    string
+	}{
+		{
+			name: "invalid-channel",
+			edit: func(chans []config.Channel) { chans[1].Fan = "bogus" },
+			want: `fer: invalid fan mode for channel "out" (value="bogus")`,
+		},
+		{
+			name: "invalid-socket",
+			edit: func(chans []config.Channel) { chans[1].Sockets[1].Type = "pull" },
+			want: `fer: invalid socket type "pull" for fan-out channel "out"`,
+		},
+		{
+			name:    "control-in-use",
+			control: "tcp://localhost:" + port,
+			want:    "fer: could not create control server: ",
+		},
+		{
+			name:    "missing-script",
+			control: "script:" + filepath.Join(os.TempDir(), "fer-no-such-script"),
+			want:    "fer: could not open control script: ",
+		},
+		{
+			name:    "invalid-control",
+			control: "bogus",
+			want:    `fer: invalid control mode "bogus"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dcfg := config.Device{ID: "dev1"}
+			for _, ch := range chans {
+				ch.Sockets = append([]config.Socket(nil), ch.Sockets...)
+				dcfg.Channels = append(dcfg.Channels, ch)
+			}
+			if tc.edit != nil {
+				tc.edit(dcfg.Channels)
+			}
+			cfg := config.Config{
+				ID:        "dev1",
+				Transport: "fer-test-count",
+				Control:   tc.control,
+				Options:   config.Options{Devices: []config.Device{dcfg}},
+			}
+
+			_, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+			if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+			}
+
+			// the sockets of the channels created before the error are
+			// closed.
+			if n := atomic.LoadInt64(&countOpen); n != 0 {
+				t.Fatalf("%d sockets left open", n)
+			}
+		})
+	}
 }
 
-func (dev *processor) Run(ctl Controller) error {
-	i := 0
-	for {
-		select {
-		case data := <-dev.idatac:
-			out := append([]byte(nil), data.Data...)
-			out = append(out, []byte(fmt.Sprintf(" (modified by %s - %02d)", dev.cfg.Name(), i))...)
-			dev.odatac <- Msg{Data: out}
-			i++
-		case <-ctl.Done():
-			return nil
+func TestChannelOptions(t *testing.T) {
+	newCfg := func(transport string, opts map[string]interface{}) config.Config {
+		return config.Config{
+			ID:        "dev1",
+			Transport: transport,
+			Options: config.Options{
+				Devices: []config.Device{{ID: "dev1", Channels: []config.Channel{{
+					Name: "data",
+					Sockets: []config.Socket{
+						{Type: "sub", Method: "bind", Address: "inproc://options-1", Options: opts},
+					},
+				}}}},
+			},
 		}
 	}
-}
 
-type sink struct {
-	cfg   config.Device
-	datac chan Msg
-	n     int
-	sum   chan string
-}
+	cfg := newCfg("nanomsg", map[string]interface{}{
+		"linger":       "100ms",
+		"recv-timeout": 500.0,
+	})
+	dev, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sck := dev.chans["data"][0].sck
+	for name, want := range map[string]interface{}{
+		mq.OptionLinger:      100 * time.Millisecond,
+		mq.OptionRecvTimeout: 500 * time.Millisecond,
+	} {
+		v, err := sck.GetOption(name)
+		if err != nil {
+			t.Fatalf("could not get option %q: %v", name, err)
+		}
+		if v != want {
+			t.Fatalf("invalid option %q: got=%v, want=%v", name, v, want)
+		}
+	}
+	err = dev.exec(CmdEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func (dev *sink) Configure(cfg config.Device) error {
-	dev.cfg = cfg
-	return nil
+	cfg = newCfg("nanomsg", map[string]interface{}{"linger": "forever"})
+	_, err = newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+	if err == nil {
+		t.Fatalf("expected an error creating a device with an invalid option value")
+	}
+
+	stdout := new(bytes.Buffer)
+	cfg = newCfg("zeromq", map[string]interface{}{"linger": "100ms"})
+	dev, err = newDevice(context.Background(), cfg, &hooks{}, nil, stdout)
+	if err != nil {
+		t.Fatalf("unsupported options should not prevent the creation of a device: %v", err)
+	}
+	err = dev.exec(CmdEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `ignoring option linger=100ms: mq/zeromq: unsupported option "linger"`; !strings.Contains(stdout.String(), want) {
+		t.Fatalf("missing warning %q:\n%s", want, stdout.String())
+	}
 }
 
-func (dev *sink) Init(ctl Controller) error {
-	datac, err := ctl.Chan("data2", 0)
+func TestChannelTransports(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "fer-transports-")
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(tmp)
 
-	dev.datac = datac
-	return nil
-}
+	certs, err := stream.GenerateCertificates(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsSocket := config.Socket{TLSCert: certs.Cert, TLSKey: certs.Key, TLSCA: certs.CA}
 
-func (dev *sink) Run(ctl Controller) error {
-	i := 0
-	for {
-		select {
-		case data := <-dev.datac:
-			//ctl.Printf("received: %q (%d)\n", string(data.Data), i)
-			dev.sum <- fmt.Sprintf("%s - %02d", string(data.Data), i)
-			i++
-		case <-ctl.Done():
-			return nil
-		}
-		if i >= dev.n {
-			close(dev.sum)
-		}
+	type testCase struct {
+		name      string
+		transport string
+		scheme    string        // scheme of the addresses, "tcp" by default.
+		path      string        // path of the addresses.
+		bind      config.Socket // bind holds the extra fields of the bound socket.
+		connect   config.Socket // connect holds the extra fields of the connecting socket.
+		secure    bool          // secure reports whether the extra fields need a secure transport.
 	}
-}
-
-func TestDeviceFSM(t *testing.T) {
-	for _, n := range testDrivers {
-		transport := n
-		for _, cmds := range [][]Cmd{
-			{CmdInitDevice, CmdRun, CmdPause, CmdStop, CmdEnd},
-			{CmdInitDevice, CmdRun, CmdStop, CmdEnd},
-			{CmdInitDevice, CmdRun, CmdEnd},
-			{CmdInitDevice, CmdEnd},
-			{CmdEnd},
-		} {
-			cmds := cmds
-			list := make([]string, len(cmds))
-			for i := range cmds {
-				list[i] = cmds[i].String()
-			}
-
-			t.Run("transport="+transport+";cmds="+strings.Join(list, "|"), func(t *testing.T) {
+	var tcs []testCase
+	for _, transport := range append(testDrivers, InProc, "stream") {
+		tcs = append(tcs, testCase{name: transport, transport: transport})
+	}
+	tcs = append(tcs,
+		testCase{name: "tls", transport: "tls", bind: tlsSocket, connect: tlsSocket, secure: true},
+		testCase{
+			name: "plain", transport: "zeromq",
+			bind: config.Socket{
+				PlainServer: true, PlainUsername: "fer", PlainPassword: "secret",
+				Allow: []string{"127.0.0.1"},
+			},
+			connect: config.Socket{PlainUsername: "fer", PlainPassword: "secret"},
+			secure:  true,
+		},
+		testCase{name: "ws", transport: "ws", scheme: "ws", path: "/data"},
+	)
 
+	// the subtests run in parallel within a group, so tmp outlives them.
+	t.Run("group", func(t *testing.T) {
+		for _, tc := range tcs {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
 				t.Parallel()
 
-				const N = 1024
-				cfg, err := getSPSConfig(transport)
+				port, err := getTCPPort()
 				if err != nil {
-					t.Fatal(err)
+					t.Fatalf("error getting free TCP port: %v", err)
 				}
-				cfg.ID = "sampler1"
+				scheme := tc.scheme
+				if scheme == "" {
+					scheme = "tcp"
+				}
+				bind, connect := tc.bind, tc.connect
+				bind.Type, bind.Method, bind.Address = "push", "bind", scheme+"://*:"+port+tc.path
+				connect.Type, connect.Method, connect.Address = "pull", "connect", scheme+"://127.0.0.1:"+port+tc.path
 
-				stdin := new(bytes.Buffer)
-				stdout := new(bytes.Buffer)
+				cfg := config.Config{
+					Transport: tc.transport,
+					Options: config.Options{
+						Devices: []config.Device{
+							{
+								ID: "sender",
+								Channels: []config.Channel{{
+									Name:    "data",
+									Sockets: []config.Socket{bind},
+								}},
+							},
+							{
+								ID: "receiver",
+								Channels: []config.Channel{{
+									Name:    "data",
+									Sockets: []config.Socket{connect},
+								}},
+							},
+						},
+					},
+				}
 
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
 
-				grp, ctx := errgroup.WithContext(ctx)
-				dev1, err := newDevice(ctx, cfg, &sampler{n: N}, stdin, stdout)
-				if err != nil {
-					t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+				want := []Msg{
+					{Parts: [][]byte{[]byte("header"), []byte("payload-1"), []byte("payload-2")}},
+					{Data: []byte("data")},
+					{Parts: [][]byte{[]byte("header"), []byte("payload")}},
+				}
+				msgs := make(chan Msg, len(want))
+				devs := map[string]Device{
+					"sender":   &msgSender{msgs: want},
+					"receiver": &msgRecver{msgs: msgs},
 				}
-				grp.Go(func() error { return dev1.run(ctx) })
 
-				for _, cmd := range cmds {
-					dev1.cmds <- cmd
+				errc := make(chan error)
+				go func() { errc <- RunTopology(ctx, cfg, devs, ioutil.Discard) }()
+
+				for i := range want {
+					select {
+					case got := <-msgs:
+						if !reflect.DeepEqual(got, want[i]) {
+							t.Errorf("msg[%d]: got=%q, want=%q", i, got, want[i])
+						}
+					case <-ctx.Done():
+						t.Fatalf("timeout waiting for msg[%d]", i)
+					}
 				}
+				cancel()
 
-				err = grp.Wait()
+				err = <-errc
 				if err != nil {
 					t.Fatal(err)
 				}
+
+				if !tc.secure {
+					return
+				}
+				// security fields are not silently ignored by other transports.
+				for _, id := range []string{"sender", "receiver"} {
+					cfg.Transport = "nanomsg"
+					cfg.ID = id
+					_, err = newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+					if want := "could not secure channel \"data\""; err == nil || !strings.Contains(err.Error(), want) {
+						t.Fatalf("%s: invalid error: got=%v, want=%q", id, err, want)
+					}
+				}
 			})
 		}
+	})
+}
+
+// msgSender is a device sending a list of messages on its "data" channel.
+type msgSender struct {
+	msgs []Msg
+}
+
+func (dev *msgSender) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	for _, msg := range dev.msgs {
+		err := ctl.Send(ctx, "data", 0, msg)
+		if err != nil {
+			return nil
+		}
 	}
+	<-ctx.Done()
+	return nil
 }
 
-func TestDeviceFSMFromStdin(t *testing.T) {
-	for _, n := range testDrivers {
+// msgRecver is a device forwarding the messages received on its "data"
+// channel to a Go channel.
+type msgRecver struct {
+	msgs chan Msg
+}
+
+func (dev *msgRecver) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	for {
+		msg, err := ctl.Recv(ctx, "data", 0)
+		if err != nil {
+			return nil
+		}
+		dev.msgs <- msg
+	}
+}
+
+func TestChannelStats(t *testing.T) {
+	defer func(unit time.Duration) { rateLoggingUnit = unit }(rateLoggingUnit)
+	rateLoggingUnit = 20 * time.Millisecond
+
+	cfg := config.Config{
+		Transport: InProc,
+		Options: config.Options{
+			Devices: []config.Device{
+				{
+					ID: "sender",
+					Channels: []config.Channel{{
+						Name:    "data",
+						Sockets: []config.Socket{{Type: "push", Method: "bind", Address: "tcp://*:5555"}},
+					}},
+				},
+				{
+					ID: "receiver",
+					Channels: []config.Channel{{
+						Name:        "data",
+						RateLogging: 1,
+						Sockets:     []config.Socket{{Type: "pull", Method: "connect", Address: "tcp://localhost:5555"}},
+					}},
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgs := []Msg{{Data: []byte("1")}, {Data: []byte("22")}, {Data: []byte("333")}}
+	stats := make(chan []ChannelStats, 1)
+	devs := map[string]Device{
+		"sender":   &msgSender{msgs: msgs},
+		"receiver": &statsRecver{n: len(msgs), stats: stats},
+	}
+
+	stdout := new(syncBuffer)
+	errc := make(chan error)
+	go func() { errc <- RunTopology(ctx, cfg, devs, stdout) }()
+
+	var got []ChannelStats
+	select {
+	case got = <-stats:
+	case <-ctx.Done():
+		t.Fatalf("timeout waiting for channel stats")
+	}
+	cancel()
+
+	err := <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("invalid number of stats: got=%d, want=1", len(got))
+	}
+	st := got[0]
+	if st.Channel != "data" || st.Socket != 0 {
+		t.Fatalf("invalid stats channel: got=%s[%d], want=data[0]", st.Channel, st.Socket)
+	}
+	if st.MsgsIn != 3 || st.BytesIn != 6 || st.MsgsOut != 0 || st.BytesOut != 0 {
+		t.Fatalf("invalid stats counters: %+v", st)
+	}
+	if st.MsgRateIn <= 0 || st.ByteRateIn <= 0 {
+		t.Fatalf("invalid stats rates: %+v", st)
+	}
+
+	if !strings.Contains(stdout.String(), "[INFO] receiver.data: in: ") {
+		t.Fatalf("missing rate logging:\n%s", stdout.String())
+	}
+	if strings.Contains(stdout.String(), "[INFO] sender.data: in: ") {
+		t.Fatalf("unexpected rate logging for channel without rateLogging:\n%s", stdout.String())
+	}
+}
+
+// statsRecver is a device receiving n messages on its "data" channel and
+// reporting the stats of its channels once their rates have been measured.
+type statsRecver struct {
+	n     int
+	stats chan []ChannelStats
+}
+
+func (dev *statsRecver) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	for i := 0; i < dev.n; i++ {
+		_, err := ctl.Recv(ctx, "data", 0)
+		if err != nil {
+			return nil
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats := ctl.Stats()
+			if len(stats) > 0 && stats[0].MsgRateIn > 0 {
+				dev.stats <- stats
+				<-ctx.Done()
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	for _, n := range append(testDrivers, InProc) {
 		transport := n
-		for _, cmds := range [][]byte{
-			{'i', 'r', 'p', 's', 'q'},
-			{'i', 'r', 's', 'q'},
-			{'i', 'r', 'q'},
-			{'i', 'q'},
-			{'q'},
-		} {
-			cmds := cmds
-			list := make([]string, len(cmds))
-			for i := range cmds {
-				list[i] = string(cmds[i])
+		t.Run("transport="+transport, func(t *testing.T) {
+			t.Parallel()
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v", err)
 			}
 
-			t.Run("transport="+transport+";cmds="+strings.Join(list, "|"), func(t *testing.T) {
+			cfg := config.Config{
+				Transport: transport,
+				Options: config.Options{
+					Devices: []config.Device{
+						{
+							ID: "publisher",
+							Channels: []config.Channel{{
+								Name:    "data",
+								Sockets: []config.Socket{{Type: "pub", Method: "bind", Address: "tcp://*:" + port}},
+							}},
+						},
+						{
+							ID: "monitor",
+							Channels: []config.Channel{{
+								Name: "data",
+								Sockets: []config.Socket{{
+									Type: "sub", Method: "connect", Address: "tcp://localhost:" + port,
+									Subscriptions: []string{"mon"},
+								}},
+							}},
+						},
+					},
+				},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			msgs := make(chan Msg)
+			devs := map[string]Device{
+				"publisher": &topicPublisher{topics: []string{"mon", "log"}},
+				"monitor":   &topicMonitor{msgs: msgs},
+			}
+
+			errc := make(chan error)
+			go func() { errc <- RunTopology(ctx, cfg, devs, ioutil.Discard) }()
+
+			for _, want := range []string{"mon", "log"} {
+				select {
+				case msg := <-msgs:
+					if got := string(msg.Data); !strings.HasPrefix(got, want) {
+						t.Errorf("invalid message: got=%q, want=%q", got, want)
+					}
+				case <-ctx.Done():
+					t.Fatalf("timeout waiting for a %q message", want)
+				}
+			}
+			cancel()
+
+			err = <-errc
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionsInvalid(t *testing.T) {
+	cfg := config.Config{
+		ID:        "dev1",
+		Transport: "nanomsg",
+		Options: config.Options{
+			Devices: []config.Device{{ID: "dev1", Channels: []config.Channel{{
+				Name: "data",
+				Sockets: []config.Socket{{
+					Type: "pull", Method: "bind", Address: "inproc://subscriptions-1",
+					Subscriptions: []string{"topic"},
+				}},
+			}}}},
+		},
+	}
+	_, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+	if err == nil {
+		t.Fatalf("expected an error creating a pull channel with subscriptions")
+	}
+
+	cfg.Options.Devices[0].Channels[0].Sockets[0].Subscriptions = nil
+	dev, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.exec(CmdEnd)
+
+	err = dev.SubscribeTopic("data", 0, "topic")
+	if err == nil {
+		t.Fatalf("expected an error subscribing a pull channel")
+	}
+	err = dev.UnsubscribeTopic("data", 1, "topic")
+	if err == nil {
+		t.Fatalf("expected an error unsubscribing an invalid channel")
+	}
+}
+
+// topicPublisher is a device publishing messages for each of its topics on
+// its "data" channel.
+type topicPublisher struct {
+	topics []string
+}
+
+func (dev *topicPublisher) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	for i := 0; ; i++ {
+		for _, topic := range dev.topics {
+			err := ctl.Send(ctx, "data", 0, Msg{Data: []byte(fmt.Sprintf("%s-%d", topic, i))})
+			if err != nil {
+				return nil
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// topicMonitor is a device receiving messages for the "mon" topic on its
+// "data" channel, then switching to the "log" topic.
+type topicMonitor struct {
+	msgs chan Msg
+}
 
+func (dev *topicMonitor) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	topic := "mon"
+	for {
+		msg, err := ctl.Recv(ctx, "data", 0)
+		if err != nil {
+			return nil
+		}
+		if !bytes.HasPrefix(msg.Data, []byte(topic)) {
+			if topic == "mon" {
+				return xerrors.Errorf("received message for an unsubscribed topic: %q", msg.Data)
+			}
+			// messages in flight before the subscriptions changed.
+			continue
+		}
+		select {
+		case dev.msgs <- msg:
+		case <-ctx.Done():
+			return nil
+		}
+		if topic == "log" {
+			<-ctx.Done()
+			return nil
+		}
+
+		topic = "log"
+		err = ctl.UnsubscribeTopic("data", 0, "mon")
+		if err != nil {
+			return err
+		}
+		err = ctl.SubscribeTopic("data", 0, "log")
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	for _, n := range append(testDrivers, InProc) {
+		for _, types := range [][2]string{{"req", "rep"}, {"dealer", "router"}, {"dealer", "rep"}} {
+			transport, client, server := n, types[0], types[1]
+			t.Run("transport="+transport+"/types="+client+"-"+server, func(t *testing.T) {
 				t.Parallel()
 
-				const N = 1024
-				cfg, err := getSPSConfig(transport)
+				port, err := getTCPPort()
 				if err != nil {
-					t.Fatal(err)
+					t.Fatalf("error getting free TCP port: %v", err)
 				}
-				cfg.ID = "sampler1"
 
-				pr, pw, err := os.Pipe()
-				if err != nil {
-					t.Fatalf("could not create pipe: %v", err)
+				cfg := config.Config{
+					Transport: transport,
+					Options: config.Options{
+						Devices: []config.Device{
+							{
+								ID: "server",
+								Channels: []config.Channel{{
+									Name:    "rpc",
+									Sockets: []config.Socket{{Type: server, Method: "bind", Address: "tcp://*:" + port}},
+								}},
+							},
+							{
+								ID: "client",
+								Channels: []config.Channel{{
+									Name:    "rpc",
+									Sockets: []config.Socket{{Type: client, Method: "connect", Address: "tcp://localhost:" + port}},
+								}},
+							},
+						},
+					},
 				}
-				defer pr.Close()
-				defer pw.Close()
-				stdout := new(bytes.Buffer)
 
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
 
-				grp, ctx := errgroup.WithContext(ctx)
-				dev1, err := newDevice(ctx, cfg, &sampler{n: N}, pr, stdout)
-				if err != nil {
-					t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+				reqs := []Msg{
+					{Data: []byte("hello")},
+					{Parts: [][]byte{[]byte("header"), []byte("payload")}},
+					{Data: []byte("world")},
+				}
+				reps := make(chan Msg, len(reqs))
+				devs := map[string]Device{
+					"server": &upperServer{},
+					"client": &requester{reqs: reqs, reps: reps},
 				}
-				grp.Go(func() error { return dev1.run(ctx) })
 
-				for _, cmd := range cmds {
-					pw.Write([]byte{cmd, '\n'})
+				errc := make(chan error)
+				go func() { errc <- RunTopology(ctx, cfg, devs, ioutil.Discard) }()
+
+				want := []Msg{
+					{Data: []byte("HELLO")},
+					{Parts: [][]byte{[]byte("HEADER"), []byte("PAYLOAD")}},
+					{Data: []byte("WORLD")},
+				}
+				for i := range want {
+					select {
+					case got := <-reps:
+						if !reflect.DeepEqual(got, want[i]) {
+							t.Errorf("reply[%d]: got=%q, want=%q", i, got, want[i])
+						}
+					case <-ctx.Done():
+						t.Fatalf("timeout waiting for reply[%d]", i)
+					}
 				}
+				cancel()
 
-				err = grp.Wait()
+				err = <-errc
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -343,6 +1117,1931 @@ func TestDeviceFSMFromStdin(t *testing.T) {
 	}
 }
 
+func TestRequestCancel(t *testing.T) {
+	for _, typ := range []string{"req", "dealer"} {
+		typ := typ
+		t.Run("type="+typ, func(t *testing.T) {
+			t.Parallel()
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v", err)
+			}
+
+			drv, err := mq.Open("go-chan")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := mq.Rep
+			if typ == "dealer" {
+				server = mq.Router
+			}
+			peer, err := drv.NewSocket(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+			err = peer.Listen("tcp://*:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// recv receives a request, returning its envelope and payload.
+			recv := func() ([][]byte, string) {
+				parts, err := peer.RecvMulti()
+				if err != nil {
+					t.Fatal(err)
+				}
+				n := len(parts) - 1
+				return parts[:n:n], string(parts[n])
+			}
+			reply := func(env [][]byte, rep string) {
+				err := peer.SendMulti(append(env, []byte(rep)))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := config.Config{
+				Transport: "go-chan",
+				Options: config.Options{
+					Devices: []config.Device{{
+						ID: "client",
+						Channels: []config.Channel{{
+							Name:    "rpc",
+							Sockets: []config.Socket{{Type: typ, Method: "connect", Address: "tcp://localhost:" + port}},
+						}},
+					}},
+				},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			usr := &ctlRunner{ctls: make(chan Controller, 1)}
+			errc := make(chan error)
+			go func() { errc <- RunTopology(ctx, cfg, map[string]Device{"client": usr}, ioutil.Discard) }()
+			ctl := <-usr.ctls
+
+			type result struct {
+				rep Msg
+				err error
+			}
+			request := func(ctx context.Context, req string) chan result {
+				res := make(chan result, 1)
+				go func() {
+					rep, err := ctl.Request(ctx, "rpc", 0, Msg{Data: []byte(req)})
+					res <- result{rep, err}
+				}()
+				return res
+			}
+			check := func(res chan result, want string) {
+				t.Helper()
+				got := <-res
+				if got.err != nil {
+					t.Fatalf("could not send request: %+v", got.err)
+				}
+				if string(got.rep.Data) != want {
+					t.Fatalf("invalid reply: got=%q, want=%q", got.rep.Data, want)
+				}
+			}
+
+			// the peer never replies to the first request in time.
+			tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer tcancel()
+			res := request(tctx, "r1")
+			env1, req := recv()
+			if req != "r1" {
+				t.Fatalf("invalid request: got=%q, want=%q", req, "r1")
+			}
+			if got := <-res; !xerrors.Is(got.err, context.DeadlineExceeded) {
+				t.Fatalf("invalid error: got=%v, want=%v", got.err, context.DeadlineExceeded)
+			}
+
+			res = request(ctx, "r2")
+			switch typ {
+			case "req":
+				// the late reply is discarded.
+				reply(env1, "late")
+				env2, req := recv()
+				if req != "r2" {
+					t.Fatalf("invalid request: got=%q, want=%q", req, "r2")
+				}
+				reply(env2, "R2")
+				check(res, "R2")
+
+			case "dealer":
+				// requests are pipelined, and replies matched to them.
+				env2, req := recv()
+				if req != "r2" {
+					t.Fatalf("invalid request: got=%q, want=%q", req, "r2")
+				}
+				res3 := request(ctx, "r3")
+				env3, req := recv()
+				if req != "r3" {
+					t.Fatalf("invalid request: got=%q, want=%q", req, "r3")
+				}
+				reply(env3, "R3")
+				reply(env1, "late")
+				reply(env2, "R2")
+				check(res3, "R3")
+				check(res, "R2")
+			}
+
+			cancel()
+			err = <-errc
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestServeError(t *testing.T) {
+	port, err := getTCPPort()
+	if err != nil {
+		t.Fatalf("error getting free TCP port: %v", err)
+	}
+
+	cfg := config.Config{
+		Transport: InProc,
+		Options: config.Options{
+			Devices: []config.Device{
+				{
+					ID: "server",
+					Channels: []config.Channel{{
+						Name:    "rpc",
+						Sockets: []config.Socket{{Type: "rep", Method: "bind", Address: "tcp://*:" + port}},
+					}},
+				},
+				{
+					ID: "client",
+					Channels: []config.Channel{{
+						Name:    "rpc",
+						Sockets: []config.Socket{{Type: "req", Method: "connect", Address: "tcp://localhost:" + port}},
+					}},
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reps := make(chan Msg, 1)
+	devs := map[string]Device{
+		"server": &failServer{},
+		"client": &requester{reqs: []Msg{{Data: []byte("hello")}}, reps: reps},
+	}
+
+	err = RunTopology(ctx, cfg, devs, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("invalid error: got=%v, want handler error", err)
+	}
+	select {
+	case rep := <-reps:
+		t.Fatalf("unexpected reply to failed request: %q", rep)
+	default:
+	}
+}
+
+func TestRequestReplyInvalid(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	dev, err := newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dev.Request(context.Background(), "data1", 0, Msg{})
+	if want := "fer: invalid socket type push for channel (name=\"data1\" index=0)"; err == nil || err.Error() != want {
+		t.Fatalf("invalid error: got=%v, want=%q", err, want)
+	}
+	err = dev.Serve(context.Background(), "data1", 1, nil)
+	if want := "fer: no such channel (name=\"data1\" index=1)"; err == nil || err.Error() != want {
+		t.Fatalf("invalid error: got=%v, want=%q", err, want)
+	}
+
+	err = dev.exec(CmdEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upperServer is a device replying to requests with their upper-cased content.
+type upperServer struct{}
+
+func (dev *upperServer) Run(ctl Controller) error {
+	err := ctl.Serve(ctl.Context(), "rpc", 0, func(ctx context.Context, req Msg) (Msg, error) {
+		if len(req.Parts) == 0 {
+			return Msg{Data: bytes.ToUpper(req.Data)}, nil
+		}
+		var rep Msg
+		for _, part := range req.Parts {
+			rep.Parts = append(rep.Parts, bytes.ToUpper(part))
+		}
+		return rep, nil
+	})
+	if err != ctl.Context().Err() {
+		return err
+	}
+	return nil
+}
+
+// failServer is a device failing to handle requests.
+type failServer struct{}
+
+func (dev *failServer) Run(ctl Controller) error {
+	return ctl.Serve(ctl.Context(), "rpc", 0, func(ctx context.Context, req Msg) (Msg, error) {
+		return Msg{}, xerrors.New("boom")
+	})
+}
+
+// ctlRunner is a device handing its controller over, and running until its
+// context is cancelled.
+type ctlRunner struct {
+	ctls chan Controller
+}
+
+func (dev *ctlRunner) Run(ctl Controller) error {
+	dev.ctls <- ctl
+	<-ctl.Context().Done()
+	return nil
+}
+
+// requester is a device sending requests and forwarding the replies to a Go
+// channel.
+type requester struct {
+	reqs []Msg
+	reps chan Msg
+}
+
+func (dev *requester) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	for _, req := range dev.reqs {
+		rep, err := ctl.Request(ctx, "rpc", 0, req)
+		if err != nil {
+			return nil
+		}
+		dev.reps <- rep
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestRunTopologyErrors(t *testing.T) {
+	sps := map[string]Device{"sampler1": &hooks{}, "processor": &hooks{}, "sink1": &hooks{}}
+
+	for _, tc := range []struct {
+		name string
+		edit func(devs []config.Device)
+		devs map[string]Device
+		want string
+		errs []string
+	}{
+		{
+			name: "missing-device",
+			devs: map[string]Device{"sampler1": &hooks{}, "processor": &hooks{}},
+			want: "fer: no implementation for device \"sink1\"",
+		},
+		{
+			name: "unknown-device",
+			devs: map[string]Device{"sampler1": &hooks{}, "processor": &hooks{}, "sink1": &hooks{}, "sink2": &hooks{}},
+			want: "fer: no such device \"sink2\"",
+		},
+		{
+			name: "init-error",
+			devs: map[string]Device{"sampler1": &hooks{}, "processor": &hooks{err: errFaulty}, "sink1": &hooks{}},
+			want: "fer: topology failed: device processor: ",
+			errs: []string{"processor"},
+		},
+		{
+			name: "duplicate-bind",
+			edit: func(devs []config.Device) {
+				// sampler1 and sink1 bind the same port, as on two different hosts.
+				devs[2].Channels[0].Sockets[0].Address = devs[0].Channels[0].Sockets[0].Address
+			},
+			devs: sps,
+			want: "fer: address \"tcp://*:",
+		},
+		{
+			name: "ambiguous-connect",
+			edit: func(devs []config.Device) {
+				addr := devs[1].Channels[0].Sockets[0].Address
+				devs[1].Channels[1].Sockets[0].Address = strings.Replace(addr, "localhost", "node-2", 1)
+			},
+			devs: sps,
+			want: "fer: address \"tcp://localhost:",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := getSPSConfig(InProc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.edit != nil {
+				tc.edit(cfg.Options.Devices)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err = RunTopology(ctx, cfg, tc.devs, ioutil.Discard)
+			if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+			}
+			if tc.errs == nil {
+				return
+			}
+			var terr *TopologyError
+			if !xerrors.As(err, &terr) {
+				t.Fatalf("invalid error type %T", err)
+			}
+			var ids []string
+			for id, err := range terr.Errs {
+				ids = append(ids, id)
+				if !xerrors.Is(err, errFaulty) {
+					t.Errorf("invalid error for device %q: %v", id, err)
+				}
+			}
+			if !reflect.DeepEqual(ids, tc.errs) {
+				t.Fatalf("invalid failing devices: got=%q, want=%q", ids, tc.errs)
+			}
+		})
+	}
+}
+
+type sampler struct {
+	cfg   config.Device
+	datac chan Msg
+	n     int
+}
+
+func (dev *sampler) Configure(cfg config.Device) error {
+	dev.cfg = cfg
+	return nil
+}
+
+func (dev *sampler) Init(ctl Controller) error {
+	datac, err := ctl.Chan("data1", 0)
+	if err != nil {
+		return err
+	}
+
+	dev.datac = datac
+	return nil
+}
+
+func (dev *sampler) Run(ctl Controller) error {
+	i := 0
+	for {
+		select {
+		case dev.datac <- Msg{Data: []byte(fmt.Sprintf("HELLO-%02d", i))}:
+			i++
+		case <-ctl.Done():
+			return nil
+		}
+		if i >= dev.n {
+			dev.datac = nil
+		}
+	}
+}
+
+type processor struct {
+	cfg    config.Device
+	idatac chan Msg
+	odatac chan Msg
+}
+
+func (dev *processor) Configure(cfg config.Device) error {
+	dev.cfg = cfg
+	return nil
+}
+
+func (dev *processor) Init(ctl Controller) error {
+	idatac, err := ctl.Chan("data1", 0)
+	if err != nil {
+		return err
+	}
+
+	odatac, err := ctl.Chan("data2", 0)
+	if err != nil {
+		return err
+	}
+
+	dev.idatac = idatac
+	dev.odatac = odatac
+	return nil
+}
+
+func (dev *processor) Run(ctl Controller) error {
+	i := 0
+	for {
+		select {
+		case data := <-dev.idatac:
+			out := append([]byte(nil), data.Data...)
+			out = append(out, []byte(fmt.Sprintf(" (modified by %s - %02d)", dev.cfg.Name(), i))...)
+			dev.odatac <- Msg{Data: out}
+			i++
+		case <-ctl.Done():
+			return nil
+		}
+	}
+}
+
+type sink struct {
+	cfg   config.Device
+	datac chan Msg
+	n     int
+	sum   chan string
+}
+
+func (dev *sink) Configure(cfg config.Device) error {
+	dev.cfg = cfg
+	return nil
+}
+
+func (dev *sink) Init(ctl Controller) error {
+	datac, err := ctl.Chan("data2", 0)
+	if err != nil {
+		return err
+	}
+
+	dev.datac = datac
+	return nil
+}
+
+func (dev *sink) Run(ctl Controller) error {
+	i := 0
+	for {
+		select {
+		case data := <-dev.datac:
+			//ctl.Printf("received: %q (%d)\n", string(data.Data), i)
+			dev.sum <- fmt.Sprintf("%s - %02d", string(data.Data), i)
+			i++
+		case <-ctl.Done():
+			return nil
+		}
+		if i >= dev.n {
+			close(dev.sum)
+		}
+	}
+}
+
+func TestDeviceFSM(t *testing.T) {
+	for _, n := range testDrivers {
+		transport := n
+		for _, cmds := range [][]Cmd{
+			{CmdInitDevice, CmdInitTask, CmdRun, CmdPause, CmdRun, CmdStop, CmdResetTask, CmdResetDevice, CmdEnd},
+			{CmdInitDevice, CmdInitTask, CmdRun, CmdPause, CmdStop, CmdResetTask, CmdResetDevice, CmdEnd},
+			{CmdInitDevice, CmdInitTask, CmdRun, CmdStop, CmdResetTask, CmdResetDevice, CmdEnd},
+			{CmdInitDevice, CmdInitTask, CmdResetTask, CmdResetDevice, CmdEnd},
+			{CmdInitDevice, CmdResetDevice, CmdEnd},
+			{CmdEnd},
+		} {
+			cmds := cmds
+			list := make([]string, len(cmds))
+			for i := range cmds {
+				list[i] = cmds[i].String()
+			}
+
+			t.Run("transport="+transport+";cmds="+strings.Join(list, "|"), func(t *testing.T) {
+
+				t.Parallel()
+
+				const N = 1024
+				cfg, err := getSPSConfig(transport)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.ID = "sampler1"
+
+				stdin := new(bytes.Buffer)
+				stdout := new(bytes.Buffer)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				grp, ctx := errgroup.WithContext(ctx)
+				dev1, err := newDevice(ctx, cfg, &sampler{n: N}, stdin, stdout)
+				if err != nil {
+					t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+				}
+				grp.Go(func() error { return dev1.run(ctx) })
+
+				for _, cmd := range cmds {
+					err = dev1.exec(cmd)
+					if err != nil {
+						t.Fatalf("could not execute %v: %v", cmd, err)
+					}
+				}
+
+				err = grp.Wait()
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestDeviceFSMInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		cmds []Cmd
+		bad  Cmd
+		want State
+	}{
+		{cmds: nil, bad: CmdRun, want: StateIdle},
+		{cmds: nil, bad: CmdInitTask, want: StateIdle},
+		{cmds: []Cmd{CmdInitDevice}, bad: CmdInitDevice, want: StateDeviceReady},
+		{cmds: []Cmd{CmdInitDevice}, bad: CmdRun, want: StateDeviceReady},
+		{cmds: []Cmd{CmdInitDevice}, bad: CmdEnd, want: StateDeviceReady},
+		{cmds: []Cmd{CmdInitDevice, CmdInitTask}, bad: CmdPause, want: StateReady},
+		{cmds: []Cmd{CmdInitDevice, CmdInitTask}, bad: CmdStop, want: StateReady},
+		{cmds: []Cmd{CmdInitDevice, CmdInitTask, CmdRun}, bad: CmdEnd, want: StateRunning},
+		{cmds: []Cmd{CmdInitDevice, CmdInitTask, CmdRun}, bad: CmdResetTask, want: StateRunning},
+		{cmds: []Cmd{CmdInitDevice, CmdInitTask, CmdRun, CmdPause}, bad: CmdPause, want: StatePaused},
+	} {
+		tc := tc
+		list := make([]string, len(tc.cmds))
+		for i := range tc.cmds {
+			list[i] = tc.cmds[i].String()
+		}
+		t.Run(strings.Join(append(list, tc.bad.String()), "|"), func(t *testing.T) {
+			t.Parallel()
+
+			cfg, err := getSPSConfig("zeromq")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.ID = "sampler1"
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			usr := &hooks{}
+			dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), new(bytes.Buffer))
+			if err != nil {
+				t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+			}
+			errc := make(chan error)
+			go func() { errc <- dev.run(ctx) }()
+
+			for _, cmd := range tc.cmds {
+				err = dev.exec(cmd)
+				if err != nil {
+					t.Fatalf("could not execute %v: %v", cmd, err)
+				}
+			}
+
+			err = dev.exec(tc.bad)
+			if err == nil {
+				t.Fatalf("expected an error executing %v", tc.bad)
+			}
+			if got, want := dev.State(), tc.want; got != want {
+				t.Fatalf("invalid state: got=%v, want=%v", got, want)
+			}
+
+			for _, cmd := range endSequence(dev.State()) {
+				err = dev.exec(cmd)
+				if err != nil {
+					t.Fatalf("could not execute %v: %v", cmd, err)
+				}
+			}
+
+			err = <-errc
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDeviceHooks(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	usr := &hooks{}
+	dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+	errc := make(chan error)
+	go func() { errc <- dev.run(ctx) }()
+
+	for _, cmd := range []Cmd{
+		CmdInitDevice, CmdInitTask, CmdRun, CmdPause, CmdRun, CmdStop,
+		CmdResetTask, CmdResetDevice, CmdEnd,
+	} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"init", "run", "pause", "run", "reset"}
+	if !reflect.DeepEqual(usr.calls, want) {
+		t.Fatalf("invalid hooks calls:\ngot= %q\nwant=%q", usr.calls, want)
+	}
+}
+
+func TestDeviceHookError(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	usr := &hooks{err: xerrors.New("boom")}
+	dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+	errc := make(chan error)
+	go func() { errc <- dev.run(ctx) }()
+
+	err = dev.exec(CmdInitDevice)
+	if !xerrors.Is(err, usr.err) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, usr.err)
+	}
+	if got, want := dev.State(), StateError; got != want {
+		t.Fatalf("invalid state: got=%v, want=%v", got, want)
+	}
+
+	err = <-errc
+	if !xerrors.Is(err, usr.err) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, usr.err)
+	}
+}
+
+func TestDeviceSubscribe(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dev, err := newDevice(ctx, cfg, &hooks{}, new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+	if got, want := dev.State(), StateIdle; got != want {
+		t.Fatalf("invalid initial state: got=%v, want=%v", got, want)
+	}
+
+	evts, unsub := dev.Subscribe()
+	defer unsub()
+
+	errc := make(chan error)
+	go func() { errc <- dev.run(ctx) }()
+
+	for _, cmd := range []Cmd{
+		CmdInitDevice, CmdInitTask, CmdRun, CmdPause, CmdStop,
+		CmdResetTask, CmdResetDevice, CmdEnd,
+	} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []StateChange
+	beg := time.Time{}
+	for ev := range evts {
+		if ev.Time.Before(beg) {
+			t.Fatalf("state changes out of order: %v", ev)
+		}
+		beg = ev.Time
+		ev.Time = time.Time{}
+		got = append(got, ev)
+	}
+
+	want := []StateChange{
+		{StateIdle, StateInitializingDevice, CmdInitDevice, time.Time{}},
+		{StateInitializingDevice, StateDeviceReady, CmdInitDevice, time.Time{}},
+		{StateDeviceReady, StateInitializingTask, CmdInitTask, time.Time{}},
+		{StateInitializingTask, StateReady, CmdInitTask, time.Time{}},
+		{StateReady, StateRunning, CmdRun, time.Time{}},
+		{StateRunning, StatePaused, CmdPause, time.Time{}},
+		{StatePaused, StateReady, CmdStop, time.Time{}},
+		{StateReady, StateResettingTask, CmdResetTask, time.Time{}},
+		{StateResettingTask, StateDeviceReady, CmdResetTask, time.Time{}},
+		{StateDeviceReady, StateResettingDevice, CmdResetDevice, time.Time{}},
+		{StateResettingDevice, StateIdle, CmdResetDevice, time.Time{}},
+		{StateIdle, StateExiting, CmdEnd, time.Time{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid state changes:\ngot= %v\nwant=%v", got, want)
+	}
+
+	evts, unsub = dev.Subscribe()
+	defer unsub()
+	if _, ok := <-evts; ok {
+		t.Fatalf("expected a closed subscription after device exited")
+	}
+}
+
+func TestControlServer(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := getTCPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+	cfg.Control = "tcp://localhost:" + port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errc := make(chan error)
+	go func() {
+		errc <- RunDevice(ctx, cfg, &hooks{}, nil, new(bytes.Buffer))
+	}()
+
+	var cli *ControlClient
+	for i := 0; i < 100; i++ {
+		cli, err = DialControl(cfg.Control)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("could not dial control server: %v", err)
+	}
+	defer cli.Close()
+
+	st, err := cli.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st, StateIdle; got != want {
+		t.Fatalf("invalid state: got=%v, want=%v", got, want)
+	}
+
+	evts, err := cli.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cli.Exec(CmdRun)
+	if err == nil {
+		t.Fatalf("expected an error executing %v from %v", CmdRun, StateIdle)
+	}
+
+	for _, tc := range []struct {
+		cmd  Cmd
+		want State
+	}{
+		{CmdInitDevice, StateDeviceReady},
+		{CmdInitTask, StateReady},
+		{CmdRun, StateRunning},
+		{CmdStop, StateReady},
+		{CmdResetTask, StateDeviceReady},
+		{CmdResetDevice, StateIdle},
+		{CmdEnd, StateExiting},
+	} {
+		st, err := cli.Exec(tc.cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", tc.cmd, err)
+		}
+		if st != tc.want {
+			t.Fatalf("invalid state after %v: got=%v, want=%v", tc.cmd, st, tc.want)
+		}
+	}
+
+	var got []State
+	for ev := range evts {
+		got = append(got, ev.New)
+	}
+	want := []State{
+		StateInitializingDevice, StateDeviceReady,
+		StateInitializingTask, StateReady,
+		StateRunning, StateReady,
+		StateResettingTask, StateDeviceReady,
+		StateResettingDevice, StateIdle,
+		StateExiting,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid state changes:\ngot= %v\nwant=%v", got, want)
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControlSubscriberNotDrained(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := getTCPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+	cfg.Control = "tcp://localhost:" + port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errc := make(chan error)
+	go func() {
+		errc <- RunDevice(ctx, cfg, &hooks{}, nil, new(bytes.Buffer))
+	}()
+
+	var cli *ControlClient
+	for i := 0; i < 100; i++ {
+		cli, err = DialControl(cfg.Control)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("could not dial control server: %v", err)
+	}
+	defer cli.Close()
+
+	// never drain the state changes.
+	_, err = cli.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		for _, cmd := range []Cmd{CmdInitDevice, CmdResetDevice} {
+			_, err := cli.Exec(cmd)
+			if err != nil {
+				t.Fatalf("could not execute %v (iter=%d): %v", cmd, i, err)
+			}
+		}
+	}
+
+	_, err = cli.Exec(CmdEnd)
+	if err != nil {
+		t.Fatalf("could not execute %v: %v", CmdEnd, err)
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeviceBindError(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := getTCPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+	cfg.Control = "tcp://localhost:" + port
+
+	// the data socket of the device can not be bound.
+	addr := cfg.Options.Devices[0].Channels[0].Sockets[0].Address
+	l, err := net.Listen("tcp", addr[strings.LastIndex(addr, "*")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = RunDevice(ctx, cfg, &hooks{}, nil, new(bytes.Buffer))
+	if err == nil {
+		t.Fatalf("expected an error binding %q", addr)
+	}
+
+	cli, err := DialControl(cfg.Control)
+	if err == nil {
+		cli.Close()
+		t.Fatalf("control server still running after a failed start")
+	}
+}
+
+// hooks is a device recording the calls to its hooks.
+type hooks struct {
+	calls []string
+	err   error
+}
+
+func (dev *hooks) Init(ctl Controller) error {
+	dev.calls = append(dev.calls, "init")
+	return dev.err
+}
+
+func (dev *hooks) Run(ctl Controller) error {
+	dev.calls = append(dev.calls, "run")
+	<-ctl.Done()
+	return nil
+}
+
+func (dev *hooks) Pause(ctl Controller) error {
+	dev.calls = append(dev.calls, "pause")
+	return nil
+}
+
+func (dev *hooks) Reset(ctl Controller) error {
+	dev.calls = append(dev.calls, "reset")
+	return nil
+}
+
+func TestControllerContext(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	usr := &ctxRunner{ctxs: make(chan context.Context, 1)}
+	dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+	errc := make(chan error)
+	go func() { errc <- dev.run(ctx) }()
+
+	if err := dev.Context().Err(); err == nil {
+		t.Fatalf("context of an idle device should be cancelled")
+	}
+
+	_, err = dev.Recv(ctx, "data3", 0)
+	if err == nil {
+		t.Fatalf("expected an error receiving from an invalid channel")
+	}
+	err = dev.Send(ctx, "data3", 0, Msg{})
+	if err == nil {
+		t.Fatalf("expected an error sending to an invalid channel")
+	}
+
+	for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+	}
+
+	runCtx := <-usr.ctxs
+	if err := runCtx.Err(); err != nil {
+		t.Fatalf("context of a running device should not be cancelled: %v", err)
+	}
+
+	// data1 is an output channel: nothing is received from it.
+	tctx, tcancel := context.WithTimeout(runCtx, 10*time.Millisecond)
+	defer tcancel()
+	_, err = dev.Recv(tctx, "data1", 0)
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, context.DeadlineExceeded)
+	}
+
+	for _, cmd := range []Cmd{CmdPause, CmdStop, CmdResetTask, CmdResetDevice, CmdEnd} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+		if cmd == CmdPause {
+			if err := runCtx.Err(); err != context.Canceled {
+				t.Fatalf("invalid context error: got=%v, want=%v", err, context.Canceled)
+			}
+			if err := dev.Context().Err(); err == nil {
+				t.Fatalf("context of a paused device should be cancelled")
+			}
+		}
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ctxRunner is a device running until its context is cancelled.
+type ctxRunner struct {
+	ctxs chan context.Context
+}
+
+func (dev *ctxRunner) Run(ctl Controller) error {
+	ctx := ctl.Context()
+	dev.ctxs <- ctx
+	msg, err := ctl.Recv(ctx, "data1", 0)
+	if err != ctx.Err() {
+		return xerrors.Errorf("unexpected message %v: %w", msg, err)
+	}
+	return nil
+}
+
+func TestControllerContextRunReturns(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	usr := &returner{ctls: make(chan Controller, 1)}
+	dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+	errc := make(chan error)
+	go func() { errc <- dev.run(ctx) }()
+
+	for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+	}
+
+	// the context of the run is cancelled once Run returned on its own.
+	ctl := <-usr.ctls
+	select {
+	case <-ctl.Context().Done():
+	case <-ctx.Done():
+		t.Fatalf("context of a device whose Run returned was not cancelled")
+	}
+
+	for _, cmd := range []Cmd{CmdResetTask, CmdResetDevice, CmdEnd} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returner is a device handing its controller over and returning from Run
+// right away.
+type returner struct {
+	ctls chan Controller
+}
+
+func (dev *returner) Run(ctl Controller) error {
+	dev.ctls <- ctl
+	return nil
+}
+
+func TestDeviceFSMFromStdin(t *testing.T) {
+	for _, n := range testDrivers {
+		transport := n
+		for _, cmds := range [][]byte{
+			{'i', 'j', 'r', 'p', 'r', 's', 'q'},
+			{'i', 'j', 'r', 'p', 's', 'q'},
+			{'i', 'j', 'r', 's', 'q'},
+			{'i', 'j', 'r', 'q'},
+			{'i', 'j', 't', 'q'},
+			{'i', 'r', 'q'},
+			{'i', 'q'},
+			{'q'},
+		} {
+			cmds := cmds
+			list := make([]string, len(cmds))
+			for i := range cmds {
+				list[i] = string(cmds[i])
+			}
+
+			t.Run("transport="+transport+";cmds="+strings.Join(list, "|"), func(t *testing.T) {
+
+				t.Parallel()
+
+				const N = 1024
+				cfg, err := getSPSConfig(transport)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.ID = "sampler1"
+
+				pr, pw, err := os.Pipe()
+				if err != nil {
+					t.Fatalf("could not create pipe: %v", err)
+				}
+				defer pr.Close()
+				defer pw.Close()
+				stdout := new(bytes.Buffer)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				grp, ctx := errgroup.WithContext(ctx)
+				dev1, err := newDevice(ctx, cfg, &sampler{n: N}, pr, stdout)
+				if err != nil {
+					t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+				}
+				grp.Go(func() error { return dev1.run(ctx) })
+
+				for _, cmd := range cmds {
+					pw.Write([]byte{cmd, '\n'})
+				}
+
+				err = grp.Wait()
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestConsole(t *testing.T) {
+	cfg, err := getSPSConfig("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ID = "sampler1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stdin := strings.NewReader(strings.Join([]string{
+		"help",
+		"run",
+		"state",
+		"init",
+		"r",
+		"INIT",
+		"bogus",
+		"channels",
+		"stats",
+		"pause",
+		"!!",
+		"history",
+		"!42",
+		"stop",
+		"reset",
+		"end",
+		"state",
+	}, "\n"))
+	stdout := new(bytes.Buffer)
+
+	dev, err := newDevice(ctx, cfg, &hooks{}, stdin, stdout)
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+
+	err = dev.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := stdout.String()
+	for _, want := range []string{
+		"init-device (i)",
+		"run: command RUN is not allowed in state IDLE\n",
+		"state: IDLE\n",
+		"state: READY\n",
+		"state: RUNNING\n",
+		"init: cannot initialize device in state RUNNING\n",
+		"unknown command \"bogus\"",
+		"data1[0]: push bind tcp://*:",
+		"data1[0]: in: 0 msgs (0 bytes), out: 0 msgs (0 bytes)\n",
+		"state: PAUSED\n",
+		"pause: command PAUSE is not allowed in state PAUSED\n",
+		"  10  pause\n",
+		"invalid history recall \"!42\"",
+		"state: IDLE\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		src   string
+		err   error
+		calls []string
+	}{
+		{
+			name: "run-for",
+			src: `# a simple script
+init
+wait-state READY 1s
+run-for 100ms
+state
+sleep 10ms
+`,
+			calls: []string{"init", "run", "reset"},
+		},
+		{
+			name: "explicit",
+			src: `i
+j
+wait-state ready
+run
+wait-state RUNNING
+pause
+wait-state PAUSED 1s
+r
+stop
+reset
+end
+`,
+			calls: []string{"init", "run", "pause", "run", "reset"},
+		},
+		{
+			name:  "timeout",
+			src:   "init\nwait-state RUNNING 50ms\n",
+			err:   errTimeout,
+			calls: []string{"init"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := ioutil.TempFile("", "fer-script-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			_, err = f.WriteString(tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := getSPSConfig("zeromq")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.ID = "sampler1"
+			cfg.Control = "script:" + f.Name()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			usr := &hooks{}
+			err = RunDevice(ctx, cfg, usr, nil, new(bytes.Buffer))
+			switch {
+			case tc.err == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != nil && !xerrors.Is(err, tc.err):
+				t.Fatalf("invalid error: got=%v, want=%v", err, tc.err)
+			}
+
+			if !reflect.DeepEqual(usr.calls, tc.calls) {
+				t.Fatalf("invalid hooks calls:\ngot= %q\nwant=%q", usr.calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestScriptParse(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		{"init\nfly\n", `fer: test:2: unknown statement "fly"`},
+		{"wait-state\n", "fer: test:1: wait-state expects a state and an optional timeout"},
+		{"wait-state FLYING\n", `fer: test:1: fer: invalid state name (value="FLYING")`},
+		{"wait-state READY soon\n", `fer: test:1: invalid timeout: time: invalid duration "soon"`},
+		{"sleep\n", "fer: test:1: sleep expects a duration"},
+		{"run-for 1\n", `fer: test:1: invalid duration: time: missing unit in duration "1"`},
+		{"run now\n", "fer: test:1: run expects no argument"},
+		{"history\n", `fer: test:1: unknown statement "history"`},
+	} {
+		_, err := parseScript("test", strings.NewReader(tc.src))
+		if err == nil {
+			t.Errorf("expected an error parsing %q", tc.src)
+			continue
+		}
+		if got, want := err.Error(), tc.err; got != want {
+			t.Errorf("invalid error parsing %q:\ngot= %v\nwant=%v", tc.src, got, want)
+		}
+	}
+}
+
+func TestSignals(t *testing.T) {
+	newTestDevice := func(t *testing.T, ctx context.Context, usr Device) (*device, chan error) {
+		cfg, err := getSPSConfig("zeromq")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.ID = "sampler1"
+
+		dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), new(bytes.Buffer))
+		if err != nil {
+			t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+		}
+		errc := make(chan error)
+		go func() { errc <- dev.run(ctx) }()
+
+		for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+			err = dev.exec(cmd)
+			if err != nil {
+				t.Fatalf("could not execute %v: %v", cmd, err)
+			}
+		}
+		return dev, errc
+	}
+
+	t.Run("shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		usr := &hooks{}
+		dev, errc := newTestDevice(t, ctx, usr)
+
+		sigc := make(chan os.Signal, 1)
+		go dev.handleSignals(sigc, time.Second)
+		sigc <- syscall.SIGTERM
+
+		err := <-errc
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := dev.State(), StateExiting; got != want {
+			t.Fatalf("invalid state: got=%v, want=%v", got, want)
+		}
+		if got, want := usr.calls, []string{"init", "run", "reset"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("invalid hooks calls:\ngot= %q\nwant=%q", got, want)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		usr := &stuck{unblock: make(chan int)}
+		defer close(usr.unblock)
+		dev, errc := newTestDevice(t, ctx, usr)
+
+		sigc := make(chan os.Signal, 1)
+		go dev.handleSignals(sigc, 50*time.Millisecond)
+		sigc <- syscall.SIGINT
+
+		err := <-errc
+		if !xerrors.Is(err, errTimeout) {
+			t.Fatalf("invalid error: got=%v, want=%v", err, errTimeout)
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		codec := make(chan int, 1)
+		defer func(exit func(int)) { osExit = exit }(osExit)
+		osExit = func(code int) { codec <- code }
+
+		usr := &stuck{unblock: make(chan int)}
+		dev, errc := newTestDevice(t, ctx, usr)
+
+		sigc := make(chan os.Signal, 1)
+		go dev.handleSignals(sigc, time.Minute)
+		sigc <- syscall.SIGINT
+		sigc <- syscall.SIGINT
+
+		if got, want := <-codec, 128+int(syscall.SIGINT); got != want {
+			t.Fatalf("invalid exit code: got=%d, want=%d", got, want)
+		}
+
+		close(usr.unblock)
+		err := <-errc
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDeviceClosesSockets(t *testing.T) {
+	cfg := config.Config{
+		ID:        "dev",
+		Transport: "fer-test-slow",
+		Control:   "interactive",
+		Options: config.Options{
+			Devices: []config.Device{{
+				ID: "dev",
+				Channels: []config.Channel{{
+					Name: "data",
+					Sockets: []config.Socket{
+						{Type: "push", Method: "bind", Address: "tcp://*:5555"},
+						{Type: "push", Method: "bind", Address: "tcp://*:5556"},
+					},
+				}},
+			}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dev, err := newDevice(ctx, cfg, &hooks{}, new(bytes.Buffer), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+	}
+	errc := make(chan error)
+	go func() { errc <- dev.run(ctx) }()
+
+	for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+		err = dev.exec(cmd)
+		if err != nil {
+			t.Fatalf("could not execute %v: %v", cmd, err)
+		}
+	}
+	err = dev.shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sockets are closed once the device exits, so the resources they hold
+	// (e.g. shared memory segments) are released.
+	for i, ch := range dev.chans["data"] {
+		select {
+		case <-ch.sck.(*slowSocket).quit:
+		default:
+			t.Fatalf("socket %d still open after the device exited", i)
+		}
+	}
+}
+
+// stuck is a device whose Run method ignores the Controller.Done() channel.
+type stuck struct {
+	unblock chan int
+}
+
+func (dev *stuck) Run(ctl Controller) error {
+	<-dev.unblock
+	return nil
+}
+
+func TestChannelErrors(t *testing.T) {
+	newConfig := func(typ, policy string) config.Config {
+		return config.Config{
+			ID:        "dev",
+			Transport: "fer-test-faulty",
+			Control:   "interactive",
+			Options: config.Options{
+				Devices: []config.Device{{
+					ID: "dev",
+					Channels: []config.Channel{{
+						Name:        "data",
+						ErrorPolicy: policy,
+						Sockets: []config.Socket{{
+							Type:    typ,
+							Method:  "bind",
+							Address: "tcp://*:5555",
+						}},
+					}},
+				}},
+			},
+		}
+	}
+
+	start := func(t *testing.T, ctx context.Context, cfg config.Config, usr Device, w io.Writer) (*device, chan error) {
+		dev, err := newDevice(ctx, cfg, usr, new(bytes.Buffer), w)
+		if err != nil {
+			t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+		}
+		errc := make(chan error)
+		go func() { errc <- dev.run(ctx) }()
+
+		for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+			err = dev.exec(cmd)
+			if err != nil {
+				t.Fatalf("could not execute %v: %v", cmd, err)
+			}
+		}
+		return dev, errc
+	}
+
+	for _, typ := range []string{"push", "pull"} {
+		typ := typ
+		t.Run("fail-"+typ, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, errc := start(t, ctx, newConfig(typ, "fail"), &relay{}, new(bytes.Buffer))
+			err := <-errc
+			var cerr *ChannelError
+			if !xerrors.As(err, &cerr) {
+				t.Fatalf("expected a channel error, got: %v", err)
+			}
+			want := &ChannelError{
+				Channel: "data",
+				Addr:    "tcp://*:5555",
+				Op:      map[string]string{"push": "send", "pull": "recv"}[typ],
+				Err:     errFaulty,
+			}
+			if !reflect.DeepEqual(cerr, want) {
+				t.Fatalf("invalid channel error:\ngot= %#v\nwant=%#v", cerr, want)
+			}
+		})
+	}
+
+	t.Run("deliver", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		usr := &relay{errs: make(chan error)}
+		dev, errc := start(t, ctx, newConfig("pull", "deliver"), usr, new(bytes.Buffer))
+		err := <-usr.errs
+		if !xerrors.Is(err, errFaulty) {
+			t.Fatalf("invalid delivered error: got=%v, want=%v", err, errFaulty)
+		}
+
+		err = dev.shutdown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-errc
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("log", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		stdout := new(syncBuffer)
+		dev, errc := start(t, ctx, newConfig("pull", "log"), &relay{}, stdout)
+		want := `dev.data: fer: recv error on channel "data" (address="tcp://*:5555"): faulty socket`
+		for !strings.Contains(stdout.String(), want) {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("missing error message in output:\n%s", stdout.String())
+			case <-time.After(time.Millisecond):
+			}
+		}
+		if got, want := dev.State(), StateRunning; got != want {
+			t.Fatalf("invalid state: got=%v, want=%v", got, want)
+		}
+
+		err := dev.shutdown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-errc
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("invalid-policy", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, err := newDevice(ctx, newConfig("pull", "ignore"), &relay{}, nil, new(bytes.Buffer))
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (buf *syncBuffer) Write(p []byte) (int, error) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.buf.Write(p)
+}
+
+func (buf *syncBuffer) String() string {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.buf.String()
+}
+
+// relay is a device sending data on its "data" channel, if it is an output
+// channel, and relaying errors received from its "data" channel otherwise.
+type relay struct {
+	data chan Msg
+	errs chan error
+}
+
+func (dev *relay) Init(ctl Controller) error {
+	data, err := ctl.Chan("data", 0)
+	dev.data = data
+	return err
+}
+
+func (dev *relay) Run(ctl Controller) error {
+	out := dev.data
+	for {
+		select {
+		case out <- Msg{Data: []byte("data")}:
+			out = nil
+		case msg := <-dev.data:
+			if msg.Err != nil && dev.errs != nil {
+				dev.errs <- msg.Err
+				dev.errs = nil
+			}
+		case <-ctl.Done():
+			return nil
+		}
+	}
+}
+
+var errFaulty = xerrors.New("faulty socket")
+
+// faultyDriver is a mq.Driver whose sockets fail to send and receive data.
+type faultyDriver struct{}
+
+func (faultyDriver) Name() string { return "fer-test-faulty" }
+
+func (faultyDriver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	return &faultySocket{typ: typ, quit: make(chan struct{})}, nil
+}
+
+type faultySocket struct {
+	typ  mq.SocketType
+	once sync.Once
+	quit chan struct{}
+}
+
+func (sck *faultySocket) Close() error {
+	sck.once.Do(func() { close(sck.quit) })
+	return nil
+}
+
+func (sck *faultySocket) Send(data []byte) error { return errFaulty }
+
+func (sck *faultySocket) Recv() ([]byte, error) {
+	select {
+	case <-time.After(time.Millisecond):
+		return nil, errFaulty
+	case <-sck.quit:
+		return nil, xerrors.New("closed socket")
+	}
+}
+
+func (sck *faultySocket) SendMulti(parts [][]byte) error { return errFaulty }
+
+func (sck *faultySocket) RecvMulti() ([][]byte, error) {
+	data, err := sck.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{data}, nil
+}
+
+func (sck *faultySocket) GetOption(name string) (interface{}, error) { return nil, errFaulty }
+func (sck *faultySocket) SetOption(name string, v interface{}) error { return errFaulty }
+
+func (sck *faultySocket) Listen(addr string) error { return nil }
+func (sck *faultySocket) Dial(addr string) error   { return nil }
+func (sck *faultySocket) Type() mq.SocketType      { return sck.typ }
+
+// slowDriver is a mq.Driver whose sockets take some time to close.
+type slowDriver struct{}
+
+func (slowDriver) Name() string { return "fer-test-slow" }
+
+func (slowDriver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	return &slowSocket{faultySocket{typ: typ, quit: make(chan struct{})}}, nil
+}
+
+type slowSocket struct {
+	faultySocket
+}
+
+func (sck *slowSocket) Close() error {
+	time.Sleep(20 * time.Millisecond)
+	return sck.faultySocket.Close()
+}
+
+// countDriver is a mq.Driver counting its sockets that are not closed.
+type countDriver struct{}
+
+var countOpen int64 // countOpen is the number of open sockets of countDriver.
+
+func (countDriver) Name() string { return "fer-test-count" }
+
+func (countDriver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	atomic.AddInt64(&countOpen, 1)
+	return &countSocket{faultySocket: faultySocket{typ: typ, quit: make(chan struct{})}}, nil
+}
+
+type countSocket struct {
+	faultySocket
+	closed sync.Once
+}
+
+func (sck *countSocket) Close() error {
+	sck.closed.Do(func() { atomic.AddInt64(&countOpen, -1) })
+	return sck.faultySocket.Close()
+}
+
+func init() {
+	mq.Register("fer-test-faulty", faultyDriver{})
+	mq.Register("fer-test-slow", slowDriver{})
+	mq.Register("fer-test-count", countDriver{})
+	RegisterLogSink("fer-test-sink", func(w io.Writer) LogSink { return &recSink{} })
+}
+
+func TestLogger(t *testing.T) {
+	// the output of the console is not subject to the severity and format
+	// of the logs.
+	for _, tc := range []struct {
+		sev    string
+		format string
+		want   []string
+		skip   []string
+	}{
+		{
+			sev:  "",
+			want: []string{"\nstate: READY\n", "[ERROR] sampler1: run: command RUN"},
+			skip: []string{"[DEBUG]", "[INFO]"},
+		},
+		{
+			sev:  "debug",
+			want: []string{"[DEBUG] sampler1: --- new device", "\nstate: READY\n"},
+			skip: []string{"[INFO]"},
+		},
+		{
+			sev:  "ERROR",
+			want: []string{"[ERROR] sampler1: run: command RUN", "\nstate: READY\n"},
+			skip: []string{"[DEBUG]", "[INFO]"},
+		},
+		{
+			sev:    "warn",
+			format: "json",
+			want:   []string{`"severity":"ERROR"`, "\nstate: READY\n"},
+			skip:   []string{`"msg":"state: `},
+		},
+	} {
+		t.Run("severity="+tc.sev+"/format="+tc.format, func(t *testing.T) {
+			cfg, err := getSPSConfig("zeromq")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.ID = "sampler1"
+			cfg.Severity = tc.sev
+			cfg.LogFormat = tc.format
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			stdin := strings.NewReader("run\ninit\nend\n")
+			stdout := new(bytes.Buffer)
+
+			dev, err := newDevice(ctx, cfg, &hooks{}, stdin, stdout)
+			if err != nil {
+				t.Fatalf("error creating device %q: %v\n", cfg.ID, err)
+			}
+
+			err = dev.run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := stdout.String()
+			for _, want := range tc.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("missing %q in output:\n%s", want, out)
+				}
+			}
+			for _, skip := range tc.skip {
+				if strings.Contains(out, skip) {
+					t.Errorf("unexpected %q in output:\n%s", skip, out)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sink, err := openLogSink("json", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := newLogger(sink, SeverityDebug, "device", "dev1")
+	msg.state = func() State { return StateRunning }
+	msg.Tracef("not displayed")
+	msg.with("channel", "data").Warnf("hello %d\n", 42)
+
+	var rec struct {
+		Severity Severity `json:"severity"`
+		Device   string   `json:"device"`
+		Channel  string   `json:"channel"`
+		State    State    `json:"state"`
+		Msg      string   `json:"msg"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &rec)
+	if err != nil {
+		t.Fatalf("could not decode JSON record %q: %v", buf.String(), err)
+	}
+
+	if rec.Severity != SeverityWarn || rec.Device != "dev1" || rec.Channel != "data" || rec.State != StateRunning || rec.Msg != "hello 42" {
+		t.Fatalf("invalid JSON record: %+v", rec)
+	}
+}
+
+func TestLoggerConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sev  string
+		fmt  string
+		want string
+	}{
+		{name: "invalid-severity", sev: "verbose", want: "fer: invalid severity name"},
+		{name: "mistyped-severity", sev: "warnig", want: "fer: invalid severity name (value=\"warnig\")"},
+		{name: "blank-severity", sev: " ", want: "fer: invalid severity name"},
+		{name: "invalid-format", fmt: "xml", want: "fer: no such log sink \"xml\""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := getSPSConfig("zeromq")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.ID = "sampler1"
+			cfg.Severity = tc.sev
+			cfg.LogFormat = tc.fmt
+
+			_, err = newDevice(context.Background(), cfg, &hooks{}, nil, ioutil.Discard)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegisterLogSink(t *testing.T) {
+	sink, err := openLogSink("fer-test-sink", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLogger(sink, SeverityInfo, "device", "dev1").Errorf("boom")
+
+	recs := sink.(*recSink).recs
+	if len(recs) != 1 || recs[0].Severity != SeverityError || recs[0].Msg != "boom" {
+		t.Fatalf("invalid records: %+v", recs)
+	}
+	if want := []LogField{{Key: "device", Value: "dev1"}}; !reflect.DeepEqual(recs[0].Fields, want) {
+		t.Fatalf("invalid fields: got=%v, want=%v", recs[0].Fields, want)
+	}
+}
+
+type recSink struct {
+	recs []LogRecord
+}
+
+func (sink *recSink) Write(rec LogRecord) error {
+	sink.recs = append(sink.recs, rec)
+	return nil
+}
+
 func getTCPPort() (string, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
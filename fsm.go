@@ -0,0 +1,222 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// State describes the state of a device's finite state machine.
+//
+// The states and the transitions between them follow FairMQ's semantics:
+//
+//  IDLE          -INIT_DEVICE->  INITIALIZING DEVICE -> DEVICE READY
+//  DEVICE READY  -INIT_TASK->    INITIALIZING TASK   -> READY
+//  READY         -RUN->          RUNNING
+//  RUNNING       -PAUSE->        PAUSED
+//  PAUSED        -RUN->          RUNNING
+//  RUNNING       -STOP->         READY
+//  PAUSED        -STOP->         READY
+//  READY         -RESET_TASK->   RESETTING TASK      -> DEVICE READY
+//  DEVICE READY  -RESET_DEVICE-> RESETTING DEVICE    -> IDLE
+//  IDLE          -END->          EXITING
+//  *             -ERROR_FOUND->  ERROR
+type State int
+
+// List of device states.
+const (
+	StateInvalid State = iota
+	StateIdle
+	StateInitializingDevice
+	StateDeviceReady
+	StateInitializingTask
+	StateReady
+	StateRunning
+	StatePaused
+	StateResettingTask
+	StateResettingDevice
+	StateExiting
+	StateError
+)
+
+func (st State) String() string {
+	switch st {
+	case StateInvalid:
+		return "INVALID"
+	case StateIdle:
+		return "IDLE"
+	case StateInitializingDevice:
+		return "INITIALIZING DEVICE"
+	case StateDeviceReady:
+		return "DEVICE READY"
+	case StateInitializingTask:
+		return "INITIALIZING TASK"
+	case StateReady:
+		return "READY"
+	case StateRunning:
+		return "RUNNING"
+	case StatePaused:
+		return "PAUSED"
+	case StateResettingTask:
+		return "RESETTING TASK"
+	case StateResettingDevice:
+		return "RESETTING DEVICE"
+	case StateExiting:
+		return "EXITING"
+	case StateError:
+		return "ERROR"
+	}
+	panic(xerrors.Errorf("fer: invalid state value (state=%d)", int(st)))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (st State) MarshalText() ([]byte, error) {
+	if st < StateInvalid || st > StateError {
+		return nil, xerrors.Errorf("fer: invalid state value (state=%d)", int(st))
+	}
+	return []byte(st.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// The matching of the state name is case insensitive, and underscores may
+// be used in lieu of spaces.
+func (st *State) UnmarshalText(text []byte) error {
+	name := strings.Replace(string(text), "_", " ", -1)
+	for v := StateInvalid; v <= StateError; v++ {
+		if strings.EqualFold(v.String(), name) {
+			*st = v
+			return nil
+		}
+	}
+	return xerrors.Errorf("fer: invalid state name (value=%q)", text)
+}
+
+// transitions holds the legal transitions of the device state machine,
+// indexed by the state the transition starts from and the triggering command.
+// Intermediate states (INITIALIZING DEVICE, RESETTING TASK, ...) are traversed
+// while the associated user hooks run.
+var transitions = map[State]map[Cmd]State{
+	StateIdle: {
+		CmdInitDevice: StateDeviceReady,
+		CmdEnd:        StateExiting,
+	},
+	StateDeviceReady: {
+		CmdInitTask:    StateReady,
+		CmdResetDevice: StateIdle,
+	},
+	StateReady: {
+		CmdRun:       StateRunning,
+		CmdResetTask: StateDeviceReady,
+	},
+	StateRunning: {
+		CmdPause: StatePaused,
+		CmdStop:  StateReady,
+	},
+	StatePaused: {
+		CmdRun:  StateRunning,
+		CmdStop: StateReady,
+	},
+}
+
+// endSequence returns the list of commands needed to bring a device from
+// the provided state to the EXITING state.
+func endSequence(st State) []Cmd {
+	switch st {
+	case StateRunning, StatePaused:
+		return []Cmd{CmdStop, CmdResetTask, CmdResetDevice, CmdEnd}
+	case StateReady:
+		return []Cmd{CmdResetTask, CmdResetDevice, CmdEnd}
+	case StateDeviceReady:
+		return []Cmd{CmdResetDevice, CmdEnd}
+	case StateIdle:
+		return []Cmd{CmdEnd}
+	}
+	return nil
+}
+
+// StateChange describes a transition of a device's state machine.
+type StateChange struct {
+	Old  State     `json:"old"`  // Old is the state the device was in before the transition.
+	New  State     `json:"new"`  // New is the state the device is in after the transition.
+	Cmd  Cmd       `json:"cmd"`  // Cmd is the command that triggered the transition.
+	Time time.Time `json:"time"` // Time is the time at which the transition happened.
+}
+
+// subscriber forwards state changes to a client, without ever blocking the
+// state machine of the device.
+type subscriber struct {
+	mu     sync.Mutex
+	queue  []StateChange
+	closed bool // closed indicates no more state changes will be queued.
+
+	ready chan struct{}
+	quit  chan struct{}
+	out   chan StateChange
+}
+
+func newSubscriber() *subscriber {
+	sub := &subscriber{
+		ready: make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		out:   make(chan StateChange),
+	}
+	go sub.run()
+	return sub
+}
+
+func (sub *subscriber) notify(ev StateChange) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, ev)
+	sub.mu.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close closes the subscription once all the queued state changes have been
+// forwarded to the client.
+func (sub *subscriber) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *subscriber) run() {
+	defer close(sub.out)
+	for {
+		sub.mu.Lock()
+		queue := sub.queue
+		closed := sub.closed
+		sub.queue = nil
+		sub.mu.Unlock()
+
+		for _, ev := range queue {
+			select {
+			case sub.out <- ev:
+			case <-sub.quit:
+				return
+			}
+		}
+
+		if closed {
+			return
+		}
+
+		select {
+		case <-sub.ready:
+		case <-sub.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Logger gives access to levelled, printf-like logging facilities.
+type Logger interface {
+	// Fatalf logs a message with the ERROR severity and exits the process.
+	Fatalf(format string, v ...interface{})
+	// Printf logs a message with the INFO severity.
+	Printf(format string, v ...interface{})
+
+	Tracef(format string, v ...interface{})
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+
+	// With returns a Logger attaching the provided key-value pairs to
+	// all of its log records.
+	With(kv ...interface{}) Logger
+}
+
+// Severity describes the severity level of a log record.
+type Severity int
+
+// List of severity levels.
+const (
+	SeverityTrace Severity = iota
+	SeverityDebug
+	SeverityInfo
+	SeverityWarn
+	SeverityError
+)
+
+func (sev Severity) String() string {
+	switch sev {
+	case SeverityTrace:
+		return "TRACE"
+	case SeverityDebug:
+		return "DEBUG"
+	case SeverityInfo:
+		return "INFO"
+	case SeverityWarn:
+		return "WARN"
+	case SeverityError:
+		return "ERROR"
+	}
+	panic(xerrors.Errorf("fer: invalid severity value (severity=%d)", int(sev)))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (sev Severity) MarshalText() ([]byte, error) {
+	if sev < SeverityTrace || sev > SeverityError {
+		return nil, xerrors.Errorf("fer: invalid severity value (severity=%d)", int(sev))
+	}
+	return []byte(sev.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// The matching of the severity name is case insensitive.
+func (sev *Severity) UnmarshalText(text []byte) error {
+	name := string(text)
+	if strings.EqualFold(name, "warning") {
+		name = "warn"
+	}
+	for v := SeverityTrace; v <= SeverityError; v++ {
+		if strings.EqualFold(v.String(), name) {
+			*sev = v
+			return nil
+		}
+	}
+	return xerrors.Errorf("fer: invalid severity name (value=%q)", text)
+}
+
+// LogRecord is an entry emitted by a Logger.
+type LogRecord struct {
+	Time     time.Time
+	Severity Severity
+	Msg      string
+	Fields   []LogField // Fields are the key-value pairs attached to the record.
+}
+
+// LogField is a key-value pair attached to a log record.
+// Devices and channels attach their name with the "device" and "channel" keys,
+// and the current state of the device with the "state" key.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// LogSink is the destination of log records.
+type LogSink interface {
+	// Write writes a log record to the sink.
+	// Write may be called concurrently from multiple goroutines.
+	Write(rec LogRecord) error
+}
+
+var logSinks struct {
+	sync.RWMutex
+	db map[string]func(w io.Writer) LogSink
+}
+
+// RegisterLogSink registers a new log sink under the provided format name.
+// The sink is created with the io.Writer devices are running with.
+//
+// The "text" and "json" formats are always available.
+func RegisterLogSink(format string, sink func(w io.Writer) LogSink) {
+	logSinks.Lock()
+	defer logSinks.Unlock()
+	if _, dup := logSinks.db[format]; dup {
+		panic(xerrors.Errorf("fer: log sink with name %q already registered", format))
+	}
+	logSinks.db[format] = sink
+}
+
+func openLogSink(format string, w io.Writer) (LogSink, error) {
+	if format == "" {
+		format = "text"
+	}
+	logSinks.RLock()
+	defer logSinks.RUnlock()
+	sink, ok := logSinks.db[format]
+	if !ok {
+		return nil, xerrors.Errorf("fer: no such log sink %q", format)
+	}
+	return sink(w), nil
+}
+
+// NewTextSink returns a log sink writing human readable records to w, one
+// per line:
+//  [SEVERITY] device.channel: message key=value ...
+// The state of the device is not displayed.
+func NewTextSink(w io.Writer) LogSink {
+	return &textSink{w: w}
+}
+
+type textSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sink *textSink) Write(rec LogRecord) error {
+	var (
+		buf  = new(bytes.Buffer)
+		name string
+		kvs  []LogField
+	)
+	for _, f := range rec.Fields {
+		switch f.Key {
+		case "device":
+			name = fmt.Sprint(f.Value) + name
+		case "channel":
+			name += "." + fmt.Sprint(f.Value)
+		case "state":
+		default:
+			kvs = append(kvs, f)
+		}
+	}
+	fmt.Fprintf(buf, "[%v] ", rec.Severity)
+	if name != "" {
+		fmt.Fprintf(buf, "%s: ", name)
+	}
+	buf.WriteString(rec.Msg)
+	for _, kv := range kvs {
+		fmt.Fprintf(buf, " %s=%v", kv.Key, kv.Value)
+	}
+	buf.WriteString("\n")
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err := sink.w.Write(buf.Bytes())
+	return err
+}
+
+// NewJSONSink returns a log sink writing records to w as JSON values, one per
+// line:
+//  {"time":"...","severity":"INFO","device":"...","state":"...","msg":"..."}
+func NewJSONSink(w io.Writer) LogSink {
+	return &jsonSink{w: w}
+}
+
+type jsonSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sink *jsonSink) Write(rec LogRecord) error {
+	buf := new(bytes.Buffer)
+	field := func(k string, v interface{}) error {
+		key, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(v)
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.WriteString(",")
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(val)
+		return nil
+	}
+
+	buf.WriteString("{")
+	err := field("time", rec.Time)
+	if err != nil {
+		return err
+	}
+	err = field("severity", rec.Severity)
+	if err != nil {
+		return err
+	}
+	for _, f := range rec.Fields {
+		err = field(f.Key, f.Value)
+		if err != nil {
+			return err
+		}
+	}
+	err = field("msg", rec.Msg)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("}\n")
+
+	raw := buf.Bytes()
+	raw = append(raw[:1], raw[2:]...) // remove leading comma.
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err = sink.w.Write(raw)
+	return err
+}
+
+// logger is the Logger of devices and channels.
+type logger struct {
+	sink   LogSink
+	level  Severity
+	fields []LogField
+	state  func() State // state returns the state of the device, if any.
+}
+
+func newLogger(sink LogSink, level Severity, kv ...interface{}) *logger {
+	return (&logger{sink: sink, level: level}).with(kv...)
+}
+
+func (l *logger) with(kv ...interface{}) *logger {
+	o := *l
+	o.fields = append([]LogField(nil), l.fields...)
+	for i := 0; i < len(kv); i += 2 {
+		f := LogField{Key: fmt.Sprint(kv[i])}
+		if i+1 < len(kv) {
+			f.Value = kv[i+1]
+		}
+		o.fields = append(o.fields, f)
+	}
+	return &o
+}
+
+func (l *logger) log(sev Severity, format string, v ...interface{}) {
+	if sev < l.level {
+		return
+	}
+	rec := LogRecord{
+		Time:     time.Now(),
+		Severity: sev,
+		Msg:      strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"),
+		Fields:   l.fields,
+	}
+	if l.state != nil {
+		rec.Fields = append(rec.Fields[:len(rec.Fields):len(rec.Fields)], LogField{Key: "state", Value: l.state()})
+	}
+	_ = l.sink.Write(rec)
+}
+
+func (l *logger) Fatalf(format string, v ...interface{}) {
+	l.log(SeverityError, format, v...)
+	osExit(1)
+}
+
+func (l *logger) Printf(format string, v ...interface{}) { l.log(SeverityInfo, format, v...) }
+func (l *logger) Tracef(format string, v ...interface{}) { l.log(SeverityTrace, format, v...) }
+func (l *logger) Debugf(format string, v ...interface{}) { l.log(SeverityDebug, format, v...) }
+func (l *logger) Infof(format string, v ...interface{})  { l.log(SeverityInfo, format, v...) }
+func (l *logger) Warnf(format string, v ...interface{})  { l.log(SeverityWarn, format, v...) }
+func (l *logger) Errorf(format string, v ...interface{}) { l.log(SeverityError, format, v...) }
+
+func (l *logger) With(kv ...interface{}) Logger {
+	return l.with(kv...)
+}
+
+func init() {
+	logSinks.Lock()
+	logSinks.db = map[string]func(w io.Writer) LogSink{
+		"text": NewTextSink,
+		"json": NewJSONSink,
+	}
+	logSinks.Unlock()
+}
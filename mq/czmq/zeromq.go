@@ -15,6 +15,7 @@ package czmq // import "github.com/alice-go/fer/mq/czmq"
 import "C"
 
 import (
+	"time"
 	"unsafe"
 
 	"github.com/alice-go/fer/mq"
@@ -69,6 +70,56 @@ func (s *socket) Recv() ([]byte, error) {
 	return data, err
 }
 
+func (s *socket) SendMulti(parts [][]byte) error {
+	for i, part := range parts {
+		var (
+			cbuf unsafe.Pointer
+			clen = C.size_t(len(part))
+			flag C.int
+		)
+		if len(part) > 0 {
+			cbuf = unsafe.Pointer(&part[0])
+		}
+		if i < len(parts)-1 {
+			flag = C.ZMQ_SNDMORE
+		}
+		o := C.zmq_send(s.c, cbuf, clen, flag)
+		if o < 0 {
+			return getError(o)
+		}
+	}
+	return nil
+}
+
+func (s *socket) RecvMulti() ([][]byte, error) {
+	var parts [][]byte
+	for {
+		var msg C.zmq_msg_t
+		if i := C.zmq_msg_init(&msg); i != 0 {
+			return nil, getError(i)
+		}
+
+		size := C.zmq_msg_recv(&msg, s.c, 0)
+		if size < 0 {
+			C.zmq_msg_close(&msg)
+			return nil, getError(size)
+		}
+		data := make([]byte, int(size))
+		if size > 0 {
+			C.memcpy(unsafe.Pointer(&data[0]), C.zmq_msg_data(&msg), C.size_t(size))
+		}
+		parts = append(parts, data)
+		more := C.zmq_msg_more(&msg)
+		err := getError(C.zmq_msg_close(&msg))
+		if err != nil {
+			return nil, err
+		}
+		if more == 0 {
+			return parts, nil
+		}
+	}
+}
+
 func (s *socket) Listen(addr string) error {
 	caddr := C.CString(addr)
 	v := C.zmq_bind(s.c, caddr)
@@ -87,6 +138,77 @@ func (s *socket) Type() mq.SocketType {
 	return s.typ
 }
 
+func (s *socket) GetOption(name string) (interface{}, error) {
+	opt, ok := options[name]
+	if !ok || name == mq.OptionSubscribe || name == mq.OptionUnsubscribe {
+		return nil, &mq.UnsupportedOptionError{Driver: "czmq", Option: name}
+	}
+	var (
+		v    C.int
+		size = C.size_t(unsafe.Sizeof(v))
+	)
+	err := getError(C.zmq_getsockopt(s.c, opt, unsafe.Pointer(&v), &size))
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case mq.OptionLinger, mq.OptionSendTimeout, mq.OptionRecvTimeout, mq.OptionReconnectInterval:
+		return time.Duration(v) * time.Millisecond, nil
+	case mq.OptionTCPKeepAlive:
+		return v == 1, nil
+	}
+	return int(v), nil
+}
+
+func (s *socket) SetOption(name string, value interface{}) error {
+	opt, ok := options[name]
+	if !ok {
+		return &mq.UnsupportedOptionError{Driver: "czmq", Option: name}
+	}
+	value, err := mq.OptionValue(name, value)
+	if err != nil {
+		return err
+	}
+
+	var v C.int
+	switch value := value.(type) {
+	case string:
+		// subscribe, unsubscribe.
+		var cbuf unsafe.Pointer
+		if len(value) > 0 {
+			cstr := C.CString(value)
+			defer C.free(unsafe.Pointer(cstr))
+			cbuf = unsafe.Pointer(cstr)
+		}
+		return getError(C.zmq_setsockopt(s.c, opt, cbuf, C.size_t(len(value))))
+	case time.Duration:
+		v = C.int(value / time.Millisecond)
+		if value < 0 {
+			v = -1
+		}
+	case bool:
+		if value {
+			v = 1
+		}
+	case int:
+		v = C.int(value)
+	}
+	return getError(C.zmq_setsockopt(s.c, opt, unsafe.Pointer(&v), C.size_t(unsafe.Sizeof(v))))
+}
+
+// options maps the common socket options to their ZeroMQ counterparts.
+var options = map[string]C.int{
+	mq.OptionSendHWM:           C.ZMQ_SNDHWM,
+	mq.OptionRecvHWM:           C.ZMQ_RCVHWM,
+	mq.OptionLinger:            C.ZMQ_LINGER,
+	mq.OptionSendTimeout:       C.ZMQ_SNDTIMEO,
+	mq.OptionRecvTimeout:       C.ZMQ_RCVTIMEO,
+	mq.OptionReconnectInterval: C.ZMQ_RECONNECT_IVL,
+	mq.OptionSubscribe:         C.ZMQ_SUBSCRIBE,
+	mq.OptionUnsubscribe:       C.ZMQ_UNSUBSCRIBE,
+	mq.OptionTCPKeepAlive:      C.ZMQ_TCP_KEEPALIVE,
+}
+
 type driver struct {
 	ctx unsafe.Pointer
 }
@@ -0,0 +1,599 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gochan implements the mq.Driver interface and allows
+// to use mq.Sockets via Go channels, within a single process.
+//
+// Sockets are connected through a process-wide registry of addresses.
+// A bind address and its matching connect address (e.g. "tcp://*:5555" and
+// "tcp://localhost:5555") designate the same endpoint, so configurations
+// written for a network transport can be used unchanged.
+// Sockets may connect to an endpoint before it is bound.
+//
+// XPub sockets receive the subscriptions of their sub and xsub peers, as
+// messages made of a 1 (subscribe) or 0 (unsubscribe) byte followed by the
+// topic. XSub sockets subscribe to topics by sending such messages.
+//
+// The driver is registered under the "go-chan" and "chan" names.
+package gochan // import "github.com/alice-go/fer/mq/gochan"
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	"golang.org/x/xerrors"
+)
+
+// defaultHWM is the default capacity of the inbound queue of sockets.
+const defaultHWM = 1000
+
+var (
+	errClosed  = xerrors.New("mq/gochan: socket closed")
+	errTimeout = xerrors.New("mq/gochan: timeout")
+)
+
+// registry holds the endpoints of the process, by address.
+var registry = struct {
+	sync.Mutex
+	eps map[string]*endpoint
+}{eps: make(map[string]*endpoint)}
+
+// endpoint is an address sockets bind or connect to.
+type endpoint struct {
+	listener *socket
+	dialers  []*socket
+}
+
+// Endpoint returns the endpoint designated by an address, and the host part
+// of tcp addresses.
+// The host part of tcp addresses is ignored by the endpoint, so bind and
+// connect addresses of a given port (e.g. "tcp://*:5555" and
+// "tcp://localhost:5555") designate the same endpoint.
+// Wildcard and loopback hosts are reported as an empty host.
+func Endpoint(addr string) (ep, host string) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return addr, ""
+	}
+	scheme, rest := addr[:i], addr[i+len("://"):]
+	if scheme == "tcp" {
+		if j := strings.LastIndex(rest, ":"); j >= 0 {
+			host, rest = strings.Trim(rest[:j], "[]"), rest[j+1:]
+		}
+		switch host {
+		case "*", "0.0.0.0", "::", "localhost", "127.0.0.1", "::1":
+			host = ""
+		}
+	}
+	return scheme + "://" + rest, host
+}
+
+// delivery is a message delivered to the inbound queue of a socket.
+type delivery struct {
+	from  *socket
+	parts [][]byte
+}
+
+var ids uint64
+
+type socket struct {
+	typ    mq.SocketType
+	id     []byte // id is the identity of the socket, as seen by router peers.
+	closed chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	inbox   chan delivery
+	peers   []*socket
+	changed chan struct{} // changed is closed when the list of peers changes.
+	next    int           // next is the index of the next peer for round-robin sends.
+	keys    []string      // keys are the registry keys the socket is bound or connected to.
+	opts    map[string]interface{}
+	topics  map[string]struct{} // topics holds the subscriptions of sub sockets.
+
+	// from and env are the peer and envelope of the last request received
+	// by a rep socket.
+	from *socket
+	env  [][]byte
+}
+
+func newSocket(typ mq.SocketType) *socket {
+	s := &socket{
+		typ:     typ,
+		id:      []byte("gochan-" + strconv.FormatUint(atomic.AddUint64(&ids, 1), 10)),
+		closed:  make(chan struct{}),
+		inbox:   make(chan delivery, defaultHWM),
+		changed: make(chan struct{}),
+		opts: map[string]interface{}{
+			mq.OptionSendHWM:     defaultHWM,
+			mq.OptionRecvHWM:     defaultHWM,
+			mq.OptionLinger:      time.Duration(0),
+			mq.OptionSendTimeout: time.Duration(0),
+			mq.OptionRecvTimeout: time.Duration(0),
+		},
+	}
+	switch typ {
+	case mq.Sub, mq.XSub:
+		s.topics = map[string]struct{}{"": {}}
+	}
+	return s
+}
+
+// Close closes the socket and disconnects it from its peers.
+func (s *socket) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+
+		registry.Lock()
+		s.mu.Lock()
+		keys := s.keys
+		s.keys = nil
+		s.mu.Unlock()
+		for _, k := range keys {
+			ep := registry.eps[k]
+			if ep == nil {
+				continue
+			}
+			if ep.listener == s {
+				ep.listener = nil
+				for _, d := range ep.dialers {
+					disconnect(s, d)
+				}
+			}
+			for i := 0; i < len(ep.dialers); i++ {
+				if ep.dialers[i] != s {
+					continue
+				}
+				ep.dialers = append(ep.dialers[:i], ep.dialers[i+1:]...)
+				i--
+				if ep.listener != nil {
+					disconnect(ep.listener, s)
+				}
+			}
+			if ep.listener == nil && len(ep.dialers) == 0 {
+				delete(registry.eps, k)
+			}
+		}
+		registry.Unlock()
+	})
+	return nil
+}
+
+func (s *socket) Send(data []byte) error {
+	return s.SendMulti([][]byte{data})
+}
+
+// Recv receives a message.
+// Multipart messages are received framed with mq.FrameParts.
+func (s *socket) Recv() ([]byte, error) {
+	parts, err := s.RecvMulti()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return mq.FrameParts(parts), nil
+}
+
+func (s *socket) SendMulti(parts [][]byte) error {
+	select {
+	case <-s.closed:
+		return errClosed
+	default:
+	}
+
+	switch s.typ {
+	case mq.Pub, mq.XPub, mq.Bus:
+		s.broadcast(parts)
+		return nil
+	case mq.Router:
+		return s.route(parts)
+	case mq.Rep:
+		s.mu.Lock()
+		from, env := s.from, s.env
+		s.from, s.env = nil, nil
+		s.mu.Unlock()
+		if from == nil {
+			return xerrors.Errorf("mq/gochan: no request to reply to")
+		}
+		return s.put(from, append(env, parts...))
+	case mq.Req:
+		parts = append([][]byte{{}}, parts...)
+	case mq.XSub:
+		s.upstream(parts)
+		return nil
+	case mq.Sub, mq.Pull:
+		return xerrors.Errorf("mq/gochan: cannot send on a %v socket", s.typ)
+	}
+	return s.roundRobin(parts)
+}
+
+func (s *socket) RecvMulti() ([][]byte, error) {
+	switch s.typ {
+	case mq.Pub, mq.Push:
+		return nil, xerrors.Errorf("mq/gochan: cannot receive on a %v socket", s.typ)
+	}
+
+	tmo, stop := s.timeout(mq.OptionRecvTimeout)
+	defer stop()
+
+	var d delivery
+	select {
+	case d = <-s.inbox:
+	case <-s.closed:
+		return nil, errClosed
+	case <-tmo:
+		return nil, errTimeout
+	}
+
+	parts := d.parts
+	switch s.typ {
+	case mq.Router:
+		parts = append([][]byte{d.from.id}, parts...)
+	case mq.Rep:
+		n := 0
+		for n < len(parts) && len(parts[n]) > 0 {
+			n++
+		}
+		if n == len(parts) {
+			n = -1 // no envelope.
+		}
+		s.mu.Lock()
+		s.from, s.env = d.from, parts[:n+1:n+1]
+		s.mu.Unlock()
+		parts = parts[n+1:]
+	case mq.Req:
+		if len(parts) > 1 && len(parts[0]) == 0 {
+			parts = parts[1:]
+		}
+	}
+	return parts, nil
+}
+
+func (s *socket) Listen(addr string) error {
+	k, _ := Endpoint(addr)
+	registry.Lock()
+	defer registry.Unlock()
+
+	ep := registry.eps[k]
+	if ep == nil {
+		ep = &endpoint{}
+		registry.eps[k] = ep
+	}
+	if ep.listener != nil {
+		return xerrors.Errorf("mq/gochan: address %q already in use", addr)
+	}
+	ep.listener = s
+	s.mu.Lock()
+	s.keys = append(s.keys, k)
+	s.mu.Unlock()
+	for _, d := range ep.dialers {
+		connect(s, d)
+	}
+	return nil
+}
+
+func (s *socket) Dial(addr string) error {
+	k, _ := Endpoint(addr)
+	registry.Lock()
+	defer registry.Unlock()
+
+	ep := registry.eps[k]
+	if ep == nil {
+		ep = &endpoint{}
+		registry.eps[k] = ep
+	}
+	ep.dialers = append(ep.dialers, s)
+	s.mu.Lock()
+	s.keys = append(s.keys, k)
+	s.mu.Unlock()
+	if ep.listener != nil {
+		connect(ep.listener, s)
+	}
+	return nil
+}
+
+func (s *socket) Type() mq.SocketType {
+	return s.typ
+}
+
+// GetOption retrieves an option of the socket.
+func (s *socket) GetOption(name string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.opts[name]
+	if !ok {
+		return nil, &mq.UnsupportedOptionError{Driver: "go-chan", Option: name}
+	}
+	return v, nil
+}
+
+// SetOption sets an option of the socket.
+// The send HWM and linger options are accepted but have no effect: messages
+// are directly queued to the peers of the socket and sockets do not hold
+// pending messages.
+func (s *socket) SetOption(name string, value interface{}) error {
+	switch name {
+	case mq.OptionSendHWM, mq.OptionRecvHWM,
+		mq.OptionLinger, mq.OptionSendTimeout, mq.OptionRecvTimeout:
+	case mq.OptionSubscribe, mq.OptionUnsubscribe:
+		if s.topics == nil {
+			return &mq.UnsupportedOptionError{Driver: "go-chan", Option: name}
+		}
+	default:
+		return &mq.UnsupportedOptionError{Driver: "go-chan", Option: name}
+	}
+
+	v, err := mq.OptionValue(name, value)
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case mq.OptionSubscribe:
+		s.upstream([][]byte{append([]byte{1}, v.(string)...)})
+		return nil
+	case mq.OptionUnsubscribe:
+		s.upstream([][]byte{append([]byte{0}, v.(string)...)})
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case mq.OptionRecvHWM:
+		if len(s.keys) > 0 {
+			return xerrors.Errorf("mq/gochan: option %q must be set before connecting", name)
+		}
+		s.inbox = make(chan delivery, v.(int))
+	}
+	s.opts[name] = v
+	return nil
+}
+
+// connect connects the provided sockets together.
+// XPub sockets receive the subscriptions of their new peer.
+func connect(a, b *socket) {
+	a.addPeer(b)
+	b.addPeer(a)
+	for _, p := range [][2]*socket{{a, b}, {b, a}} {
+		if p[0].typ != mq.XPub || p[1].topics == nil {
+			continue
+		}
+		p[1].mu.Lock()
+		topics := make([]string, 0, len(p[1].topics))
+		for k := range p[1].topics {
+			topics = append(topics, k)
+		}
+		p[1].mu.Unlock()
+		for _, topic := range topics {
+			p[1].deliver(p[0], [][]byte{append([]byte{1}, topic...)})
+		}
+	}
+}
+
+// disconnect disconnects the provided sockets.
+func disconnect(a, b *socket) {
+	a.removePeer(b)
+	b.removePeer(a)
+}
+
+func (s *socket) addPeer(p *socket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = append(s.peers, p)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *socket) removePeer(p *socket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.peers {
+		if s.peers[i] == p {
+			s.peers = append(s.peers[:i:i], s.peers[i+1:]...)
+			break
+		}
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// timeout returns a channel notified when the named timeout option of the
+// socket expires, if any, and a function to release the associated timer.
+func (s *socket) timeout(name string) (<-chan time.Time, func()) {
+	s.mu.Lock()
+	d := s.opts[name].(time.Duration)
+	s.mu.Unlock()
+	if d <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+// roundRobin sends a message to the next peer of the socket able to accept
+// it, waiting for a peer if none is connected.
+func (s *socket) roundRobin(parts [][]byte) error {
+	tmo, stop := s.timeout(mq.OptionSendTimeout)
+	defer stop()
+
+	d := delivery{from: s, parts: clone(parts)}
+	for {
+		s.mu.Lock()
+		peers, changed, next := s.peers, s.changed, s.next
+		s.mu.Unlock()
+
+		for i := range peers {
+			select {
+			case peers[(next+i)%len(peers)].inbox <- d:
+				s.mu.Lock()
+				s.next = next + i + 1
+				s.mu.Unlock()
+				return nil
+			default:
+			}
+		}
+
+		// all peers are busy (or there is no peer): wait for the next one.
+		var inbox chan delivery
+		if len(peers) > 0 {
+			inbox = peers[next%len(peers)].inbox
+		}
+		select {
+		case inbox <- d:
+			s.mu.Lock()
+			s.next = next + 1
+			s.mu.Unlock()
+			return nil
+		case <-changed:
+		case <-s.closed:
+			return errClosed
+		case <-tmo:
+			return errTimeout
+		}
+	}
+}
+
+// broadcast sends a message to all the (subscribed) peers of the socket.
+// Peers that can not accept the message drop it.
+func (s *socket) broadcast(parts [][]byte) {
+	s.mu.Lock()
+	peers := s.peers
+	s.mu.Unlock()
+
+	var topic []byte
+	if len(parts) > 0 {
+		topic = parts[0]
+	}
+	for _, p := range peers {
+		if s.typ != mq.Bus && !p.subscribed(topic) {
+			continue
+		}
+		s.deliver(p, parts)
+	}
+}
+
+// upstream sends a message of a sub or xsub socket to its xpub peers.
+// Subscription messages, made of a 1 (subscribe) or 0 (unsubscribe) byte
+// followed by the topic, first update the subscriptions of the socket.
+func (s *socket) upstream(parts [][]byte) {
+	if len(parts) == 1 && len(parts[0]) > 0 {
+		topic := string(parts[0][1:])
+		s.mu.Lock()
+		switch parts[0][0] {
+		case 1:
+			s.topics[topic] = struct{}{}
+		case 0:
+			delete(s.topics, topic)
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	peers := s.peers
+	s.mu.Unlock()
+	for _, p := range peers {
+		if p.typ == mq.XPub {
+			s.deliver(p, parts)
+		}
+	}
+}
+
+// deliver queues a message to the provided peer, without blocking.
+// Peers that can not accept the message drop it.
+func (s *socket) deliver(p *socket, parts [][]byte) {
+	select {
+	case p.inbox <- delivery{from: s, parts: clone(parts)}:
+	default:
+	}
+}
+
+// route sends a message to the peer whose identity is the first part of the
+// message.
+// Messages for unknown peers are dropped.
+func (s *socket) route(parts [][]byte) error {
+	if len(parts) == 0 {
+		return xerrors.Errorf("mq/gochan: no peer identity in message")
+	}
+	s.mu.Lock()
+	peers := s.peers
+	s.mu.Unlock()
+	for _, p := range peers {
+		if bytes.Equal(p.id, parts[0]) {
+			return s.put(p, parts[1:])
+		}
+	}
+	return nil
+}
+
+// put sends a message to the provided peer.
+func (s *socket) put(p *socket, parts [][]byte) error {
+	tmo, stop := s.timeout(mq.OptionSendTimeout)
+	defer stop()
+
+	select {
+	case p.inbox <- delivery{from: s, parts: clone(parts)}:
+		return nil
+	case <-p.closed:
+		return nil // the peer is gone: drop the message.
+	case <-s.closed:
+		return errClosed
+	case <-tmo:
+		return errTimeout
+	}
+}
+
+// subscribed returns whether a message with the provided topic matches the
+// subscriptions of the socket.
+func (s *socket) subscribed(topic []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.topics {
+		if bytes.HasPrefix(topic, []byte(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the parts of a message, so the sender may reuse
+// its buffers.
+func clone(parts [][]byte) [][]byte {
+	o := make([][]byte, len(parts))
+	for i, p := range parts {
+		o[i] = append([]byte{}, p...)
+	}
+	return o
+}
+
+type driver struct {
+	name string
+}
+
+func (drv driver) Name() string {
+	return drv.name
+}
+
+func (driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	switch typ {
+	case mq.Sub, mq.XSub, mq.Pub, mq.XPub,
+		mq.Push, mq.Pull,
+		mq.Req, mq.Rep, mq.Dealer, mq.Router,
+		mq.Pair, mq.Bus:
+		return newSocket(typ), nil
+	}
+	return nil, xerrors.Errorf("mq/gochan: invalid socket type %v (%d)", typ, int(typ))
+}
+
+func init() {
+	mq.Register("go-chan", driver{name: "go-chan"})
+	mq.Register("chan", driver{name: "chan"})
+}
@@ -0,0 +1,578 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package queue implements the message queues, subscriptions and options
+// shared by the sockets of the drivers exchanging messages over connections
+// of their own (e.g. "stream" and "ws").
+// Drivers only implement the transport of messages over these connections.
+//
+// Push, pull, pub, sub and pair sockets are supported:
+//  - push sockets load-balance messages over their connected peers,
+//  - pub sockets send messages to all their peers, dropping the messages of
+//    the peers whose queue is full,
+//  - sub sockets filter the messages they receive with their subscriptions,
+//  - pair sockets accept a single peer at a time.
+//
+// The outbound and inbound queues of sockets hold at most OptionSendHWM and
+// OptionRecvHWM messages.
+package queue // import "github.com/alice-go/fer/mq/internal/queue"
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	"golang.org/x/xerrors"
+)
+
+// Defaults of the socket options.
+const (
+	defaultHWM       = 1000
+	defaultLinger    = time.Second
+	defaultReconnect = 100 * time.Millisecond
+)
+
+// MaxMsgSize is the maximum size of a message, in bytes.
+const MaxMsgSize = 1 << 30
+
+// Transport is a connection of a socket to one of its peers, implemented by
+// a driver.
+type Transport interface {
+	// ReadMsg reads the next message sent by the peer.
+	ReadMsg() ([][]byte, error)
+
+	// WriteMsg writes a message to the peer.
+	// flush reports whether the outbound queue of the connection is empty,
+	// so buffered transports may flush their output.
+	WriteMsg(parts [][]byte, flush bool) error
+
+	// Close closes the connection.
+	// Close may be called multiple times.
+	Close() error
+}
+
+// Socket implements the queues, subscriptions and options of an mq.Socket.
+// Drivers provide the Listen and Dial methods, and hand the connections of
+// the socket to its Serve method.
+type Socket struct {
+	driver string
+	typ    mq.SocketType
+	ctx    context.Context // ctx is cancelled when the socket is closed.
+	cancel context.CancelFunc
+	once   sync.Once
+	wg     sync.WaitGroup // wg tracks the goroutines of the socket.
+
+	errClosed  error
+	errTimeout error
+
+	// pending is the number of messages queued for, or being written to,
+	// the connections of the socket.
+	pending int64
+
+	mu      sync.Mutex
+	opts    map[string]interface{}
+	extra   map[string]bool // extra are the options of the driver.
+	out     chan [][]byte   // out is the outbound queue of push and pair sockets.
+	in      chan [][]byte   // in is the inbound queue of pull, sub and pair sockets.
+	closers []io.Closer     // closers are the listeners of the socket.
+	conns   map[*conn]struct{}
+	started bool                // started reports whether the socket was bound or connected.
+	topics  map[string]struct{} // topics holds the subscriptions of sub sockets.
+}
+
+// conn is a connection of a socket to one of its peers.
+type conn struct {
+	t    Transport
+	out  chan [][]byte // out is the outbound queue of the connection.
+	done chan struct{} // done is closed when the connection is closed.
+	once sync.Once
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.t.Close()
+	})
+}
+
+// New returns a new socket of the named driver.
+// opts holds the default values of the options of the driver, in addition
+// to the common options. These options must be set before the socket is
+// bound or connected.
+func New(driver string, typ mq.SocketType, opts map[string]interface{}) *Socket {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Socket{
+		driver:     driver,
+		typ:        typ,
+		ctx:        ctx,
+		cancel:     cancel,
+		errClosed:  xerrors.Errorf("mq/%s: socket closed", driver),
+		errTimeout: xerrors.Errorf("mq/%s: timeout", driver),
+		opts: map[string]interface{}{
+			mq.OptionSendHWM:           defaultHWM,
+			mq.OptionRecvHWM:           defaultHWM,
+			mq.OptionLinger:            defaultLinger,
+			mq.OptionSendTimeout:       time.Duration(0),
+			mq.OptionRecvTimeout:       time.Duration(0),
+			mq.OptionReconnectInterval: defaultReconnect,
+		},
+		extra: make(map[string]bool, len(opts)),
+		out:   make(chan [][]byte, defaultHWM),
+		in:    make(chan [][]byte, defaultHWM),
+		conns: make(map[*conn]struct{}),
+	}
+	for name, v := range opts {
+		s.opts[name] = v
+		s.extra[name] = true
+	}
+	if typ == mq.Sub {
+		s.topics = map[string]struct{}{"": {}}
+	}
+	return s
+}
+
+// Context returns a context that is cancelled when the socket is closed.
+func (s *Socket) Context() context.Context {
+	return s.ctx
+}
+
+// Close closes the socket, its listeners and its connections.
+// Close waits for the queued messages to be sent to the connected peers, for
+// at most the linger duration of the socket.
+func (s *Socket) Close() error {
+	s.once.Do(func() {
+		s.linger()
+
+		s.mu.Lock()
+		s.cancel()
+		closers, conns := s.closers, s.conns
+		s.closers, s.conns = nil, nil
+		s.mu.Unlock()
+
+		for _, c := range closers {
+			c.Close()
+		}
+		for c := range conns {
+			c.close()
+		}
+		s.wg.Wait()
+	})
+	return nil
+}
+
+// linger waits for the pending messages of the socket to be sent, while it
+// has connected peers.
+func (s *Socket) linger() {
+	deadline := time.Now().Add(s.Opt(mq.OptionLinger).(time.Duration))
+	for atomic.LoadInt64(&s.pending) > 0 && time.Now().Before(deadline) {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *Socket) Send(data []byte) error {
+	return s.SendMulti([][]byte{data})
+}
+
+func (s *Socket) SendMulti(parts [][]byte) error {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	if n > MaxMsgSize {
+		return xerrors.Errorf("mq/%s: message size %d exceeds maximum size %d", s.driver, n, MaxMsgSize)
+	}
+	select {
+	case <-s.ctx.Done():
+		return s.errClosed
+	default:
+	}
+
+	msg := make([][]byte, len(parts))
+	for i, part := range parts {
+		msg[i] = append([]byte(nil), part...)
+	}
+	switch s.typ {
+	case mq.Push, mq.Pair:
+		return s.enqueue(msg)
+	case mq.Pub:
+		s.broadcast(msg)
+		return nil
+	}
+	return xerrors.Errorf("mq/%s: cannot send on a %v socket", s.driver, s.typ)
+}
+
+// enqueue puts a message on the outbound queue of the socket, waiting for
+// room in the queue.
+func (s *Socket) enqueue(msg [][]byte) error {
+	tmo, stop := s.timeout(mq.OptionSendTimeout)
+	defer stop()
+
+	s.mu.Lock()
+	out := s.out
+	s.mu.Unlock()
+
+	atomic.AddInt64(&s.pending, 1)
+	select {
+	case out <- msg:
+		return nil
+	case <-tmo:
+		atomic.AddInt64(&s.pending, -1)
+		return s.errTimeout
+	case <-s.ctx.Done():
+		atomic.AddInt64(&s.pending, -1)
+		return s.errClosed
+	}
+}
+
+// broadcast puts a message on the outbound queue of each connection of the
+// socket, dropping it for the connections whose queue is full.
+func (s *Socket) broadcast(msg [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		select {
+		case c.out <- msg:
+			atomic.AddInt64(&s.pending, 1)
+		default:
+		}
+	}
+}
+
+// Recv receives a message.
+// Multipart messages are received framed with mq.FrameParts.
+func (s *Socket) Recv() ([]byte, error) {
+	parts, err := s.RecvMulti()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return mq.FrameParts(parts), nil
+}
+
+func (s *Socket) RecvMulti() ([][]byte, error) {
+	switch s.typ {
+	case mq.Pull, mq.Sub, mq.Pair:
+	default:
+		return nil, xerrors.Errorf("mq/%s: cannot receive on a %v socket", s.driver, s.typ)
+	}
+
+	tmo, stop := s.timeout(mq.OptionRecvTimeout)
+	defer stop()
+
+	s.mu.Lock()
+	in := s.in
+	s.mu.Unlock()
+
+	for {
+		select {
+		case msg := <-in:
+			if s.subscribed(msg) {
+				return msg, nil
+			}
+		case <-tmo:
+			return nil, s.errTimeout
+		case <-s.ctx.Done():
+			return nil, s.errClosed
+		}
+	}
+}
+
+// subscribed returns whether the first part of msg matches the subscriptions
+// of the socket.
+func (s *Socket) subscribed(msg [][]byte) bool {
+	if s.topics == nil {
+		return true
+	}
+	var first []byte
+	if len(msg) > 0 {
+		first = msg[0]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic := range s.topics {
+		if bytes.HasPrefix(first, []byte(topic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start marks the socket as bound or connected, and runs f in a goroutine of
+// the socket.
+// ln, if not nil, is closed when the socket is closed.
+// Start closes ln and returns an error if the socket is already closed.
+func (s *Socket) Start(ln io.Closer, f func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ctx.Done():
+		if ln != nil {
+			ln.Close()
+		}
+		return s.errClosed
+	default:
+	}
+	s.started = true
+	if ln != nil {
+		s.closers = append(s.closers, ln)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+	return nil
+}
+
+// Go runs f in a goroutine of the socket, and reports whether the socket
+// was still open.
+func (s *Socket) Go(f func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ctx.Done():
+		return false
+	default:
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Redial connects the socket with dial, and reconnects it whenever the
+// connection is lost, every OptionReconnectInterval, until the socket is
+// closed.
+func (s *Socket) Redial(dial func(ctx context.Context) (Transport, error)) {
+	for {
+		t, err := dial(s.ctx)
+		if err == nil {
+			s.Serve(t)
+		}
+
+		retry := time.NewTimer(s.Opt(mq.OptionReconnectInterval).(time.Duration))
+		select {
+		case <-s.ctx.Done():
+			retry.Stop()
+			return
+		case <-retry.C:
+		}
+	}
+}
+
+// Serve runs a connection of the socket to one of its peers, until either
+// the connection or the socket is closed.
+// The connection is closed when Serve returns.
+func (s *Socket) Serve(t Transport) {
+	c, err := s.open(t)
+	if err != nil {
+		t.Close()
+		return
+	}
+
+	done := make(chan struct{})
+	switch s.typ {
+	case mq.Push, mq.Pub, mq.Pair:
+		go func() {
+			defer close(done)
+			s.write(c)
+		}()
+	default:
+		close(done)
+	}
+	s.read(c)
+
+	c.close()
+	s.removeConn(c)
+	<-done
+
+	if s.typ == mq.Pub {
+		// the queue of the connection can not be written to anymore.
+		for {
+			select {
+			case <-c.out:
+				atomic.AddInt64(&s.pending, -1)
+			default:
+				return
+			}
+		}
+	}
+}
+
+// open adds a new connection to the connections of the socket.
+func (s *Socket) open(t Transport) (*conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ctx.Done():
+		return nil, s.errClosed
+	default:
+	}
+	if s.typ == mq.Pair && len(s.conns) > 0 {
+		return nil, xerrors.Errorf("mq/%s: pair socket already connected", s.driver)
+	}
+
+	c := &conn{
+		t:    t,
+		out:  s.out,
+		done: make(chan struct{}),
+	}
+	if s.typ == mq.Pub {
+		c.out = make(chan [][]byte, s.opts[mq.OptionSendHWM].(int))
+	}
+	s.conns[c] = struct{}{}
+	return c, nil
+}
+
+func (s *Socket) removeConn(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// read reads the messages sent by the peer of a connection and puts them on
+// the inbound queue of the socket.
+// Messages sent to push and pub sockets are discarded.
+func (s *Socket) read(c *conn) {
+	s.mu.Lock()
+	in := s.in
+	s.mu.Unlock()
+
+	for {
+		msg, err := c.t.ReadMsg()
+		if err != nil {
+			return
+		}
+		switch s.typ {
+		case mq.Pull, mq.Sub, mq.Pair:
+		default:
+			continue
+		}
+		select {
+		case in <- msg:
+		case <-c.done:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// write writes the messages of the outbound queue of a connection to its
+// peer.
+func (s *Socket) write(c *conn) {
+	defer c.close()
+	for {
+		var msg [][]byte
+		select {
+		case msg = <-c.out:
+		case <-c.done:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+
+		err := c.t.WriteMsg(msg, len(c.out) == 0)
+		atomic.AddInt64(&s.pending, -1)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Socket) Type() mq.SocketType {
+	return s.typ
+}
+
+// GetOption retrieves an option of the socket.
+func (s *Socket) GetOption(name string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.opts[name]
+	if !ok {
+		return nil, &mq.UnsupportedOptionError{Driver: s.driver, Option: name}
+	}
+	return v, nil
+}
+
+// SetOption sets an option of the socket.
+// The HWM options and the options of the driver must be set before the
+// socket is bound or connected.
+func (s *Socket) SetOption(name string, value interface{}) error {
+	s.mu.Lock()
+	_, ok := s.opts[name]
+	s.mu.Unlock()
+	switch name {
+	case mq.OptionSubscribe, mq.OptionUnsubscribe:
+		ok = s.topics != nil
+	}
+	if !ok {
+		return &mq.UnsupportedOptionError{Driver: s.driver, Option: name}
+	}
+
+	v, err := mq.OptionValue(name, value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case mq.OptionSubscribe:
+		s.topics[v.(string)] = struct{}{}
+		return nil
+	case mq.OptionUnsubscribe:
+		delete(s.topics, v.(string))
+		return nil
+	case mq.OptionSendHWM, mq.OptionRecvHWM:
+		if s.started {
+			return xerrors.Errorf("mq/%s: option %q must be set before connecting", s.driver, name)
+		}
+		q := make(chan [][]byte, v.(int))
+		if name == mq.OptionSendHWM {
+			s.out = q
+		} else {
+			s.in = q
+		}
+	default:
+		if s.extra[name] && s.started {
+			return xerrors.Errorf("mq/%s: option %q must be set before connecting", s.driver, name)
+		}
+	}
+	s.opts[name] = v
+	return nil
+}
+
+// Opt returns the value of the named option of the socket.
+func (s *Socket) Opt(name string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opts[name]
+}
+
+// timeout returns a channel notified when the named timeout option of the
+// socket expires, if any, and a function to release the associated timer.
+func (s *Socket) timeout(name string) (<-chan time.Time, func()) {
+	d := s.Opt(name).(time.Duration)
+	if d <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
@@ -24,6 +24,14 @@ type Socket interface {
 	// Recv receives a complete message.
 	Recv() ([]byte, error)
 
+	// SendMulti puts a multipart message on the outbound send queue.
+	// SendMulti blocks until the message can be queued or the send deadline expires.
+	SendMulti(parts [][]byte) error
+
+	// RecvMulti receives a complete multipart message.
+	// Messages sent with Send are received as a single part.
+	RecvMulti() ([][]byte, error)
+
 	// Listen connects a local endpoint to the Socket.
 	Listen(addr string) error
 
@@ -34,10 +42,15 @@ type Socket interface {
 	Type() SocketType
 
 	// GetOption is used to retrieve an option for a socket.
-	//GetOption(name string) (interface{}, error)
+	// GetOption returns an *UnsupportedOptionError if the option is not
+	// supported by the driver.
+	GetOption(name string) (interface{}, error)
 
 	// SetOption is used to set an option for a socket.
-	//SetOption(name string, value interface{}) error
+	// Options should be set before the socket is connected.
+	// SetOption returns an *UnsupportedOptionError if the option is not
+	// supported by the driver.
+	SetOption(name string, value interface{}) error
 }
 
 // SocketType describes the type of a socket (PUB, SUB, PUSH, PULL, ...)
@@ -60,6 +73,9 @@ const (
 	Router
 	Pair
 	Bus
+	Surveyor
+	Respondent
+	Star
 )
 
 func (typ SocketType) String() string {
@@ -90,6 +106,12 @@ func (typ SocketType) String() string {
 		return "pair"
 	case Bus:
 		return "bus"
+	case Surveyor:
+		return "surveyor"
+	case Respondent:
+		return "respondent"
+	case Star:
+		return "star"
 	}
 	return "N/A"
 }
@@ -123,6 +145,12 @@ func SocketTypeFrom(name string) SocketType {
 		return Pair
 	case "bus":
 		return Bus
+	case "surveyor":
+		return Surveyor
+	case "respondent":
+		return Respondent
+	case "star":
+		return Star
 	}
 	panic(xerrors.Errorf("fer: invalid socket type name (value=%q)", name))
 }
@@ -5,15 +5,33 @@
 package mq_test
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/alice-go/fer/mq"
+	_ "github.com/alice-go/fer/mq/gochan"
 	_ "github.com/alice-go/fer/mq/nanomsg"
+	"github.com/alice-go/fer/mq/shmem"
+	"github.com/alice-go/fer/mq/stream"
+	"github.com/alice-go/fer/mq/ws"
 	_ "github.com/alice-go/fer/mq/zeromq"
+	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
+	"nanomsg.org/go-mangos"
 )
 
 func TestOpen(t *testing.T) {
@@ -37,7 +55,17 @@ func TestOpen(t *testing.T) {
 	}
 }
 
-var drivers = []string{"zeromq", "nanomsg"}
+var drivers = []string{"zeromq", "nanomsg", "go-chan", "shmem"}
+
+// streamDrivers are the drivers only supporting the push/pull, pub/sub and
+// pair patterns.
+var streamDrivers = []string{"stream"}
+
+// pipelineDrivers returns the drivers supporting the push/pull and pub/sub
+// patterns.
+func pipelineDrivers() []string {
+	return append(append([]string(nil), drivers...), streamDrivers...)
+}
 
 func getTCPPort() (string, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
@@ -53,8 +81,8 @@ func getTCPPort() (string, error) {
 }
 
 func TestPushPull(t *testing.T) {
-	for i := range drivers {
-		transport := drivers[i]
+	for _, transport := range pipelineDrivers() {
+		transport := transport
 		t.Run("transport="+transport, func(t *testing.T) {
 
 			t.Parallel()
@@ -88,17 +116,19 @@ func TestPushPull(t *testing.T) {
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go func() {
+				defer wg.Done()
 				err := push.Dial("tcp://localhost:" + port)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 				for i := 0; i < N; i++ {
 					err = push.Send([]byte(fmt.Sprintf(tmpl, i)))
 					if err != nil {
-						t.Fatalf("error sending data[%d]: %v\n", i, err)
+						t.Errorf("error sending data[%d]: %v\n", i, err)
+						return
 					}
 				}
-				wg.Done()
 			}()
 
 			err = pull.Listen("tcp://*:" + port)
@@ -163,24 +193,27 @@ func TestReqRep(t *testing.T) {
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go func() {
+				defer wg.Done()
 				err := req.Dial("tcp://localhost:" + port)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 				for i := 0; i < N; i++ {
 					err = req.Send([]byte("GET"))
 					if err != nil {
-						t.Fatalf("error sending request[%d]: %v\n", i, err)
+						t.Errorf("error sending request[%d]: %v\n", i, err)
+						return
 					}
 					msg, err := req.Recv()
 					if err != nil {
-						t.Fatal(err)
+						t.Error(err)
+						return
 					}
 					if got, want := string(msg), fmt.Sprintf(tmpl, i); got != want {
 						t.Errorf("req-rep[%d]: got=%q want=%q\n", i, got, want)
 					}
 				}
-				wg.Done()
 			}()
 
 			err = rep.Listen("tcp://*:" + port)
@@ -215,8 +248,8 @@ func TestReqRep(t *testing.T) {
 }
 
 func TestPubSub(t *testing.T) {
-	for i := range drivers {
-		transport := drivers[i]
+	for _, transport := range pipelineDrivers() {
+		transport := transport
 		t.Run("transport="+transport, func(t *testing.T) {
 
 			t.Parallel()
@@ -251,7 +284,8 @@ func TestPubSub(t *testing.T) {
 			go func() {
 				err := pub.Listen("tcp://*:" + port)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 				for {
 					select {
@@ -260,7 +294,8 @@ func TestPubSub(t *testing.T) {
 					default:
 						err = pub.Send([]byte(tmpl))
 						if err != nil {
-							t.Fatalf("error sending data[%d]: %v\n", i, err)
+							t.Errorf("error sending data: %v\n", err)
+							return
 						}
 					}
 				}
@@ -292,3 +327,2776 @@ func TestPubSub(t *testing.T) {
 		})
 	}
 }
+
+func TestSubscriptions(t *testing.T) {
+	for _, transport := range pipelineDrivers() {
+		transport := transport
+		t.Run("transport="+transport, func(t *testing.T) {
+			t.Parallel()
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v\n", err)
+			}
+
+			drv, err := mq.Open(transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sub, err := drv.NewSocket(mq.Sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			pub, err := drv.NewSocket(mq.Pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pub.Close()
+
+			for _, opt := range []struct{ name, topic string }{
+				{mq.OptionUnsubscribe, ""},
+				{mq.OptionSubscribe, "a"},
+			} {
+				err = sub.SetOption(opt.name, opt.topic)
+				if err != nil {
+					t.Fatalf("could not set %s=%q: %v", opt.name, opt.topic, err)
+				}
+			}
+
+			var (
+				wg   sync.WaitGroup
+				done = make(chan int)
+			)
+			defer wg.Wait()
+			defer close(done)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := pub.Listen("tcp://*:" + port)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				msgs := [][][]byte{
+					{[]byte("a-data")},
+					{[]byte("b-data")},
+					{[]byte("a"), []byte("payload")},
+					{[]byte("b"), []byte("payload")},
+				}
+				for {
+					for _, msg := range msgs {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						err = pub.SendMulti(msg)
+						if err != nil {
+							t.Errorf("error sending data: %v\n", err)
+							return
+						}
+					}
+				}
+			}()
+
+			err = sub.Dial("tcp://localhost:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			multi := false
+			for i := 0; i < 10 || !multi; i++ {
+				parts, err := sub.RecvMulti()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if parts[0][0] != 'a' {
+					t.Fatalf("received message for an unsubscribed topic: %q", parts)
+				}
+				multi = multi || len(parts) == 2
+			}
+
+			err = sub.SetOption(mq.OptionUnsubscribe, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sub.SetOption(mq.OptionSubscribe, "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				parts, err := sub.RecvMulti()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if parts[0][0] == 'b' {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDealerRouter(t *testing.T) {
+	for i := range drivers {
+		transport := drivers[i]
+		t.Run("transport="+transport, func(t *testing.T) {
+
+			t.Parallel()
+
+			const N = 2 // number of requests in flight, per dealer.
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v\n", err)
+			}
+
+			drv, err := mq.Open(transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			router, err := drv.NewSocket(mq.Router)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer router.Close()
+			err = router.Listen("tcp://*:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dealers := make([]mq.Socket, 2)
+			for i := range dealers {
+				dealers[i], err = drv.NewSocket(mq.Dealer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer dealers[i].Close()
+				err = dealers[i].Dial("tcp://localhost:" + port)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// dealers do not wait for the replies to their previous requests.
+			for i, dealer := range dealers {
+				for j := 0; j < N; j++ {
+					err = dealer.SendMulti([][]byte{{}, []byte(fmt.Sprintf("req-%d-%d", i, j))})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			reqs := make([][][]byte, N*len(dealers))
+			for i := range reqs {
+				parts, err := router.RecvMulti()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) != 0 {
+					t.Fatalf("invalid router message: %q", parts)
+				}
+				reqs[i] = parts
+			}
+			for _, parts := range reqs {
+				err = router.SendMulti([][]byte{parts[0], {}, bytes.Replace(parts[2], []byte("req"), []byte("rep"), 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i, dealer := range dealers {
+				for j := 0; j < N; j++ {
+					parts, err := dealer.RecvMulti()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(parts) != 2 || len(parts[0]) != 0 {
+						t.Fatalf("dealer[%d]: invalid reply: %q", i, parts)
+					}
+					if got, want := string(parts[1]), fmt.Sprintf("rep-%d-%d", i, j); got != want {
+						t.Fatalf("dealer[%d]: got=%q, want=%q", i, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSurveyorRespondent(t *testing.T) {
+	for _, transport := range []string{"nanomsg", "shmem"} {
+		transport := transport
+		t.Run("transport="+transport, func(t *testing.T) {
+
+			t.Parallel()
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v\n", err)
+			}
+
+			drv, err := mq.Open(transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			surveyor, err := drv.NewSocket(mq.Surveyor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer surveyor.Close()
+			err = surveyor.SetOption("SURVEY-TIME", 50*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = surveyor.Listen("tcp://*:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+			for i := 0; i < 2; i++ {
+				resp, err := drv.NewSocket(mq.Respondent)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Close()
+				err = resp.Dial("tcp://localhost:" + port)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for {
+						msg, err := resp.Recv()
+						if err != nil {
+							return // socket closed.
+						}
+						err = resp.Send([]byte(fmt.Sprintf("%s-%d", msg, i)))
+						if err != nil {
+							return
+						}
+					}
+				}(i)
+			}
+
+			// surveys sent before the respondents are connected are lost.
+			got := make(map[string]bool)
+			for i := 0; i < 100 && len(got) < 2; i++ {
+				err = surveyor.Send([]byte("survey"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for {
+					msg, err := surveyor.Recv()
+					if err != nil {
+						break // survey expired.
+					}
+					got[string(msg)] = true
+				}
+			}
+			if want := map[string]bool{"survey-0": true, "survey-1": true}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("invalid responses: got=%v, want=%v", got, want)
+			}
+		})
+	}
+}
+
+func TestStar(t *testing.T) {
+	for _, transport := range []string{"nanomsg", "shmem"} {
+		transport := transport
+		t.Run("transport="+transport, func(t *testing.T) {
+
+			t.Parallel()
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v\n", err)
+			}
+
+			drv, err := mq.Open(transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stars := make([]mq.Socket, 3)
+			for i := range stars {
+				stars[i], err = drv.NewSocket(mq.Star)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stars[i].Close()
+				switch i {
+				case 0:
+					err = stars[i].Listen("tcp://*:" + port)
+				default:
+					err = stars[i].Dial("tcp://localhost:" + port)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// messages sent before the peers are connected are lost.
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := stars[1].Send([]byte("hello"))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+			}()
+			defer wg.Wait()
+			defer close(done)
+
+			// messages are forwarded to all the other peers.
+			for _, i := range []int{0, 2} {
+				msg, err := stars[i].Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(msg) != "hello" {
+					t.Fatalf("star[%d]: got=%q, want=%q", i, msg, "hello")
+				}
+			}
+		})
+	}
+}
+
+func TestNanomsgRaw(t *testing.T) {
+	drv, err := mq.Open("nanomsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []mq.SocketType{mq.Dealer, mq.Router, mq.XPub, mq.XSub} {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sck.Close()
+		raw, err := sck.GetOption("RAW")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw != true {
+			t.Fatalf("%v socket is not in raw mode", typ)
+		}
+	}
+
+	t.Run("req-router", func(t *testing.T) {
+		router, err := drv.NewSocket(mq.Router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer router.Close()
+		err = router.Listen("inproc://nn-req-router")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := drv.NewSocket(mq.Req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer req.Close()
+		err = req.Dial("inproc://nn-req-router")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = req.Send([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err := router.RecvMulti()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 2 || string(parts[1]) != "ping" {
+			t.Fatalf("invalid router message: %q", parts)
+		}
+		err = router.SendMulti([][]byte{parts[0], []byte("pong")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := req.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "pong" {
+			t.Fatalf("got=%q, want=%q", msg, "pong")
+		}
+	})
+
+	t.Run("xpub-xsub", func(t *testing.T) {
+		xpub, err := drv.NewSocket(mq.XPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer xpub.Close()
+		_, err = xpub.Recv()
+		if err == nil {
+			t.Fatalf("expected an error receiving subscriptions")
+		}
+
+		xsub, err := drv.NewSocket(mq.XSub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer xsub.Close()
+		err = xsub.Send([]byte{1})
+		if err == nil {
+			t.Fatalf("expected an error sending subscriptions")
+		}
+	})
+}
+
+func TestSocketType(t *testing.T) {
+	for typ := mq.Sub; typ <= mq.Star; typ++ {
+		if got := mq.SocketTypeFrom(typ.String()); got != typ {
+			t.Errorf("invalid round-trip: got=%v, want=%v", got, typ)
+		}
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	for _, transport := range pipelineDrivers() {
+		transport := transport
+		t.Run("transport="+transport, func(t *testing.T) {
+
+			t.Parallel()
+
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatalf("error getting free TCP port: %v\n", err)
+			}
+
+			drv, err := mq.Open(transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pull, err := drv.NewSocket(mq.Pull)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pull.Close()
+
+			push, err := drv.NewSocket(mq.Push)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer push.Close()
+
+			want := [][][]byte{
+				{[]byte("header"), []byte("payload-1"), []byte("payload-2")},
+				{[]byte("header"), {}, []byte("payload")},
+				{[]byte("single")},
+			}
+
+			// a single-part payload that looks like a framed multipart message.
+			lookalike := mq.FrameParts([][]byte{[]byte("a"), []byte("b")})
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := push.Dial("tcp://localhost:" + port)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for i, parts := range want {
+					err = push.SendMulti(parts)
+					if err != nil {
+						t.Errorf("error sending parts[%d]: %v\n", i, err)
+						return
+					}
+				}
+				err = push.Send([]byte("plain"))
+				if err != nil {
+					t.Errorf("error sending data: %v\n", err)
+					return
+				}
+				err = push.Send(lookalike)
+				if err != nil {
+					t.Errorf("error sending data: %v\n", err)
+					return
+				}
+			}()
+
+			err = pull.Listen("tcp://*:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range want {
+				parts, err := pull.RecvMulti()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalParts(parts, want[i]) {
+					t.Errorf("multipart[%d]: got=%q want=%q\n", i, parts, want[i])
+				}
+			}
+			parts, err := pull.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := [][]byte{[]byte("plain")}; !equalParts(parts, want) {
+				t.Errorf("multipart: got=%q want=%q\n", parts, want)
+			}
+			parts, err = pull.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// nanomsg can not mark multipart messages (see mq.FrameParts.)
+			if want := [][]byte{lookalike}; transport != "nanomsg" && !equalParts(parts, want) {
+				t.Errorf("lookalike: got=%q want=%q\n", parts, want)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	drv, err := mq.Open("nanomsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sck, err := drv.NewSocket(mq.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sck.Close()
+
+	for _, tc := range []struct {
+		name string
+		v    interface{}
+	}{
+		{mq.OptionSendHWM, 42},
+		{mq.OptionRecvHWM, 42},
+		{mq.OptionLinger, time.Second},
+		{mq.OptionSendTimeout, 2 * time.Second},
+		{mq.OptionRecvTimeout, 3 * time.Second},
+		{mq.OptionReconnectInterval, 4 * time.Second},
+		{mq.OptionTCPKeepAlive, false},
+	} {
+		err = sck.SetOption(tc.name, tc.v)
+		if err != nil {
+			t.Fatalf("could not set option %q: %v", tc.name, err)
+		}
+		v, err := sck.GetOption(tc.name)
+		if err != nil {
+			t.Fatalf("could not get option %q: %v", tc.name, err)
+		}
+		if v != tc.v {
+			t.Fatalf("invalid option %q: got=%v, want=%v", tc.name, v, tc.v)
+		}
+	}
+
+	err = sck.SetOption(mq.OptionSubscribe, "topic")
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	err = sck.SetOption(mq.OptionLinger, "1 second")
+	if err == nil {
+		t.Fatalf("expected an error setting an invalid option value")
+	}
+
+	for _, tc := range []struct {
+		drv  string
+		typ  mq.SocketType
+		name string
+	}{
+		{"nanomsg", mq.Push, mq.OptionSubscribe},
+		{"zeromq", mq.Push, mq.OptionSendHWM},
+		{"zeromq", mq.Push, mq.OptionLinger},
+		{"zeromq", mq.Push, mq.OptionSubscribe},
+	} {
+		drv, err := mq.Open(tc.drv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sck, err := drv.NewSocket(tc.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sck.Close()
+
+		err = sck.SetOption(tc.name, "1s")
+		var unsupported *mq.UnsupportedOptionError
+		if !xerrors.As(err, &unsupported) || unsupported.Driver != tc.drv || unsupported.Option != tc.name {
+			t.Fatalf("%s: invalid error setting option %q of %v socket: %v", tc.drv, tc.name, tc.typ, err)
+		}
+	}
+
+	drv, err = mq.Open("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := drv.NewSocket(mq.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	err = sub.SetOption(mq.OptionSubscribe, "topic")
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	// the dial retry delay of zeromq sockets is set before they are connected.
+	push, err := drv.NewSocket(mq.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer push.Close()
+	err = push.SetOption(mq.OptionReconnectInterval, "10ms")
+	if err != nil {
+		t.Fatalf("could not set option %q: %v", mq.OptionReconnectInterval, err)
+	}
+	v, err := push.GetOption(mq.OptionReconnectInterval)
+	if err != nil {
+		t.Fatalf("could not get option %q: %v", mq.OptionReconnectInterval, err)
+	}
+	if want := 10 * time.Millisecond; v != want {
+		t.Fatalf("invalid option %q: got=%v, want=%v", mq.OptionReconnectInterval, v, want)
+	}
+
+	port, err := getTCPPort()
+	if err != nil {
+		t.Fatalf("error getting free TCP port: %v\n", err)
+	}
+	start := time.Now()
+	err = push.Dial("tcp://localhost:" + port)
+	if err == nil {
+		t.Fatalf("expected an error dialing a closed port")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dial retry delay not applied: gave up dialing after %v", d)
+	}
+	err = push.SetOption(mq.OptionReconnectInterval, "20ms")
+	if err == nil {
+		t.Fatalf("expected an error setting option %q of a connected socket", mq.OptionReconnectInterval)
+	}
+}
+
+func TestOptionValue(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		v    interface{}
+		want interface{}
+		err  bool
+	}{
+		{name: mq.OptionSendHWM, v: 10, want: 10},
+		{name: mq.OptionSendHWM, v: 10.0, want: 10},
+		{name: mq.OptionRecvHWM, v: 10.5, err: true},
+		{name: mq.OptionRecvHWM, v: -1.0, err: true},
+		{name: mq.OptionLinger, v: "100ms", want: 100 * time.Millisecond},
+		{name: mq.OptionLinger, v: 100.0, want: 100 * time.Millisecond},
+		{name: mq.OptionSendTimeout, v: time.Second, want: time.Second},
+		{name: mq.OptionRecvTimeout, v: "soon", err: true},
+		{name: mq.OptionSubscribe, v: []byte("topic"), want: "topic"},
+		{name: mq.OptionUnsubscribe, v: 1.0, err: true},
+		{name: mq.OptionTCPKeepAlive, v: true, want: true},
+		{name: mq.OptionTCPKeepAlive, v: "true", err: true},
+		{name: mq.OptionPlainServer, v: true, want: true},
+		{name: mq.OptionPlainPassword, v: []byte("secret"), err: true},
+		{name: mq.OptionAllow, v: []interface{}{"127.0.0.1", "10.0.0.0/8"}, want: []string{"127.0.0.1", "10.0.0.0/8"}},
+		{name: mq.OptionAllow, v: []interface{}{"127.0.0.1", 1.0}, err: true},
+		{name: mq.OptionAllow, v: "127.0.0.1", err: true},
+		{name: "driver-specific", v: "value", want: "value"},
+	} {
+		got, err := mq.OptionValue(tc.name, tc.v)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("%s=%v: expected an error", tc.name, tc.v)
+		case !tc.err && err != nil:
+			t.Errorf("%s=%v: unexpected error: %v", tc.name, tc.v, err)
+		case !reflect.DeepEqual(got, tc.want):
+			t.Errorf("%s=%v: got=%v (%T), want=%v (%T)", tc.name, tc.v, got, got, tc.want, tc.want)
+		}
+	}
+}
+
+func TestGoChan(t *testing.T) {
+	drv, err := mq.Open("chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSocket := func(typ mq.SocketType) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sck
+	}
+
+	t.Run("push-pull", func(t *testing.T) {
+		push := newSocket(mq.Push)
+		defer push.Close()
+		pulls := []mq.Socket{newSocket(mq.Pull), newSocket(mq.Pull)}
+
+		// dial before bind.
+		for _, pull := range pulls {
+			defer pull.Close()
+			err := pull.Dial("tcp://localhost:6001")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := push.Listen("tcp://*:6001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := newSocket(mq.Push)
+		defer other.Close()
+		err = other.Listen("tcp://*:6001")
+		if err == nil {
+			t.Fatalf("expected an error binding an address in use")
+		}
+
+		for i := 0; i < 4; i++ {
+			err := push.Send([]byte{byte(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, pull := range pulls {
+			for j := 0; j < 2; j++ {
+				msg, err := pull.Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := msg[0], byte(i+2*j); got != want {
+					t.Fatalf("pull[%d]: invalid load balancing: got=%d, want=%d", i, got, want)
+				}
+			}
+		}
+	})
+
+	t.Run("pub-sub", func(t *testing.T) {
+		pub := newSocket(mq.Pub)
+		defer pub.Close()
+		err := pub.Listen("inproc://pub-sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subs := []mq.Socket{newSocket(mq.Sub), newSocket(mq.Sub)}
+		for _, sub := range subs {
+			defer sub.Close()
+			err := sub.Dial("inproc://pub-sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = subs[1].SetOption(mq.OptionUnsubscribe, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = subs[1].SetOption(mq.OptionSubscribe, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range []string{"a-1", "b-1"} {
+			err = pub.Send([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, want := range [][]string{{"a-1", "b-1"}, {"b-1"}} {
+			for _, want := range want {
+				msg, err := subs[i].Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(msg) != want {
+					t.Fatalf("sub[%d]: got=%q, want=%q", i, msg, want)
+				}
+			}
+		}
+	})
+
+	t.Run("dealer-router", func(t *testing.T) {
+		router := newSocket(mq.Router)
+		defer router.Close()
+		err := router.Listen("inproc://dealer-router")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dealers := []mq.Socket{newSocket(mq.Dealer), newSocket(mq.Dealer)}
+		for i, dealer := range dealers {
+			defer dealer.Close()
+			err := dealer.Dial("inproc://dealer-router")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = dealer.SendMulti([][]byte{{}, []byte(strconv.Itoa(i))})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for range dealers {
+			parts, err := router.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != 3 || len(parts[1]) != 0 {
+				t.Fatalf("invalid router message: %q", parts)
+			}
+			err = router.SendMulti([][]byte{parts[0], {}, append([]byte("rep-"), parts[2]...)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, dealer := range dealers {
+			parts, err := dealer.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(parts[1]), "rep-"+strconv.Itoa(i); got != want {
+				t.Fatalf("dealer[%d]: got=%q, want=%q", i, got, want)
+			}
+		}
+
+		// closed sockets with peers report an error, not empty messages.
+		for _, sck := range []mq.Socket{router, dealers[0]} {
+			err := sck.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts, err := sck.RecvMulti()
+			if err == nil {
+				t.Fatalf("%v: expected an error receiving from a closed socket, got %q", sck.Type(), parts)
+			}
+		}
+	})
+
+	t.Run("xpub-sub", func(t *testing.T) {
+		xpub := newSocket(mq.XPub)
+		defer xpub.Close()
+		err := xpub.Listen("inproc://gochan-xpub-sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := newSocket(mq.Sub)
+		defer sub.Close()
+		err = sub.Dial("inproc://gochan-xpub-sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sub.SetOption(mq.OptionSubscribe, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sub.SetOption(mq.OptionUnsubscribe, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range [][]byte{{1}, {1, 'b'}, {0}} {
+			msg, err := xpub.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, want) {
+				t.Fatalf("invalid subscription: got=%q, want=%q", msg, want)
+			}
+		}
+
+		for _, msg := range []string{"a-1", "b-1"} {
+			err = xpub.Send([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg, err := sub.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "b-1" {
+			t.Fatalf("got=%q, want=%q", msg, "b-1")
+		}
+	})
+
+	t.Run("xpub-xsub", func(t *testing.T) {
+		xpub := newSocket(mq.XPub)
+		defer xpub.Close()
+		err := xpub.Listen("inproc://gochan-xpub-xsub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		xsub := newSocket(mq.XSub)
+		defer xsub.Close()
+		err = xsub.Dial("inproc://gochan-xpub-xsub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range [][]byte{{0}, {1, 'b'}} {
+			err = xsub.Send(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, want := range [][]byte{{1}, {0}, {1, 'b'}} {
+			msg, err := xpub.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, want) {
+				t.Fatalf("invalid subscription: got=%q, want=%q", msg, want)
+			}
+		}
+
+		for _, msg := range []string{"a-1", "b-1"} {
+			err = xpub.Send([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg, err := xsub.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "b-1" {
+			t.Fatalf("got=%q, want=%q", msg, "b-1")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		pull := newSocket(mq.Pull)
+		defer pull.Close()
+		err := pull.SetOption(mq.OptionRecvTimeout, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pull.Recv()
+		if err == nil {
+			t.Fatalf("expected a timeout error")
+		}
+
+		err = pull.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pull.Recv()
+		if err == nil {
+			t.Fatalf("expected an error receiving from a closed socket")
+		}
+	})
+}
+
+func TestZeroMQ(t *testing.T) {
+	drv, err := mq.Open("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSocket := func(typ mq.SocketType) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sck
+	}
+
+	t.Run("dealer-router", func(t *testing.T) {
+		router := newSocket(mq.Router)
+		defer router.Close()
+		err := router.Listen("inproc://zmq-dealer-router")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dealers := []mq.Socket{newSocket(mq.Dealer), newSocket(mq.Dealer)}
+		for i, dealer := range dealers {
+			defer dealer.Close()
+			err := dealer.Dial("inproc://zmq-dealer-router")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = dealer.SendMulti([][]byte{{}, []byte(strconv.Itoa(i))})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ids := make(map[string]bool)
+		for range dealers {
+			parts, err := router.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) != 0 {
+				t.Fatalf("invalid router message: %q", parts)
+			}
+			ids[string(parts[0])] = true
+			err = router.SendMulti([][]byte{parts[0], {}, append([]byte("rep-"), parts[2]...)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(ids) != len(dealers) {
+			t.Fatalf("invalid peer identities: %v", ids)
+		}
+
+		for i, dealer := range dealers {
+			parts, err := dealer.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != 2 || len(parts[0]) != 0 {
+				t.Fatalf("dealer[%d]: invalid reply: %q", i, parts)
+			}
+			if got, want := string(parts[1]), "rep-"+strconv.Itoa(i); got != want {
+				t.Fatalf("dealer[%d]: got=%q, want=%q", i, got, want)
+			}
+		}
+
+		// closed sockets with peers report an error, not empty messages.
+		for _, sck := range []mq.Socket{router, dealers[0]} {
+			err := sck.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts, err := sck.RecvMulti()
+			if err == nil {
+				t.Fatalf("%v: expected an error receiving from a closed socket, got %q", sck.Type(), parts)
+			}
+		}
+	})
+
+	t.Run("pair", func(t *testing.T) {
+		p1 := newSocket(mq.Pair)
+		defer p1.Close()
+		err := p1.Listen("inproc://zmq-pair")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2 := newSocket(mq.Pair)
+		defer p2.Close()
+		err = p2.Dial("inproc://zmq-pair")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range [][2]mq.Socket{{p1, p2}, {p2, p1}} {
+			err = p[0].Send([]byte("ping"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := p[1].Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != "ping" {
+				t.Fatalf("got=%q, want=%q", msg, "ping")
+			}
+		}
+	})
+
+	t.Run("xpub-sub", func(t *testing.T) {
+		xpub := newSocket(mq.XPub)
+		defer xpub.Close()
+		err := xpub.Listen("inproc://zmq-xpub-sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := newSocket(mq.Sub)
+		defer sub.Close()
+		err = sub.Dial("inproc://zmq-xpub-sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := xpub.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, []byte{1}) {
+			t.Fatalf("invalid subscription: got=%q, want=%q", msg, []byte{1})
+		}
+
+		err = xpub.Send([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err = sub.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "data" {
+			t.Fatalf("got=%q, want=%q", msg, "data")
+		}
+	})
+
+	t.Run("pub-xsub", func(t *testing.T) {
+		pub := newSocket(mq.Pub)
+		defer pub.Close()
+		err := pub.Listen("inproc://zmq-pub-xsub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		xsub := newSocket(mq.XSub)
+		defer xsub.Close()
+		err = xsub.SetOption(mq.OptionUnsubscribe, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = xsub.SetOption(mq.OptionSubscribe, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = xsub.Dial("inproc://zmq-pub-xsub")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the publisher drops messages until it processed the subscription.
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				for _, msg := range []string{"a-1", "b-1"} {
+					err := pub.Send([]byte(msg))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}()
+		defer wg.Wait()
+		defer close(done)
+
+		for i := 0; i < 2; i++ {
+			msg, err := xsub.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != "b-1" {
+				t.Fatalf("got=%q, want=%q", msg, "b-1")
+			}
+		}
+	})
+
+	t.Run("bus", func(t *testing.T) {
+		_, err := drv.NewSocket(mq.Bus)
+		if err == nil {
+			t.Fatalf("expected an error creating a bus socket")
+		}
+	})
+}
+
+func TestZeroMQSecurity(t *testing.T) {
+	drv, err := mq.Open("zeromq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSocket := func(typ mq.SocketType, opts map[string]interface{}) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, v := range opts {
+			err := sck.SetOption(name, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sck
+	}
+
+	tmp, err := ioutil.TempDir("", "fer-mq-zeromq-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	server := map[string]interface{}{
+		mq.OptionPlainServer:   true,
+		mq.OptionPlainUsername: "fer",
+		mq.OptionPlainPassword: "secret",
+	}
+	client := map[string]interface{}{
+		mq.OptionPlainUsername: "fer",
+		mq.OptionPlainPassword: "secret",
+	}
+
+	// recv checks that the messages of push reach pull.
+	recv := func(t *testing.T, push, pull mq.Socket, msg string) {
+		t.Helper()
+		err := push.Send([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := pull.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Fatalf("got=%q, want=%q", got, msg)
+		}
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		for _, addr := range []string{"tcp", "ipc://" + filepath.Join(tmp, "plain.sock")} {
+			listen, dial := addr, addr
+			if addr == "tcp" {
+				port, err := getTCPPort()
+				if err != nil {
+					t.Fatal(err)
+				}
+				listen, dial = "tcp://*:"+port, "tcp://localhost:"+port
+			}
+
+			pull := newSocket(mq.Pull, server)
+			defer pull.Close()
+			err := pull.Listen(listen)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, opts := range []map[string]interface{}{
+				nil,
+				{mq.OptionPlainUsername: "fer", mq.OptionPlainPassword: "guess"},
+				{mq.OptionPlainUsername: "admin", mq.OptionPlainPassword: "secret"},
+			} {
+				intruder := newSocket(mq.Push, opts)
+				defer intruder.Close()
+				err := intruder.Dial(dial)
+				if err == nil {
+					t.Fatalf("%s: expected an error connecting with credentials %v", addr, opts)
+				}
+			}
+
+			// the server still accepts authenticated peers.
+			push := newSocket(mq.Push, client)
+			defer push.Close()
+			err = push.Dial(dial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recv(t, push, pull, "data")
+		}
+	})
+
+	t.Run("dealer-router", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := newSocket(mq.Router, server)
+		defer router.Close()
+		err = router.Listen("tcp://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dealer := newSocket(mq.Dealer, client)
+		defer dealer.Close()
+		err = dealer.Dial("tcp://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dealer.SendMulti([][]byte{{}, []byte("ping")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err := router.RecvMulti()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 3 || len(parts[0]) == 0 || string(parts[2]) != "ping" {
+			t.Fatalf("invalid request: %q", parts)
+		}
+		err = router.SendMulti([][]byte{parts[0], {}, []byte("pong")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err = dealer.RecvMulti()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 2 || string(parts[1]) != "pong" {
+			t.Fatalf("invalid reply: %q", parts)
+		}
+	})
+
+	t.Run("allow", func(t *testing.T) {
+		for _, tc := range []struct {
+			allow []string
+			ok    bool
+		}{
+			{[]string{"10.1.2.3", "192.168.0.0/16"}, false},
+			{[]string{"10.1.2.3", "127.0.0.1"}, true},
+			{[]string{"127.0.0.0/8"}, true},
+		} {
+			port, err := getTCPPort()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pull := newSocket(mq.Pull, map[string]interface{}{mq.OptionAllow: tc.allow})
+			defer pull.Close()
+			err = pull.Listen("tcp://*:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			push := newSocket(mq.Push, nil)
+			defer push.Close()
+			err = push.Dial("tcp://127.0.0.1:" + port)
+			switch {
+			case !tc.ok && err == nil:
+				t.Fatalf("allow=%q: expected an error connecting", tc.allow)
+			case tc.ok && err != nil:
+				t.Fatalf("allow=%q: could not connect: %v", tc.allow, err)
+			case tc.ok:
+				recv(t, push, pull, "data")
+			}
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		sck := newSocket(mq.Pull, server)
+		defer sck.Close()
+		for name, want := range server {
+			got, err := sck.GetOption(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("option %q: got=%v, want=%v", name, got, want)
+			}
+		}
+		err := sck.SetOption(mq.OptionAllow, []string{"localhost"})
+		if err == nil {
+			t.Fatalf("expected an error setting an invalid allow-list")
+		}
+		err = sck.Dial("ipc://" + filepath.Join(tmp, "options.sock"))
+		if err == nil {
+			t.Fatalf("expected an error connecting a PLAIN server")
+		}
+		err = sck.SetOption(mq.OptionPlainPassword, "other")
+		if err == nil {
+			t.Fatalf("expected an error setting the password of a connected socket")
+		}
+
+		anon := newSocket(mq.Pull, map[string]interface{}{mq.OptionPlainServer: true})
+		defer anon.Close()
+		err = anon.Listen("ipc://" + filepath.Join(tmp, "anon.sock"))
+		if err == nil {
+			t.Fatalf("expected an error binding a PLAIN server without credentials")
+		}
+	})
+}
+
+func TestShmem(t *testing.T) {
+	const session = "fer-mq-test"
+	defer shmem.Cleanup(session)
+
+	drv, err := mq.Open("shmem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	push, err := drv.NewSocket(mq.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer push.Close()
+	pull, err := drv.NewSocket(mq.Pull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pull.Close()
+
+	for _, opt := range []struct {
+		name string
+		v    interface{}
+	}{
+		{shmem.OptionSession, session},
+		{shmem.OptionSegmentSize, 12.0 * (1 << 20)}, // JSON numbers are float64.
+	} {
+		for _, sck := range []mq.Socket{push, pull} {
+			err = sck.SetOption(opt.name, opt.v)
+			if err != nil {
+				t.Fatalf("could not set option %q: %v", opt.name, err)
+			}
+		}
+	}
+
+	port, err := getTCPPort()
+	if err != nil {
+		t.Fatalf("error getting free TCP port: %v\n", err)
+	}
+	err = push.Listen("tcp://*:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pull.Dial("tcp://localhost:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// payloads larger than a third of the segment reuse the released blocks.
+	const N = 10
+	go func() {
+		for i := 0; i < N; i++ {
+			data := bytes.Repeat([]byte{byte(i)}, (5<<20)+i)
+			err := push.SendMulti([][]byte{[]byte("header"), data})
+			if err != nil {
+				t.Errorf("could not send message %d: %v", i, err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < N; i++ {
+		parts, err := pull.RecvMulti()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bytes.Repeat([]byte{byte(i)}, (5<<20)+i)
+		if len(parts) != 2 || string(parts[0]) != "header" || !bytes.Equal(parts[1], want) {
+			t.Fatalf("invalid message %d", i)
+		}
+	}
+
+	// messages are filled in place and received without being copied: their
+	// blocks are held until the receiver releases them.
+	err = push.SetOption(mq.OptionSendTimeout, "10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		src = push.(shmem.Socket)
+		dst = pull.(shmem.Socket)
+	)
+	msg, err := src.Alloc(len("header"), 5<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(msg.Parts[0], "header")
+	for i := range msg.Parts[1] {
+		msg.Parts[1][i] = 42
+	}
+	err = src.SendMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.SendMessage(msg)
+	if err == nil {
+		t.Fatalf("expected an error sending a message twice")
+	}
+	got, err := dst.RecvMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{42}, 5<<20); len(got.Parts) != 2 || string(got.Parts[0]) != "header" || !bytes.Equal(got.Parts[1], want) {
+		t.Fatalf("invalid zero-copy message")
+	}
+	held, err := src.Alloc(5 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = src.Alloc(5 << 20)
+	if err == nil {
+		t.Fatalf("expected an error allocating a message in a segment held by a receiver")
+	}
+	got.Release()
+	msg, err = src.Alloc(5 << 20)
+	if err != nil {
+		t.Fatalf("could not allocate a message once the receiver released its block: %v", err)
+	}
+	msg.Release()
+	held.Release()
+
+	err = push.Send(make([]byte, 13<<20))
+	if err == nil {
+		t.Fatalf("expected an error sending a message larger than the segment")
+	}
+	err = push.SetOption(shmem.OptionSegmentSize, 1<<20)
+	if err == nil {
+		t.Fatalf("expected an error resizing a segment in use")
+	}
+
+	// closing sockets wait for their payloads to be received, without
+	// blocking the other methods of the socket.
+	err = push.Send([]byte("pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error)
+	go func() { closed <- push.Close() }()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	_, err = push.GetOption(shmem.OptionSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("closing socket blocked GetOption for %v", d)
+	}
+	data, err := pull.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "pending" {
+		t.Fatalf("invalid message: got=%q, want=%q", data, "pending")
+	}
+	err = <-closed
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShmemPeers(t *testing.T) {
+	const session = "fer-mq-test-peers"
+	defer shmem.Cleanup(session)
+
+	drv, err := mq.Open("shmem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSocket := func(typ mq.SocketType, opts map[string]interface{}) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, v := range opts {
+			err = sck.SetOption(name, v)
+			if err != nil {
+				t.Fatalf("could not set option %q: %v", name, err)
+			}
+		}
+		return sck
+	}
+
+	t.Run("session", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatalf("error getting free TCP port: %v\n", err)
+		}
+		push := newSocket(mq.Push, map[string]interface{}{
+			shmem.OptionSession: session,
+			mq.OptionLinger:     "10ms",
+		})
+		defer push.Close()
+		pull := newSocket(mq.Pull, nil)
+		defer pull.Close()
+		err = push.Listen("tcp://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pull.Dial("tcp://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = push.Send([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// receivers only map the segments of their session.
+		_, err = pull.Recv()
+		if err == nil || !strings.Contains(err.Error(), "invalid segment name") {
+			t.Fatalf("invalid error receiving from another session: %v", err)
+		}
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		const size = 64 << 10
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatalf("error getting free TCP port: %v\n", err)
+		}
+		push := newSocket(mq.Push, map[string]interface{}{
+			shmem.OptionSession:     session,
+			shmem.OptionSegmentSize: 1 << 20,
+			shmem.OptionLease:       "0s",
+			mq.OptionSendTimeout:    "10ms",
+			mq.OptionLinger:         "10ms",
+		})
+		defer push.Close()
+		err = push.Listen("tcp://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stalled := newSocket(mq.Pull, map[string]interface{}{
+			shmem.OptionSession: session,
+			mq.OptionLinger:     "10ms",
+		})
+		defer stalled.Close()
+		err = stalled.Dial("tcp://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the stalled peer holds the blocks of the payloads it did not
+		// receive, until the segment is full.
+		msg := make([]byte, size)
+		n := 0
+		for ; ; n++ {
+			err := push.Send(msg)
+			if err != nil {
+				if !strings.Contains(err.Error(), "timeout") {
+					t.Fatalf("invalid error sending to a stalled peer: %v", err)
+				}
+				break
+			}
+		}
+		if n == 0 {
+			t.Fatalf("could not send any message")
+		}
+
+		// once reclaimed, the blocks are reused.
+		push.(shmem.Socket).Reclaim()
+		err = push.Send([]byte("data"))
+		if err != nil {
+			t.Fatalf("could not send a message once the blocks were reclaimed: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			_, err = stalled.Recv()
+			if err == nil || !strings.Contains(err.Error(), "reclaimed") {
+				t.Fatalf("invalid error receiving a reclaimed payload %d: %v", i, err)
+			}
+		}
+		data, err := stalled.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "data" {
+			t.Fatalf("invalid message: got=%q, want=%q", data, "data")
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	drv, err := mq.Open("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSocket := func(typ mq.SocketType) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sck
+	}
+
+	tmp, err := ioutil.TempDir("", "fer-mq-stream-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	t.Run("push-pull-ipc", func(t *testing.T) {
+		const N = 10
+		addr := "ipc://" + filepath.Join(tmp, "push-pull.sock")
+
+		// dial before bind.
+		pulls := []mq.Socket{newSocket(mq.Pull), newSocket(mq.Pull)}
+		for _, pull := range pulls {
+			defer pull.Close()
+			err := pull.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		push := newSocket(mq.Push)
+		defer push.Close()
+		err := push.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < N; i++ {
+			err := push.Send([]byte{byte(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		msgs := make(chan byte)
+		for _, pull := range pulls {
+			go func(pull mq.Socket) {
+				for {
+					msg, err := pull.Recv()
+					if err != nil {
+						return // socket closed.
+					}
+					msgs <- msg[0]
+				}
+			}(pull)
+		}
+		got := make(map[byte]bool)
+		for i := 0; i < N; i++ {
+			got[<-msgs] = true
+		}
+		if len(got) != N {
+			t.Fatalf("invalid messages: %v", got)
+		}
+	})
+
+	t.Run("pair", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1 := newSocket(mq.Pair)
+		defer p1.Close()
+		err = p1.Listen("tcp://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2 := newSocket(mq.Pair)
+		defer p2.Close()
+		err = p2.Dial("tcp://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range [][2]mq.Socket{{p1, p2}, {p2, p1}} {
+			err = p[0].Send([]byte("ping"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := p[1].Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != "ping" {
+				t.Fatalf("got=%q, want=%q", msg, "ping")
+			}
+		}
+
+		// pair sockets accept a single peer.
+		p3 := newSocket(mq.Pair)
+		defer p3.Close()
+		err = p3.SetOption(mq.OptionRecvTimeout, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p3.Dial("tcp://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p1.Send([]byte("pong"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p3.Recv()
+		if err == nil {
+			t.Fatalf("expected a timeout error")
+		}
+		msg, err := p2.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "pong" {
+			t.Fatalf("got=%q, want=%q", msg, "pong")
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		push := newSocket(mq.Push)
+		defer push.Close()
+		err = push.SetOption(mq.OptionReconnectInterval, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = push.Dial("tcp://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			pull := newSocket(mq.Pull)
+			err = pull.Listen("tcp://*:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// messages sent while the connection is being lost may be
+			// lost with it.
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+					err := push.Send([]byte("data"))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			msg, err := pull.Recv()
+			close(done)
+			wg.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != "data" {
+				t.Fatalf("got=%q, want=%q", msg, "data")
+			}
+			err = pull.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("hwm", func(t *testing.T) {
+		push := newSocket(mq.Push)
+		defer push.Close()
+		for _, opt := range []struct {
+			name  string
+			value interface{}
+		}{
+			{mq.OptionSendHWM, 1},
+			{mq.OptionSendTimeout, 10 * time.Millisecond},
+			{mq.OptionLinger, time.Duration(0)},
+		} {
+			err := push.SetOption(opt.name, opt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := push.Dial("ipc://" + filepath.Join(tmp, "no-peer.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = push.SetOption(mq.OptionSendHWM, 10)
+		if err == nil {
+			t.Fatalf("expected an error setting the HWM of a connected socket")
+		}
+
+		err = push.Send([]byte("queued"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = push.Send([]byte("blocked"))
+		if err == nil {
+			t.Fatalf("expected a timeout error")
+		}
+	})
+
+	t.Run("wire", func(t *testing.T) {
+		addr := filepath.Join(tmp, "wire.sock")
+		pull := newSocket(mq.Pull)
+		defer pull.Close()
+		err := pull.Listen("ipc://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		greeting := []byte("FER\x00STREAM\x00\x02")
+		for _, tc := range []struct {
+			typ  mq.SocketType
+			want string
+		}{
+			{mq.Pub, ""},
+			{mq.Push, "data"},
+		} {
+			conn, err := net.Dial("unix", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = conn.Write(append(greeting, byte(tc.typ)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = conn.Write([]byte("\x00\x00\x00\x04data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, len(greeting)+1)
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append(greeting, byte(mq.Pull)); !bytes.Equal(buf, want) {
+				t.Fatalf("invalid greeting: got=%q, want=%q", buf, want)
+			}
+			if tc.want == "" {
+				// incompatible peers are disconnected.
+				_, err = conn.Read(buf)
+				if err == nil {
+					t.Fatalf("%v peer: expected a closed connection", tc.typ)
+				}
+				continue
+			}
+			msg, err := pull.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != tc.want {
+				t.Fatalf("got=%q, want=%q", msg, tc.want)
+			}
+		}
+	})
+
+	for _, typ := range []mq.SocketType{mq.Req, mq.Router, mq.Bus} {
+		_, err := drv.NewSocket(typ)
+		if err == nil {
+			t.Fatalf("expected an error creating a %v socket", typ)
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	drv, err := mq.Open("tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "fer-mq-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var certs [2]stream.Certificates
+	for i := range certs {
+		dir := filepath.Join(tmp, strconv.Itoa(i))
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs[i], err = stream.GenerateCertificates(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newSocket := func(typ mq.SocketType, certs stream.Certificates) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opt := range []struct {
+			name  string
+			value string
+		}{
+			{mq.OptionTLSCert, certs.Cert},
+			{mq.OptionTLSKey, certs.Key},
+			{mq.OptionTLSCA, certs.CA},
+		} {
+			err := sck.SetOption(opt.name, opt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sck
+	}
+
+	for _, tc := range []struct {
+		name   string
+		listen string
+		dial   string
+	}{
+		{"tcp", "tcp://*:%s", "tcp://127.0.0.1:%s"},
+		{"tcp-localhost", "tcp://*:%s", "tcp://localhost:%s"},
+		{"ipc", "ipc://" + filepath.Join(tmp, "push-pull.sock"), "ipc://" + filepath.Join(tmp, "push-pull.sock")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			listen, dial := tc.listen, tc.dial
+			if strings.HasPrefix(listen, "tcp") {
+				port, err := getTCPPort()
+				if err != nil {
+					t.Fatal(err)
+				}
+				listen = fmt.Sprintf(listen, port)
+				dial = fmt.Sprintf(dial, port)
+			}
+
+			pull := newSocket(mq.Pull, certs[0])
+			defer pull.Close()
+			err := pull.Listen(listen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			push := newSocket(mq.Push, certs[0])
+			defer push.Close()
+			err = push.Dial(dial)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = push.Send([]byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := pull.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != "secret" {
+				t.Fatalf("got=%q, want=%q", msg, "secret")
+			}
+		})
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pull := newSocket(mq.Pull, certs[0])
+		defer pull.Close()
+		err = pull.SetOption(mq.OptionRecvTimeout, 200*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pull.Listen("tcp://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// peers with a certificate signed by another authority, or without
+		// TLS, are rejected.
+		untrusted := newSocket(mq.Push, certs[1])
+		defer untrusted.Close()
+		plain, err := mq.Open("stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		insecure, err := plain.NewSocket(mq.Push)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer insecure.Close()
+
+		for _, push := range []mq.Socket{untrusted, insecure} {
+			err = push.SetOption(mq.OptionLinger, time.Duration(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = push.Dial("tcp://localhost:" + port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = push.Send([]byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg, err := pull.Recv()
+		if err == nil {
+			t.Fatalf("expected a timeout error, got %q", msg)
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pull := newSocket(mq.Pull, certs[0])
+		defer pull.Close()
+		err = pull.Listen("tcp://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the client trusts the server, but presents a certificate signed by
+		// another authority: the server aborts the handshake.
+		pem, err := ioutil.ReadFile(certs[0].CA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			t.Fatalf("could not load certificate authority")
+		}
+		cert, err := tls.LoadX509KeyPair(certs[1].Cert, certs[1].Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", "localhost:"+port, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+		})
+		if err == nil {
+			defer conn.Close()
+			// with TLS 1.3, client certificates are verified after the
+			// client completed its side of the handshake.
+			_, err = conn.Read(make([]byte, 1))
+		}
+		if err == nil || !strings.Contains(err.Error(), "tls: unknown certificate authority") {
+			t.Fatalf("expected a TLS handshake error, got: %v", err)
+		}
+	})
+
+	t.Run("no-certificates", func(t *testing.T) {
+		sck, err := drv.NewSocket(mq.Push)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sck.Close()
+		err = sck.Listen("ipc://" + filepath.Join(tmp, "no-certs.sock"))
+		if err == nil {
+			t.Fatalf("expected an error listening without certificates")
+		}
+		err = sck.Dial("ipc://" + filepath.Join(tmp, "no-certs.sock"))
+		if err == nil {
+			t.Fatalf("expected an error dialing without certificates")
+		}
+
+		sck = newSocket(mq.Push, stream.Certificates{
+			Cert: certs[0].Cert,
+			Key:  certs[0].Key,
+			CA:   filepath.Join(tmp, "not-there.pem"),
+		})
+		defer sck.Close()
+		err = sck.Dial("ipc://" + filepath.Join(tmp, "no-certs.sock"))
+		if err == nil {
+			t.Fatalf("expected an error dialing with a missing certificate authority")
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		sck := newSocket(mq.Pull, certs[0])
+		defer sck.Close()
+		v, err := sck.GetOption(mq.OptionTLSCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != certs[0].CA {
+			t.Fatalf("got=%q, want=%q", v, certs[0].CA)
+		}
+		err = sck.Listen("ipc://" + filepath.Join(tmp, "options.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sck.SetOption(mq.OptionTLSCert, certs[1].Cert)
+		if err == nil {
+			t.Fatalf("expected an error setting the certificate of a bound socket")
+		}
+
+		plain, err := mq.Open("stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		insecure, err := plain.NewSocket(mq.Pull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer insecure.Close()
+		err = insecure.SetOption(mq.OptionTLSCert, certs[0].Cert)
+		if !xerrors.As(err, new(*mq.UnsupportedOptionError)) {
+			t.Fatalf("expected an unsupported option error, got %v", err)
+		}
+	})
+}
+
+func TestWebSocket(t *testing.T) {
+	drv, err := mq.Open("ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSocket := func(typ mq.SocketType) mq.Socket {
+		sck, err := drv.NewSocket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sck
+	}
+
+	t.Run("push-pull", func(t *testing.T) {
+		const N = 10
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// dial before bind.
+		pull := newSocket(mq.Pull)
+		defer pull.Close()
+		err = pull.Dial("ws://localhost:" + port + "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		push := newSocket(mq.Push)
+		defer push.Close()
+		err = push.Listen("ws://*:" + port + "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < N; i++ {
+			err := push.SendMulti([][]byte{[]byte("data"), {byte(i)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < N; i++ {
+			parts, err := pull.RecvMulti()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := [][]byte{[]byte("data"), {byte(i)}}; !reflect.DeepEqual(parts, want) {
+				t.Fatalf("msg[%d]: got=%q, want=%q", i, parts, want)
+			}
+		}
+
+		// single-part messages are never decoded as multipart messages.
+		lookalike := mq.FrameParts([][]byte{[]byte("a"), []byte("b")})
+		err = push.Send(lookalike)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err := pull.RecvMulti()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := [][]byte{lookalike}; !reflect.DeepEqual(parts, want) {
+			t.Fatalf("lookalike: got=%q, want=%q", parts, want)
+		}
+	})
+
+	t.Run("pub-sub", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := newSocket(mq.Pub)
+		defer pub.Close()
+		err = pub.Listen("ws://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := newSocket(mq.Sub)
+		defer sub.Close()
+		err = sub.SetOption(mq.OptionUnsubscribe, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sub.SetOption(mq.OptionSubscribe, "temperature")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sub.Dial("ws://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// messages published before the subscriber is connected are lost.
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				for _, msg := range []string{"pressure=1", "temperature=2"} {
+					err := pub.Send([]byte(msg))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+		msg, err := sub.Recv()
+		close(done)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "temperature=2" {
+			t.Fatalf("got=%q, want=%q", msg, "temperature=2")
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		push := newSocket(mq.Push)
+		defer push.Close()
+		err = push.Listen("ws://*:" + port + "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pull := newSocket(mq.Pull)
+		defer pull.Close()
+		err = pull.Listen("ws://*:" + port + "x")
+		if err == nil {
+			t.Fatalf("expected an error listening on an invalid address")
+		}
+
+		resp, err := http.Get("http://localhost:" + port + "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("plain HTTP request: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+
+		// clients such as web browsers receive a binary message per message.
+		ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:"+port+"/data", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		err = push.Send([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.BinaryMessage || string(msg) != "data" {
+			t.Fatalf("got=%q (type=%d), want=%q (type=%d)", msg, typ, "data", websocket.BinaryMessage)
+		}
+
+		// closing the socket closes the connections of its clients.
+		err = push.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = ws.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("expected a normal closure, got %v", err)
+		}
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := newSocket(mq.Pub)
+		defer pub.Close()
+		err = pub.Listen("ws://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// peers announce their type through the subprotocol.
+		for _, tc := range []struct {
+			proto string
+			ok    bool
+		}{
+			{"fer.mq.v1.sub", true},
+			{"fer.mq.v1.push", false},
+			{"fer.mq.v1.pull", false},
+		} {
+			dialer := websocket.Dialer{Subprotocols: []string{tc.proto}}
+			conn, resp, err := dialer.Dial("ws://localhost:"+port, nil)
+			switch {
+			case tc.ok && err != nil:
+				t.Fatalf("%s: %v", tc.proto, err)
+			case tc.ok:
+				if got := conn.Subprotocol(); got != tc.proto {
+					t.Fatalf("%s: invalid subprotocol %q", tc.proto, got)
+				}
+				conn.Close()
+			case err == nil:
+				conn.Close()
+				t.Fatalf("%s: expected an error", tc.proto)
+			case resp == nil || resp.StatusCode != http.StatusBadRequest:
+				t.Fatalf("%s: expected a bad request, got %v", tc.proto, err)
+			}
+		}
+
+		// sockets of incompatible types never exchange messages.
+		pull := newSocket(mq.Pull)
+		defer pull.Close()
+		err = pull.SetOption(mq.OptionRecvTimeout, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pull.Dial("ws://localhost:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				_ = pub.Send([]byte("data"))
+			}
+		}()
+		msg, err := pull.Recv()
+		if err == nil {
+			t.Fatalf("pull socket received %q from a pub socket", msg)
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pull := newSocket(mq.Pull)
+		defer pull.Close()
+		err = pull.Listen("ws://*:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:"+port, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		err = ws.WriteMessage(websocket.TextMessage, []byte("command"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := pull.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "command" {
+			t.Fatalf("got=%q, want=%q", msg, "command")
+		}
+
+		// messages of clients are never decoded as multipart messages.
+		lookalike := mq.FrameParts([][]byte{[]byte("a"), []byte("b")})
+		err = ws.WriteMessage(websocket.BinaryMessage, lookalike)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err := pull.RecvMulti()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := [][]byte{lookalike}; !reflect.DeepEqual(parts, want) {
+			t.Fatalf("lookalike: got=%q, want=%q", parts, want)
+		}
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		port, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := newSocket(mq.Pub)
+		defer pub.Close()
+		err = pub.SetOption(ws.OptionOrigins, []interface{}{"http://localhost:8080"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := pub.GetOption(ws.OptionOrigins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"http://localhost:8080"}; !reflect.DeepEqual(v, want) {
+			t.Fatalf("origins: got=%q, want=%q", v, want)
+		}
+		err = pub.SetOption(ws.OptionOrigins, "http://localhost:8080")
+		if err == nil {
+			t.Fatalf("expected an error setting origins from a string")
+		}
+		err = pub.Listen("ws://*:" + port + "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pub.SetOption(ws.OptionOrigins, []string{"*"})
+		if err == nil {
+			t.Fatalf("expected an error setting origins after listening")
+		}
+
+		for _, tc := range []struct {
+			origin string
+			ok     bool
+		}{
+			{"", true},
+			{"http://localhost:" + port, true},
+			{"http://localhost:8080", true},
+			{"http://LOCALHOST:8080", true},
+			{"http://localhost:8081", false},
+			{"http://example.com", false},
+		} {
+			hdr := make(http.Header)
+			if tc.origin != "" {
+				hdr.Set("Origin", tc.origin)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial("ws://localhost:"+port+"/data", hdr)
+			switch {
+			case tc.ok && err != nil:
+				t.Fatalf("origin %q: %v", tc.origin, err)
+			case tc.ok:
+				conn.Close()
+			case err == nil:
+				conn.Close()
+				t.Fatalf("origin %q: expected the handshake to fail", tc.origin)
+			case resp == nil || resp.StatusCode != http.StatusForbidden:
+				t.Fatalf("origin %q: expected a forbidden status, got %v", tc.origin, err)
+			}
+		}
+
+		// without allowed origins, only pages of the socket's host are accepted.
+		other := newSocket(mq.Pub)
+		defer other.Close()
+		port2, err := getTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = other.Listen("ws://*:" + port2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for origin, ok := range map[string]bool{
+			"http://localhost:" + port2: true,
+			"http://localhost:8080":     false,
+		} {
+			hdr := http.Header{"Origin": {origin}}
+			conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:"+port2, hdr)
+			if err == nil {
+				conn.Close()
+			}
+			if got := err == nil; got != ok {
+				t.Fatalf("origin %q: got=%v, want=%v (err=%v)", origin, got, ok, err)
+			}
+		}
+	})
+
+	for _, addr := range []string{"tcp://localhost:5555", "wss://localhost:5555"} {
+		sck := newSocket(mq.Push)
+		defer sck.Close()
+		err := sck.Dial(addr)
+		if err == nil {
+			t.Fatalf("expected an error dialing %q", addr)
+		}
+	}
+	for _, typ := range []mq.SocketType{mq.Req, mq.Router, mq.Pair} {
+		_, err := drv.NewSocket(typ)
+		if err == nil {
+			t.Fatalf("expected an error creating a %v socket", typ)
+		}
+	}
+}
+
+func BenchmarkPushPull(b *testing.B) {
+	for _, transport := range pipelineDrivers() {
+		for _, size := range []int{64, 64 << 10, 1 << 20, 10 << 20} {
+			b.Run(fmt.Sprintf("transport=%s/size=%d", transport, size), func(b *testing.B) {
+				port, err := getTCPPort()
+				if err != nil {
+					b.Fatal(err)
+				}
+				drv, err := mq.Open(transport)
+				if err != nil {
+					b.Fatal(err)
+				}
+				pull, err := drv.NewSocket(mq.Pull)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer pull.Close()
+				if transport == "nanomsg" {
+					// mangos drops the messages larger than 1MB by default.
+					err = pull.SetOption(mangos.OptionMaxRecvSize, 2*size)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err = pull.Listen("tcp://*:" + port)
+				if err != nil {
+					b.Fatal(err)
+				}
+				push, err := drv.NewSocket(mq.Push)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer push.Close()
+				err = push.Dial("tcp://localhost:" + port)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				msg := make([]byte, size)
+				errc := make(chan error, 1)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				go func() {
+					for i := 0; i < b.N; i++ {
+						err := push.Send(msg)
+						if err != nil {
+							errc <- err
+							return
+						}
+					}
+					errc <- nil
+				}()
+				for i := 0; i < b.N; i++ {
+					_, err := pull.Recv()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err = <-errc
+				if err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkShmemMessage measures the zero-copy exchange of messages of the
+// shmem driver, to be compared with BenchmarkPushPull.
+func BenchmarkShmemMessage(b *testing.B) {
+	const session = "fer-mq-bench"
+	defer shmem.Cleanup(session)
+
+	for _, size := range []int{64, 64 << 10, 1 << 20, 10 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			port, err := getTCPPort()
+			if err != nil {
+				b.Fatal(err)
+			}
+			drv, err := mq.Open("shmem")
+			if err != nil {
+				b.Fatal(err)
+			}
+			newSocket := func(typ mq.SocketType) shmem.Socket {
+				sck, err := drv.NewSocket(typ)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = sck.SetOption(shmem.OptionSession, session)
+				if err != nil {
+					b.Fatal(err)
+				}
+				return sck.(shmem.Socket)
+			}
+			pull := newSocket(mq.Pull)
+			defer pull.Close()
+			err = pull.Listen("tcp://*:" + port)
+			if err != nil {
+				b.Fatal(err)
+			}
+			push := newSocket(mq.Push)
+			defer push.Close()
+			err = push.Dial("tcp://localhost:" + port)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			errc := make(chan error, 1)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					msg, err := push.Alloc(size)
+					if err == nil {
+						err = push.SendMessage(msg)
+					}
+					if err != nil {
+						errc <- err
+						return
+					}
+				}
+				errc <- nil
+			}()
+			for i := 0; i < b.N; i++ {
+				msg, err := pull.RecvMessage()
+				if err != nil {
+					b.Fatal(err)
+				}
+				msg.Release()
+			}
+			err = <-errc
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFrameParts(t *testing.T) {
+	for _, parts := range [][][]byte{
+		nil,
+		{{}},
+		{[]byte("header")},
+		{[]byte("header"), []byte("payload-1"), {}, []byte("payload-3")},
+	} {
+		got, err := mq.UnframeParts(mq.FrameParts(parts))
+		if err != nil {
+			t.Fatalf("could not unframe %q: %v", parts, err)
+		}
+		if !equalParts(got, parts) {
+			t.Fatalf("round trip failed: got=%q want=%q", got, parts)
+		}
+	}
+
+	got, err := mq.UnframeParts([]byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("plain")}; !equalParts(got, want) {
+		t.Fatalf("invalid plain message: got=%q want=%q", got, want)
+	}
+
+	raw := mq.FrameParts([][]byte{[]byte("header"), []byte("payload")})
+	for _, n := range []int{1, 5, len(raw) - 10} {
+		_, err = mq.UnframeParts(raw[:len(raw)-n])
+		if err == nil {
+			t.Fatalf("expected an error unframing a truncated message (n=%d)", n)
+		}
+	}
+	_, err = mq.UnframeParts(append(raw[:len(raw):len(raw)], 'x'))
+	if err == nil {
+		t.Fatalf("expected an error unframing a message with trailing bytes")
+	}
+}
+
+func equalParts(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// partsMagic marks the payload of a multipart message framed by FrameParts.
+var partsMagic = []byte("FER\x00MP\x00\x01")
+
+// FrameParts encodes the parts of a multipart message into a single payload.
+// FrameParts is meant to be used by drivers without native support for
+// multipart messages.
+//
+// The payload is made of a magic header, followed by the number of parts and
+// by each part, prefixed with its length.
+// All integers are encoded as big-endian uint32.
+//
+// A single-part payload starting with the magic header can not be told apart
+// from a framed multipart message. Drivers should thus mark multipart messages
+// in their transport, and only decode the payloads so marked. Drivers that
+// can not mark them (e.g. "nanomsg") receive such single-part payloads as
+// multipart messages, and filter their subscriptions on their first part.
+func FrameParts(parts [][]byte) []byte {
+	n := len(partsMagic) + 4
+	for _, part := range parts {
+		n += 4 + len(part)
+	}
+	buf := make([]byte, n)
+	i := copy(buf, partsMagic)
+	binary.BigEndian.PutUint32(buf[i:], uint32(len(parts)))
+	i += 4
+	for _, part := range parts {
+		binary.BigEndian.PutUint32(buf[i:], uint32(len(part)))
+		i += 4
+		i += copy(buf[i:], part)
+	}
+	return buf
+}
+
+// UnframeParts decodes a payload encoded with FrameParts.
+// Payloads that have not been encoded with FrameParts are returned as a
+// single part.
+func UnframeParts(data []byte) ([][]byte, error) {
+	if !bytes.HasPrefix(data, partsMagic) {
+		return [][]byte{data}, nil
+	}
+	buf := data[len(partsMagic):]
+	if len(buf) < 4 {
+		return nil, xerrors.Errorf("mq: invalid multipart message (missing number of parts)")
+	}
+	n := int(binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	if n > len(buf)/4 {
+		return nil, xerrors.Errorf("mq: invalid multipart message (parts=%d, size=%d)", n, len(data))
+	}
+	parts := make([][]byte, n)
+	for i := range parts {
+		if len(buf) < 4 {
+			return nil, xerrors.Errorf("mq: invalid multipart message (missing length of part %d)", i)
+		}
+		sz := int(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+		if sz > len(buf) {
+			return nil, xerrors.Errorf("mq: invalid multipart message (part %d: size=%d, remaining=%d)", i, sz, len(buf))
+		}
+		parts[i] = buf[:sz:sz]
+		buf = buf[sz:]
+	}
+	if len(buf) != 0 {
+		return nil, xerrors.Errorf("mq: invalid multipart message (%d trailing bytes)", len(buf))
+	}
+	return parts, nil
+}
@@ -4,9 +4,23 @@
 
 // Package nanomsg implements the mq.Driver interface and allows
 // to use mq.Sockets via nanomsg sockets.
+//
+// Dealer, Router, XPub and XSub sockets are implemented with raw-mode req,
+// rep, pub and sub sockets:
+//  - dealer sockets send requests asynchronously, without waiting for the
+//    replies to previous requests,
+//  - router sockets prefix the messages they receive with the backtrace
+//    of the request, which identifies the requesting peer, and route the
+//    messages they send with their first part,
+//  - nanomsg does not forward subscriptions: xpub sockets can not receive
+//    them and xsub sockets can not send them.
 package nanomsg // import "github.com/alice-go/fer/mq/nanomsg"
 
 import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
 	"github.com/alice-go/fer/mq"
 	"golang.org/x/xerrors"
 	"nanomsg.org/go-mangos"
@@ -17,7 +31,10 @@ import (
 	"nanomsg.org/go-mangos/protocol/push"
 	"nanomsg.org/go-mangos/protocol/rep"
 	"nanomsg.org/go-mangos/protocol/req"
+	"nanomsg.org/go-mangos/protocol/respondent"
+	"nanomsg.org/go-mangos/protocol/star"
 	"nanomsg.org/go-mangos/protocol/sub"
+	"nanomsg.org/go-mangos/protocol/surveyor"
 	"nanomsg.org/go-mangos/transport/inproc"
 	"nanomsg.org/go-mangos/transport/ipc"
 	"nanomsg.org/go-mangos/transport/tcp"
@@ -26,12 +43,223 @@ import (
 type socket struct {
 	mangos.Socket
 	typ mq.SocketType
+
+	// keepAlive holds the TCP keep-alive setting of the socket's
+	// connections, applied when the socket is connected.
+	keepAlive *bool
+
+	// topics holds the subscriptions of sub sockets.
+	// Subscriptions are matched against the first part of messages, as
+	// with ZeroMQ, so they are filtered here rather than by mangos (which
+	// would match them against the framing of multipart messages.)
+	mu     sync.RWMutex
+	topics map[string]struct{}
+
+	reqID uint32 // reqID is the identifier of the last request of a dealer socket.
 }
 
-func (s socket) Type() mq.SocketType {
+func (s *socket) Type() mq.SocketType {
 	return s.typ
 }
 
+// GetOption retrieves an option of the socket.
+// Options not defined by the mq package are forwarded to mangos.
+func (s *socket) GetOption(name string) (interface{}, error) {
+	if name == mq.OptionTCPKeepAlive {
+		if s.keepAlive == nil {
+			return true, nil // mangos' default.
+		}
+		return *s.keepAlive, nil
+	}
+	v, err := s.Socket.GetOption(option(name))
+	if err == mangos.ErrBadOption {
+		return nil, &mq.UnsupportedOptionError{Driver: "nanomsg", Option: name}
+	}
+	return v, err
+}
+
+// SetOption sets an option of the socket.
+// Options not defined by the mq package are forwarded to mangos.
+func (s *socket) SetOption(name string, value interface{}) error {
+	v, err := mq.OptionValue(name, value)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case mq.OptionTCPKeepAlive:
+		keepAlive := v.(bool)
+		s.keepAlive = &keepAlive
+		return nil
+	case mq.OptionSubscribe, mq.OptionUnsubscribe:
+		if s.topics == nil {
+			return &mq.UnsupportedOptionError{Driver: "nanomsg", Option: name}
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if name == mq.OptionSubscribe {
+			s.topics[v.(string)] = struct{}{}
+		} else {
+			delete(s.topics, v.(string))
+		}
+		return nil
+	}
+	err = s.Socket.SetOption(option(name), v)
+	if err == mangos.ErrBadOption {
+		return &mq.UnsupportedOptionError{Driver: "nanomsg", Option: name}
+	}
+	return err
+}
+
+// option returns the mangos name of an option.
+func option(name string) string {
+	switch name {
+	case mq.OptionSendHWM:
+		return mangos.OptionWriteQLen
+	case mq.OptionRecvHWM:
+		return mangos.OptionReadQLen
+	case mq.OptionLinger:
+		return mangos.OptionLinger
+	case mq.OptionSendTimeout:
+		return mangos.OptionSendDeadline
+	case mq.OptionRecvTimeout:
+		return mangos.OptionRecvDeadline
+	case mq.OptionReconnectInterval:
+		return mangos.OptionReconnectTime
+	}
+	return name
+}
+
+func (s *socket) Listen(addr string) error {
+	return s.ListenOptions(addr, s.options(addr))
+}
+
+func (s *socket) Dial(addr string) error {
+	return s.DialOptions(addr, s.options(addr))
+}
+
+// options returns the transport options of a connection to addr.
+func (s *socket) options(addr string) map[string]interface{} {
+	if s.keepAlive == nil || !strings.HasPrefix(addr, "tcp://") {
+		return nil
+	}
+	return map[string]interface{}{mangos.OptionKeepAlive: *s.keepAlive}
+}
+
+// Send sends a message.
+// Messages sent through router sockets are routed with their first part.
+func (s *socket) Send(data []byte) error {
+	switch s.typ {
+	case mq.Dealer:
+		return s.sendMsg(s.nextReqID(), data)
+	case mq.Router:
+		parts, err := mq.UnframeParts(data)
+		if err != nil {
+			return err
+		}
+		return s.SendMulti(parts)
+	case mq.XSub:
+		return xerrors.Errorf("mq/nanomsg: xsub sockets can not send subscriptions")
+	}
+	return s.Socket.Send(data)
+}
+
+// SendMulti sends a multipart message, framed with mq.FrameParts.
+// Messages sent through router sockets are routed with their first part.
+func (s *socket) SendMulti(parts [][]byte) error {
+	if s.typ != mq.Router {
+		return s.Send(mq.FrameParts(parts))
+	}
+	if len(parts) == 0 || len(parts[0]) == 0 {
+		return xerrors.Errorf("mq/nanomsg: router message without peer backtrace")
+	}
+	var body []byte
+	switch len(parts) {
+	case 2:
+		body = parts[1]
+	default:
+		body = mq.FrameParts(parts[1:])
+	}
+	return s.sendMsg(parts[0], body)
+}
+
+// sendMsg sends a message with the provided header through a raw-mode socket.
+func (s *socket) sendMsg(header, body []byte) error {
+	msg := mangos.NewMessage(len(body))
+	msg.Header = append(msg.Header, header...)
+	msg.Body = append(msg.Body, body...)
+	return s.Socket.SendMsg(msg)
+}
+
+// nextReqID returns the header of the next request of a dealer socket.
+// Request identifiers have their high bit set, as the rep protocol uses it
+// to find the end of the backtrace.
+func (s *socket) nextReqID() []byte {
+	id := atomic.AddUint32(&s.reqID, 1) | 0x80000000
+	return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
+// Recv receives a message.
+// Multipart messages are received with their mq.FrameParts framing.
+func (s *socket) Recv() ([]byte, error) {
+	data, _, err := s.recv()
+	return data, err
+}
+
+// RecvMulti receives a multipart message, framed with mq.FrameParts.
+func (s *socket) RecvMulti() ([][]byte, error) {
+	_, parts, err := s.recv()
+	return parts, err
+}
+
+// recv receives the next message matching the subscriptions of the socket,
+// together with its parts.
+//
+// Messages received by router sockets are prefixed with the backtrace of the
+// request.
+func (s *socket) recv() ([]byte, [][]byte, error) {
+	if s.typ == mq.XPub {
+		return nil, nil, xerrors.Errorf("mq/nanomsg: xpub sockets can not receive subscriptions")
+	}
+	for {
+		msg, err := s.Socket.RecvMsg()
+		if err != nil {
+			return nil, nil, err
+		}
+		data := msg.Body
+		parts, err := mq.UnframeParts(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.typ == mq.Router {
+			parts = append([][]byte{msg.Header}, parts...)
+			data = mq.FrameParts(parts)
+		}
+		var first []byte
+		if len(parts) > 0 {
+			first = parts[0]
+		}
+		if s.subscribed(first) {
+			return data, parts, nil
+		}
+	}
+}
+
+// subscribed returns whether a message whose first part is v matches the
+// subscriptions of the socket.
+func (s *socket) subscribed(v []byte) bool {
+	if s.topics == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for topic := range s.topics {
+		if strings.HasPrefix(string(v), topic) {
+			return true
+		}
+	}
+	return false
+}
+
 type driver struct{}
 
 func (driver) Name() string {
@@ -62,6 +290,12 @@ func (driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
 		sck, err = pair.NewSocket()
 	case mq.Bus:
 		sck, err = bus.NewSocket()
+	case mq.Surveyor:
+		sck, err = surveyor.NewSocket()
+	case mq.Respondent:
+		sck, err = respondent.NewSocket()
+	case mq.Star:
+		sck, err = star.NewSocket()
 	default:
 		return nil, xerrors.Errorf("fer/nanomsg: invalid socket type %v (%d)", typ, int(typ))
 	}
@@ -70,10 +304,25 @@ func (driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
 		return nil, err
 	}
 
+	switch typ {
+	case mq.XSub, mq.XPub, mq.Dealer, mq.Router:
+		err = sck.SetOption(mangos.OptionRaw, true)
+		if err != nil {
+			sck.Close()
+			return nil, xerrors.Errorf("fer/nanomsg: could not enable raw mode of %v socket: %w", typ, err)
+		}
+	}
+
 	sck.AddTransport(ipc.NewTransport())
 	sck.AddTransport(tcp.NewTransport())
 	sck.AddTransport(inproc.NewTransport())
-	return socket{Socket: sck, typ: typ}, err
+
+	o := &socket{Socket: sck, typ: typ}
+	switch typ {
+	case mq.Sub, mq.XSub:
+		o.topics = map[string]struct{}{"": {}}
+	}
+	return o, nil
 }
 
 func init() {
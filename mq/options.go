@@ -0,0 +1,127 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// List of socket options common to all drivers.
+// Drivers may not support all of them.
+const (
+	OptionSendHWM           = "send-hwm"           // high-water mark of the outbound queue, in messages (int).
+	OptionRecvHWM           = "recv-hwm"           // high-water mark of the inbound queue, in messages (int).
+	OptionLinger            = "linger"             // time pending messages are kept after Close (time.Duration).
+	OptionSendTimeout       = "send-timeout"       // maximum time a Send may block (time.Duration).
+	OptionRecvTimeout       = "recv-timeout"       // maximum time a Recv may block (time.Duration).
+	OptionReconnectInterval = "reconnect-interval" // time between two reconnection attempts (time.Duration).
+	OptionSubscribe         = "subscribe"          // subscribes a sub socket to a topic (string).
+	OptionUnsubscribe       = "unsubscribe"        // unsubscribes a sub socket from a topic (string).
+	OptionTCPKeepAlive      = "tcp-keepalive"      // enables TCP keep-alive probes (bool).
+	OptionTLSCert           = "tls-cert"           // path of the PEM certificate of the socket (string).
+	OptionTLSKey            = "tls-key"            // path of the PEM private key of the socket (string).
+	OptionTLSCA             = "tls-ca"             // path of the PEM certificates of the trusted authorities (string).
+	OptionPlainServer       = "plain-server"       // authenticates the peers of the socket with the PLAIN mechanism (bool).
+	OptionPlainUsername     = "plain-username"     // PLAIN user name of the socket (string).
+	OptionPlainPassword     = "plain-password"     // PLAIN password of the socket (string).
+	OptionAllow             = "allow"              // IP addresses or networks of the peers allowed to connect to the socket ([]string).
+)
+
+// UnsupportedOptionError is returned when a socket option is not supported by
+// a driver or by a type of socket.
+type UnsupportedOptionError struct {
+	Driver string // Driver is the name of the driver.
+	Option string // Option is the name of the option.
+}
+
+func (err *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("mq/%s: unsupported option %q", err.Driver, err.Option)
+}
+
+// OptionValue converts v to the type of the value of the named common option,
+// so values decoded from JSON can be used with Socket.SetOption:
+//  - integer options accept integral numbers,
+//  - duration options accept durations, strings (e.g. "100ms") and numbers
+//    of milliseconds,
+//  - topic options accept strings and byte slices,
+//  - TLS options and PLAIN credentials accept strings,
+//  - the allow option accepts lists of strings.
+// Values of options not listed by the mq package are returned unchanged.
+func OptionValue(name string, v interface{}) (interface{}, error) {
+	var (
+		o  interface{}
+		ok bool
+	)
+	switch name {
+	case OptionSendHWM, OptionRecvHWM:
+		var n int
+		n, ok = intValue(v)
+		ok = ok && n >= 0
+		o = n
+	case OptionLinger, OptionSendTimeout, OptionRecvTimeout, OptionReconnectInterval:
+		switch v := v.(type) {
+		case time.Duration:
+			o, ok = v, true
+		case string:
+			d, err := time.ParseDuration(v)
+			o, ok = d, err == nil
+		default:
+			var n int
+			n, ok = intValue(v)
+			o = time.Duration(n) * time.Millisecond
+		}
+	case OptionSubscribe, OptionUnsubscribe:
+		switch v := v.(type) {
+		case string:
+			o, ok = v, true
+		case []byte:
+			o, ok = string(v), true
+		}
+	case OptionTCPKeepAlive, OptionPlainServer:
+		o, ok = v.(bool)
+	case OptionTLSCert, OptionTLSKey, OptionTLSCA, OptionPlainUsername, OptionPlainPassword:
+		o, ok = v.(string)
+	case OptionAllow:
+		switch v := v.(type) {
+		case []string:
+			o, ok = v, true
+		case []interface{}:
+			strs := make([]string, len(v))
+			ok = true
+			for i, e := range v {
+				strs[i], ok = e.(string)
+				if !ok {
+					break
+				}
+			}
+			o = strs
+		}
+	default:
+		return v, nil
+	}
+	if !ok {
+		return nil, xerrors.Errorf("mq: invalid value %v (type %T) for option %q", v, v, name)
+	}
+	return o, nil
+}
+
+func intValue(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, false
+		}
+		return int(v), true
+	}
+	return 0, false
+}
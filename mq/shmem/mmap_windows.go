@@ -0,0 +1,19 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shmem
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, xerrors.Errorf("mq/shmem: shared memory segments not supported on windows")
+}
+
+func munmap(buf []byte) error {
+	return nil
+}
@@ -0,0 +1,303 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shmem
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// dir is the directory holding the shared memory segments.
+var dir = func() string {
+	const shm = "/dev/shm"
+	if fi, err := os.Stat(shm); err == nil && fi.IsDir() {
+		return shm
+	}
+	return os.TempDir()
+}()
+
+// Layout of the blocks of a segment.
+// Each block starts with a header made of its state word (uint64) and its
+// size (uint64, header included), followed by the payload.
+// The state word holds the sequence number of the block in its upper 32 bits
+// and its state in its lower 32 bits, so a descriptor only acts on the block
+// it was issued for.
+// Blocks are aligned on blockAlign bytes.
+const (
+	blockHeader = 16
+	blockAlign  = 16
+)
+
+// States of a block.
+const (
+	blockUsed     uint32 = 1 // the block holds a payload not yet received.
+	blockClaimed  uint32 = 2 // the payload of the block is being received.
+	blockReleased uint32 = 3 // the payload of the block has been received.
+	blockReserved uint32 = 4 // the block is being filled by its sender.
+)
+
+// segment is a shared memory segment, mapped in memory.
+//
+// Segments are written by a single sending socket, which allocates the blocks
+// holding the payloads.
+// Receivers claim the blocks, from any process, and release them once they
+// are done with the payloads.
+// Blocks are freed independently of each other, so a slow receiver only
+// holds the blocks of the payloads it did not receive yet.
+type segment struct {
+	name string
+	buf  []byte
+
+	// allocator, only used by the owner of the segment.
+	free   []span        // free holds the free spans of the segment, by offset.
+	blocks map[int]block // blocks holds the allocated blocks, by offset.
+	used   int           // used is the number of allocated bytes.
+	seq    uint32        // seq is the sequence number of the last allocated block.
+}
+
+// span is a range of bytes of a segment.
+type span struct {
+	off  int
+	size int
+}
+
+// block describes an allocated block.
+type block struct {
+	size    int
+	seq     uint32
+	expires time.Time // expires is the end of the lease of the block.
+}
+
+// prefix returns the prefix of the names of the segments of a session.
+func prefix(session string) string {
+	return "fer-" + session + "-"
+}
+
+// Cleanup removes the segments of the provided session left behind by
+// processes that did not close their sockets (e.g. because they crashed.)
+// Cleanup must not be called while processes of the session are running.
+func Cleanup(session string) error {
+	names, err := filepath.Glob(filepath.Join(dir, prefix(session)+"*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = os.Remove(name)
+		if err != nil {
+			return xerrors.Errorf("mq/shmem: could not remove segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// createSegment creates and maps a new segment of the provided size.
+func createSegment(name string, size int) (*segment, error) {
+	size = align(size)
+	if size < 2*blockHeader {
+		return nil, xerrors.Errorf("mq/shmem: invalid segment size %d", size)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, xerrors.Errorf("mq/shmem: could not create segment: %w", err)
+	}
+	defer f.Close()
+
+	err = f.Truncate(int64(size))
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, xerrors.Errorf("mq/shmem: could not resize segment %q: %w", name, err)
+	}
+	buf, err := mmap(f, size)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, xerrors.Errorf("mq/shmem: could not map segment %q: %w", name, err)
+	}
+	return &segment{
+		name:   name,
+		buf:    buf,
+		free:   []span{{0, size}},
+		blocks: make(map[int]block),
+	}, nil
+}
+
+// openSegment maps an existing segment of the provided session.
+func openSegment(session, name string) (*segment, error) {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, prefix(session)) {
+		return nil, xerrors.Errorf("mq/shmem: invalid segment name %q for session %q", name, session)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR, 0)
+	if err != nil {
+		return nil, xerrors.Errorf("mq/shmem: could not open segment: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, xerrors.Errorf("mq/shmem: could not stat segment %q: %w", name, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, xerrors.Errorf("mq/shmem: invalid segment %q", name)
+	}
+	buf, err := mmap(f, int(fi.Size()))
+	if err != nil {
+		return nil, xerrors.Errorf("mq/shmem: could not map segment %q: %w", name, err)
+	}
+	return &segment{name: name, buf: buf}, nil
+}
+
+// unmap unmaps the segment.
+func (seg *segment) unmap() error {
+	buf := seg.buf
+	seg.buf = nil
+	return munmap(buf)
+}
+
+// remove unmaps the segment and removes it from the file system.
+// Processes that have mapped the segment may still access it.
+func (seg *segment) remove() error {
+	err := seg.unmap()
+	if e := os.Remove(filepath.Join(dir, seg.name)); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (seg *segment) state(off int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&seg.buf[off]))
+}
+
+func (seg *segment) size(off int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&seg.buf[off+8]))
+}
+
+func word(seq, state uint32) uint64 {
+	return uint64(seq)<<32 | uint64(state)
+}
+
+// alloc reserves a block for a payload of n bytes, to be filled by the sender
+// and committed, and returns its offset and sequence number.
+// alloc returns false if the segment has not enough free space.
+func (seg *segment) alloc(n int) (int, uint32, bool) {
+	need := align(blockHeader + n)
+	for i, sp := range seg.free {
+		if sp.size < need {
+			continue
+		}
+		if sp.size == need {
+			seg.free = append(seg.free[:i], seg.free[i+1:]...)
+		} else {
+			seg.free[i] = span{sp.off + need, sp.size - need}
+		}
+		seg.seq++
+		seg.blocks[sp.off] = block{size: need, seq: seg.seq}
+		seg.used += need
+		*seg.size(sp.off) = uint64(need)
+		atomic.StoreUint64(seg.state(sp.off), word(seg.seq, blockReserved))
+		return sp.off, seg.seq, true
+	}
+	return 0, 0, false
+}
+
+// commit marks the reserved block at off as holding a payload not yet
+// received, leased until expires.
+func (seg *segment) commit(off int, expires time.Time) {
+	b := seg.blocks[off]
+	b.expires = expires
+	seg.blocks[off] = b
+	atomic.StoreUint64(seg.state(off), word(b.seq, blockUsed))
+}
+
+// expire ends the lease of all the blocks of the segment.
+func (seg *segment) expire() {
+	for off, b := range seg.blocks {
+		b.expires = time.Time{}
+		seg.blocks[off] = b
+	}
+}
+
+// reclaim frees the blocks released by receivers.
+// Blocks whose lease ended before now and that no receiver claimed are freed
+// as well, unless now is zero.
+func (seg *segment) reclaim(now time.Time) {
+	for off, b := range seg.blocks {
+		state := seg.state(off)
+		switch atomic.LoadUint64(state) {
+		case word(b.seq, blockReleased):
+		case word(b.seq, blockUsed):
+			if now.IsZero() || now.Before(b.expires) {
+				continue
+			}
+			if !atomic.CompareAndSwapUint64(state, word(b.seq, blockUsed), word(b.seq, blockReleased)) {
+				continue
+			}
+		default:
+			continue
+		}
+		delete(seg.blocks, off)
+		seg.used -= b.size
+		seg.insert(span{off, b.size})
+	}
+}
+
+// insert returns a span to the free spans of the segment, merging it with
+// its neighbours.
+func (seg *segment) insert(sp span) {
+	i := sort.Search(len(seg.free), func(i int) bool { return seg.free[i].off > sp.off })
+	if i > 0 && seg.free[i-1].off+seg.free[i-1].size == sp.off {
+		i--
+		sp = span{seg.free[i].off, seg.free[i].size + sp.size}
+		seg.free = append(seg.free[:i], seg.free[i+1:]...)
+	}
+	if i < len(seg.free) && sp.off+sp.size == seg.free[i].off {
+		sp.size += seg.free[i].size
+		seg.free = append(seg.free[:i], seg.free[i+1:]...)
+	}
+	seg.free = append(seg.free, span{})
+	copy(seg.free[i+1:], seg.free[i:])
+	seg.free[i] = sp
+}
+
+// block checks that off is the offset of a block of the segment.
+func (seg *segment) block(off int) error {
+	if off < 0 || off%blockAlign != 0 || off+blockHeader > len(seg.buf) {
+		return xerrors.Errorf("mq/shmem: invalid block (offset=%d) in segment %q", off, seg.name)
+	}
+	return nil
+}
+
+// payload returns the payload of n bytes held by the block at off.
+func (seg *segment) payload(off, n int) ([]byte, error) {
+	if err := seg.block(off); err != nil {
+		return nil, err
+	}
+	if n < 0 || off+blockHeader+n > len(seg.buf) {
+		return nil, xerrors.Errorf("mq/shmem: invalid block (offset=%d, size=%d) in segment %q", off, n, seg.name)
+	}
+	beg := off + blockHeader
+	return seg.buf[beg : beg+n : beg+n], nil
+}
+
+// claim marks the block at off, with the provided sequence number, as being
+// received.
+// claim returns false if the block was reclaimed by its owner.
+func (seg *segment) claim(off int, seq uint32) bool {
+	return atomic.CompareAndSwapUint64(seg.state(off), word(seq, blockUsed), word(seq, blockClaimed))
+}
+
+// release marks the claimed (or reserved) block at off as received.
+func (seg *segment) release(off int, seq uint32) {
+	atomic.StoreUint64(seg.state(off), word(seq, blockReleased))
+}
+
+func align(n int) int {
+	return (n + blockAlign - 1) &^ (blockAlign - 1)
+}
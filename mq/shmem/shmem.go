@@ -0,0 +1,805 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package shmem implements the mq.Driver interface and allows
+// to use mq.Sockets exchanging data through shared memory, between the
+// processes of a single host.
+//
+// Payloads are written to a shared memory segment (a file in /dev/shm,
+// mapped in memory) owned by the sending socket, and only small descriptors
+// of the payloads are exchanged through a control socket connected to the
+// addresses of the socket with the nanomsg driver.
+// Receivers map the segments of their peers and release the blocks of the
+// payloads they received, which are then reused by the sender.
+// Receivers only map the segments of their own session (OptionSession).
+//
+// The sockets of the driver implement Socket, which exchanges messages
+// without copying them: senders fill the blocks of their segment in place
+// (Socket.Alloc and Socket.SendMessage) and receivers read them from the
+// mapped segment of their peer (Socket.RecvMessage), until they release them
+// (Message.Release).
+// The methods of mq.Socket copy each payload once into the segment and once
+// out of it, so the messages they receive stay valid after their blocks are
+// reused.
+//
+// The blocks of payloads whose descriptors are not received, e.g. because
+// the receiving peer went away, are reclaimed by the sender once the segment
+// is full and their lease (OptionLease) is over, or when Socket.Reclaim is
+// called.
+// Closing sockets release the blocks of the descriptors they did not
+// receive.
+//
+// Messages of pub, xpub, bus, surveyor and star sockets, which may be received
+// by any number of peers, are sent inline through the control socket.
+//
+// The segments are named after the session of the sockets (OptionSession)
+// and their size is set with OptionSegmentSize.
+package shmem // import "github.com/alice-go/fer/mq/shmem"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	_ "github.com/alice-go/fer/mq/nanomsg" // control sockets.
+	"golang.org/x/xerrors"
+)
+
+// Options of the shmem sockets.
+const (
+	OptionSegmentSize = "shm-segment-size" // size of the segment of the socket, in bytes (int).
+	OptionSession     = "shm-session"      // name of the session of the socket (string).
+	OptionLease       = "shm-lease"        // time after which the payloads not received may be reclaimed (time.Duration).
+)
+
+// Defaults of the shmem options.
+const (
+	DefaultSegmentSize = 64 << 20
+	DefaultSession     = "default"
+	DefaultLease       = 10 * time.Second
+
+	// defaultLinger is the default time a closing socket waits for the
+	// payloads it sent to be received.
+	defaultLinger = time.Second
+)
+
+// Kinds of the messages exchanged through the control socket.
+const (
+	kindInline     = 'I' // payload framed with mq.FrameParts.
+	kindDescriptor = 'D' // descriptor of a payload held by a segment.
+)
+
+var (
+	errClosed  = xerrors.New("mq/shmem: socket closed")
+	errTimeout = xerrors.New("mq/shmem: timeout")
+	errExpired = xerrors.New("mq/shmem: payload reclaimed before it was received")
+
+	errBacktrace = xerrors.New("mq/shmem: router message without peer backtrace")
+)
+
+var ids uint64
+
+// Socket is a shmem socket.
+// The sockets created by the shmem driver implement Socket.
+type Socket interface {
+	mq.Socket
+
+	// Alloc allocates a message made of parts of the provided sizes, held
+	// by the segment of the socket, to be filled in place and sent with
+	// SendMessage.
+	// Messages of router sockets are prefixed with the identity of the peer,
+	// as with SendMulti.
+	// Messages of pub, xpub, bus, surveyor and star sockets are not held by
+	// the segment.
+	Alloc(sizes ...int) (*Message, error)
+
+	// SendMessage sends a message allocated by the socket.
+	SendMessage(msg *Message) error
+
+	// RecvMessage receives a message, whose parts are slices of the segment
+	// of the sending peer.
+	// Messages of router sockets are prefixed with the envelope of the
+	// control message, as with RecvMulti.
+	RecvMessage() (*Message, error)
+
+	// Reclaim reclaims the blocks of the payloads sent by the socket that
+	// were not received yet, regardless of their lease.
+	Reclaim()
+}
+
+// Message is a multipart message held by a shared memory segment.
+//
+// The parts of a message may be modified in place, but not resized or
+// replaced.
+// Messages allocated by a socket must be sent or released before the socket
+// is closed.
+// Received messages must be released once the receiver is done with them, so
+// their sender may reuse their block, and before the receiving socket is
+// closed.
+type Message struct {
+	Parts [][]byte
+
+	sck   *socket
+	seg   *segment // seg is the segment holding the payload, if any.
+	off   int      // off is the offset of the block of the payload.
+	seq   uint32   // seq is the sequence number of the block of the payload.
+	sizes []int    // sizes are the sizes of the parts of the payload.
+	sent  bool
+}
+
+// Release releases the block of a received message, or of an allocated
+// message that was not sent.
+// The parts of the message must not be used after Release.
+func (msg *Message) Release() {
+	if msg.seg == nil || msg.sent {
+		return
+	}
+	s := msg.sck
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.seg.buf != nil {
+		msg.seg.release(msg.off, msg.seq)
+	}
+	msg.seg = nil
+}
+
+type socket struct {
+	ctl mq.Socket // ctl is the control socket carrying the descriptors.
+	typ mq.SocketType
+
+	mu      sync.RWMutex
+	closed  bool
+	size    int
+	session string
+	timeout time.Duration // timeout is the send timeout.
+	linger  time.Duration
+	lease   time.Duration
+	seg     *segment // seg is the segment of the socket, created on the first send.
+	peers   map[string]*segment
+
+	topics map[string]struct{} // topics holds the subscriptions of sub sockets.
+}
+
+func (s *socket) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	seg, linger := s.seg, s.linger
+	s.mu.Unlock()
+
+	if seg != nil {
+		// wait for the payloads in flight to be received, so their
+		// descriptors are not left dangling.
+		deadline := time.Now().Add(linger)
+		for s.inFlight(seg) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.drain(linger)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.ctl.Close()
+	if s.seg != nil {
+		if e := s.seg.remove(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, seg := range s.peers {
+		if e := seg.unmap(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.peers = nil
+	return err
+}
+
+// inFlight returns whether payloads of the segment are still to be received.
+func (s *socket) inFlight(seg *segment) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg.reclaim(time.Time{})
+	return seg.used > 0
+}
+
+// drain receives the descriptors queued in the control socket of a closing
+// socket, for up to linger, and releases their blocks.
+func (s *socket) drain(linger time.Duration) {
+	switch s.typ {
+	case mq.Push, mq.Pub:
+		return
+	}
+	err := s.ctl.SetOption(mq.OptionRecvTimeout, time.Millisecond)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(linger)
+	for time.Now().Before(deadline) {
+		_, raw, err := s.recv()
+		if err != nil {
+			return
+		}
+		msg, err := s.decode(raw)
+		if err == nil {
+			msg.Release()
+		}
+	}
+}
+
+func (s *socket) Send(data []byte) error {
+	return s.SendMulti([][]byte{data})
+}
+
+// Recv receives a message.
+// Multipart messages are received framed with mq.FrameParts.
+func (s *socket) Recv() ([]byte, error) {
+	parts, err := s.RecvMulti()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return mq.FrameParts(parts), nil
+}
+
+func (s *socket) SendMulti(parts [][]byte) error {
+	if s.inline() {
+		var env [][]byte
+		if s.typ == mq.Router {
+			if len(parts) == 0 {
+				return errBacktrace
+			}
+			env, parts = parts[:1:1], parts[1:]
+		}
+		return s.send(env, append([]byte{kindInline}, mq.FrameParts(parts)...))
+	}
+
+	sizes := make([]int, len(parts))
+	for i, part := range parts {
+		sizes[i] = len(part)
+	}
+	msg, err := s.Alloc(sizes...)
+	if err != nil {
+		return err
+	}
+	for i, part := range parts {
+		copy(msg.Parts[i], part)
+	}
+	return s.SendMessage(msg)
+}
+
+// inline returns whether the messages of the socket are sent inline through
+// the control socket.
+func (s *socket) inline() bool {
+	switch s.typ {
+	case mq.Pub, mq.XPub, mq.Bus, mq.Surveyor, mq.Star:
+		return true
+	}
+	return false
+}
+
+func (s *socket) Alloc(sizes ...int) (*Message, error) {
+	msg := &Message{sck: s, Parts: make([][]byte, len(sizes))}
+	parts := msg.Parts
+	if s.typ == mq.Router {
+		if len(sizes) == 0 {
+			return nil, errBacktrace
+		}
+		parts[0] = make([]byte, sizes[0])
+		parts, sizes = parts[1:], sizes[1:]
+	}
+
+	n := 0
+	for _, sz := range sizes {
+		if sz < 0 {
+			return nil, xerrors.Errorf("mq/shmem: invalid part size %d", sz)
+		}
+		n += sz
+	}
+
+	var buf []byte
+	switch {
+	case s.inline():
+		buf = make([]byte, n)
+	default:
+		s.mu.Lock()
+		seg, off, seq, err := s.alloc(n)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		buf, _ = seg.payload(off, n)
+		s.mu.Unlock()
+		msg.seg, msg.off, msg.seq = seg, off, seq
+		msg.sizes = append([]int(nil), sizes...)
+	}
+
+	for i, sz := range sizes {
+		parts[i] = buf[:sz:sz]
+		buf = buf[sz:]
+	}
+	return msg, nil
+}
+
+func (s *socket) SendMessage(msg *Message) error {
+	if msg.sck != s || msg.sent {
+		return xerrors.Errorf("mq/shmem: message not allocated by the socket, or already sent")
+	}
+	var (
+		env   [][]byte
+		parts = msg.Parts
+	)
+	if s.typ == mq.Router {
+		env, parts = parts[:1:1], parts[1:]
+	}
+	if msg.seg == nil {
+		msg.sent = true
+		return s.send(env, append([]byte{kindInline}, mq.FrameParts(parts)...))
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+	msg.seg.commit(msg.off, time.Now().Add(s.lease))
+	msg.sent = true
+	s.mu.Unlock()
+
+	return s.send(env, descriptor(msg.seg.name, msg.off, msg.seq, msg.sizes))
+}
+
+// send sends a control message, routed with the envelope of router sockets.
+func (s *socket) send(env [][]byte, msg []byte) error {
+	if env == nil {
+		return s.ctl.Send(msg)
+	}
+	return s.ctl.SendMulti(append(env, msg))
+}
+
+// alloc allocates a block of n bytes in the segment of the socket, waiting
+// for receivers to release blocks if the segment is full.
+// alloc returns the offset and the sequence number of the block.
+// alloc is called with s.mu held.
+func (s *socket) alloc(n int) (*segment, int, uint32, error) {
+	if s.closed {
+		return nil, 0, 0, errClosed
+	}
+	if s.seg == nil {
+		name := fmt.Sprintf("%s%d-%d", prefix(s.session), os.Getpid(), atomic.AddUint64(&ids, 1))
+		seg, err := createSegment(name, s.size)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		s.seg = seg
+	}
+	if align(blockHeader+n) > len(s.seg.buf) {
+		return nil, 0, 0, xerrors.Errorf("mq/shmem: message size %d exceeds segment size %d", n, len(s.seg.buf))
+	}
+
+	var (
+		beg   = time.Now()
+		sleep = 10 * time.Microsecond
+	)
+	for {
+		s.seg.reclaim(time.Time{})
+		off, seq, ok := s.seg.alloc(n)
+		if !ok && s.lease > 0 {
+			// reclaim the blocks of the descriptors that were not received.
+			s.seg.reclaim(time.Now())
+			off, seq, ok = s.seg.alloc(n)
+		}
+		if ok {
+			return s.seg, off, seq, nil
+		}
+		if s.timeout > 0 && time.Since(beg) > s.timeout {
+			return nil, 0, 0, errTimeout
+		}
+		s.mu.Unlock()
+		time.Sleep(sleep)
+		if sleep < time.Millisecond {
+			sleep *= 2
+		}
+		s.mu.Lock()
+		if s.closed {
+			return nil, 0, 0, errClosed
+		}
+	}
+}
+
+// RecvMulti receives a multipart message.
+// Messages received by router sockets are prefixed with the envelope of the
+// control message.
+func (s *socket) RecvMulti() ([][]byte, error) {
+	msg, err := s.RecvMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msg.seg == nil {
+		return msg.Parts, nil
+	}
+
+	n := 0
+	for _, part := range msg.Parts {
+		n += len(part)
+	}
+	data := make([]byte, n)
+	parts := make([][]byte, len(msg.Parts))
+	for i, part := range msg.Parts {
+		sz := copy(data, part)
+		parts[i] = data[:sz:sz]
+		data = data[sz:]
+	}
+	msg.Release()
+	return parts, nil
+}
+
+func (s *socket) RecvMessage() (*Message, error) {
+	for {
+		env, raw, err := s.recv()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := s.decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		if env != nil {
+			msg.Parts = append(env, msg.Parts...)
+		}
+		var topic []byte
+		if len(msg.Parts) > 0 {
+			topic = msg.Parts[0]
+		}
+		if s.subscribed(topic) {
+			return msg, nil
+		}
+		msg.Release()
+	}
+}
+
+func (s *socket) Reclaim() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seg == nil || s.closed {
+		return
+	}
+	s.seg.expire()
+	s.seg.reclaim(time.Now())
+}
+
+// recv receives a control message, together with its envelope for router
+// sockets.
+func (s *socket) recv() ([][]byte, []byte, error) {
+	if s.typ != mq.Router {
+		raw, err := s.ctl.Recv()
+		return nil, raw, err
+	}
+	parts, err := s.ctl.RecvMulti()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(parts) != 2 {
+		return nil, nil, xerrors.Errorf("mq/shmem: invalid router control message (parts=%d)", len(parts))
+	}
+	return parts[:1:1], parts[1], nil
+}
+
+// decode decodes a message received from the control socket.
+// The parts of the payloads held by shared memory segments are slices of the
+// segment, and their blocks are claimed until the message is released.
+// The blocks of the descriptors received by closed sockets are released
+// right away.
+func (s *socket) decode(raw []byte) (*Message, error) {
+	if len(raw) == 0 {
+		return nil, xerrors.Errorf("mq/shmem: empty control message")
+	}
+	switch raw[0] {
+	case kindInline:
+		parts, err := mq.UnframeParts(raw[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &Message{Parts: parts, sck: s}, nil
+	case kindDescriptor:
+	default:
+		return nil, xerrors.Errorf("mq/shmem: invalid control message kind 0x%02x", raw[0])
+	}
+
+	name, off, seq, sizes, err := parseDescriptor(raw[1:])
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, sz := range sizes {
+		n += sz
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers == nil {
+		return nil, errClosed
+	}
+	seg, ok := s.peers[name]
+	if !ok {
+		seg, err = openSegment(s.session, name)
+		if err != nil {
+			return nil, err
+		}
+		s.peers[name] = seg
+	}
+	err = seg.block(off)
+	if err != nil {
+		return nil, err
+	}
+	if !seg.claim(off, seq) {
+		return nil, errExpired
+	}
+
+	buf, err := seg.payload(off, n)
+	if err == nil && s.closed {
+		err = errClosed
+	}
+	if err != nil {
+		seg.release(off, seq)
+		return nil, err
+	}
+
+	parts := make([][]byte, len(sizes))
+	for i, sz := range sizes {
+		parts[i] = buf[:sz:sz]
+		buf = buf[sz:]
+	}
+	return &Message{Parts: parts, sck: s, seg: seg, off: off, seq: seq, sizes: sizes}, nil
+}
+
+// descriptor encodes the descriptor of a payload held by the block at off of
+// the named segment, with the provided sequence number.
+//
+// A descriptor is made of its kind, the length of the name of the segment
+// (uint16) and that name, the offset (uint64) and sequence number (uint32)
+// of the block, the number of parts of the payload (uint32) followed by the
+// size of each part (uint64.)
+// All integers are encoded as big-endian.
+func descriptor(name string, off int, seq uint32, sizes []int) []byte {
+	buf := make([]byte, 1+2+len(name)+8+4+4+8*len(sizes))
+	buf[0] = kindDescriptor
+	i := 1
+	binary.BigEndian.PutUint16(buf[i:], uint16(len(name)))
+	i += 2
+	i += copy(buf[i:], name)
+	binary.BigEndian.PutUint64(buf[i:], uint64(off))
+	i += 8
+	binary.BigEndian.PutUint32(buf[i:], seq)
+	i += 4
+	binary.BigEndian.PutUint32(buf[i:], uint32(len(sizes)))
+	i += 4
+	for _, sz := range sizes {
+		binary.BigEndian.PutUint64(buf[i:], uint64(sz))
+		i += 8
+	}
+	return buf
+}
+
+func parseDescriptor(buf []byte) (name string, off int, seq uint32, sizes []int, err error) {
+	invalid := func() (string, int, uint32, []int, error) {
+		return "", 0, 0, nil, xerrors.Errorf("mq/shmem: invalid descriptor (size=%d)", len(buf))
+	}
+	if len(buf) < 2 {
+		return invalid()
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < n+8+4+4 {
+		return invalid()
+	}
+	name = string(buf[:n])
+	buf = buf[n:]
+	off64 := binary.BigEndian.Uint64(buf)
+	buf = buf[8:]
+	seq = binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	nparts := int(binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	if off64 > math.MaxInt32 || len(buf) != 8*nparts {
+		return invalid()
+	}
+	sizes = make([]int, nparts)
+	for i := range sizes {
+		sz := binary.BigEndian.Uint64(buf)
+		if sz > math.MaxInt32 {
+			return invalid()
+		}
+		sizes[i] = int(sz)
+		buf = buf[8:]
+	}
+	return name, int(off64), seq, sizes, nil
+}
+
+func (s *socket) Listen(addr string) error {
+	return s.ctl.Listen(addr)
+}
+
+func (s *socket) Dial(addr string) error {
+	return s.ctl.Dial(addr)
+}
+
+func (s *socket) Type() mq.SocketType {
+	return s.typ
+}
+
+// GetOption retrieves an option of the socket.
+// Options not handled by the shmem driver are forwarded to the control socket.
+func (s *socket) GetOption(name string) (interface{}, error) {
+	switch name {
+	case OptionSegmentSize:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.size, nil
+	case OptionSession:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.session, nil
+	case OptionLease:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.lease, nil
+	case mq.OptionSubscribe, mq.OptionUnsubscribe:
+		return nil, &mq.UnsupportedOptionError{Driver: "shmem", Option: name}
+	}
+	v, err := s.ctl.GetOption(name)
+	if e := new(mq.UnsupportedOptionError); xerrors.As(err, &e) {
+		e.Driver = "shmem"
+	}
+	return v, err
+}
+
+// SetOption sets an option of the socket.
+// The segment size and session options must be set before the first message
+// is sent.
+// A zero or negative lease never reclaims the blocks of payloads that were
+// not received.
+// Options not handled by the shmem driver are forwarded to the control socket.
+func (s *socket) SetOption(name string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch name {
+	case OptionSegmentSize, OptionSession:
+		if s.seg != nil {
+			return xerrors.Errorf("mq/shmem: option %q must be set before sending data", name)
+		}
+	}
+
+	switch name {
+	case OptionSegmentSize:
+		var n int
+		switch v := value.(type) {
+		case int:
+			n = v
+		case float64:
+			n = int(v)
+			if float64(n) != v {
+				n = -1
+			}
+		}
+		if n <= 2*blockHeader {
+			return xerrors.Errorf("mq/shmem: invalid value %v (type %T) for option %q", value, value, name)
+		}
+		s.size = n
+		return nil
+
+	case OptionSession:
+		v, ok := value.(string)
+		if !ok || v == "" || strings.ContainsAny(v, "/\x00") {
+			return xerrors.Errorf("mq/shmem: invalid value %v (type %T) for option %q", value, value, name)
+		}
+		s.session = v
+		return nil
+
+	case OptionLease:
+		// leases are durations, like the linger option.
+		v, err := mq.OptionValue(mq.OptionLinger, value)
+		if err != nil {
+			return xerrors.Errorf("mq/shmem: invalid value %v (type %T) for option %q", value, value, name)
+		}
+		s.lease = v.(time.Duration)
+		return nil
+
+	case mq.OptionSubscribe, mq.OptionUnsubscribe:
+		if s.topics == nil {
+			return &mq.UnsupportedOptionError{Driver: "shmem", Option: name}
+		}
+		v, err := mq.OptionValue(name, value)
+		if err != nil {
+			return err
+		}
+		if name == mq.OptionSubscribe {
+			s.topics[v.(string)] = struct{}{}
+		} else {
+			delete(s.topics, v.(string))
+		}
+		return nil
+
+	case mq.OptionSendTimeout, mq.OptionLinger:
+		v, err := mq.OptionValue(name, value)
+		if err != nil {
+			return err
+		}
+		if name == mq.OptionLinger {
+			s.linger = v.(time.Duration)
+		} else {
+			s.timeout = v.(time.Duration)
+		}
+	}
+
+	err := s.ctl.SetOption(name, value)
+	if e := new(mq.UnsupportedOptionError); xerrors.As(err, &e) {
+		e.Driver = "shmem"
+	}
+	return err
+}
+
+// subscribed returns whether a message with the provided topic matches the
+// subscriptions of the socket.
+func (s *socket) subscribed(topic []byte) bool {
+	if s.topics == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k := range s.topics {
+		if bytes.HasPrefix(topic, []byte(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+type driver struct{}
+
+func (driver) Name() string {
+	return "shmem"
+}
+
+func (driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	drv, err := mq.Open("nanomsg")
+	if err != nil {
+		return nil, err
+	}
+	ctl, err := drv.NewSocket(typ)
+	if err != nil {
+		return nil, xerrors.Errorf("mq/shmem: could not create control socket: %w", err)
+	}
+
+	s := &socket{
+		ctl:     ctl,
+		typ:     typ,
+		size:    DefaultSegmentSize,
+		session: DefaultSession,
+		linger:  defaultLinger,
+		lease:   DefaultLease,
+		peers:   make(map[string]*segment),
+	}
+	switch typ {
+	case mq.Sub, mq.XSub:
+		s.topics = map[string]struct{}{"": {}}
+	}
+	return s, nil
+}
+
+func init() {
+	mq.Register("shmem", driver{})
+}
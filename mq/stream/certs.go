@@ -0,0 +1,104 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Certificates holds the paths to the PEM files of a certificate, its private
+// key and the certificate authority that signed it.
+type Certificates struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// GenerateCertificates generates a throwaway certificate authority and a
+// certificate signed by it, valid for localhost as both a server and a client,
+// and writes them under dir.
+// The generated certificates are meant for tests, and expire after a day.
+func GenerateCertificates(dir string) (Certificates, error) {
+	certs := Certificates{
+		Cert: filepath.Join(dir, "cert.pem"),
+		Key:  filepath.Join(dir, "key.pem"),
+		CA:   filepath.Join(dir, "ca.pem"),
+	}
+
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return certs, xerrors.Errorf("mq/tls: could not generate key: %w", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"fer"}, CommonName: "fer test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return certs, xerrors.Errorf("mq/tls: could not create certificate authority: %w", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return certs, xerrors.Errorf("mq/tls: could not parse certificate authority: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return certs, xerrors.Errorf("mq/tls: could not generate key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{Organization: []string{"fer"}, CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return certs, xerrors.Errorf("mq/tls: could not create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return certs, xerrors.Errorf("mq/tls: could not encode key: %w", err)
+	}
+
+	for _, f := range []struct {
+		name  string
+		block *pem.Block
+		perm  os.FileMode
+	}{
+		{certs.CA, &pem.Block{Type: "CERTIFICATE", Bytes: caDER}, 0644},
+		{certs.Cert, &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0644},
+		{certs.Key, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}, 0600},
+	} {
+		err = ioutil.WriteFile(f.name, pem.EncodeToMemory(f.block), f.perm)
+		if err != nil {
+			return certs, xerrors.Errorf("mq/tls: could not write %q: %w", f.name, err)
+		}
+	}
+	return certs, nil
+}
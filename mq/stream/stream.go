@@ -0,0 +1,352 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stream implements the mq.Driver interface and allows
+// to use mq.Sockets via plain TCP and Unix domain stream connections,
+// without any third-party protocol stack.
+//
+// Messages are framed with their length, as a big-endian uint32, followed by
+// their payload. The most significant bit of the length marks multipart
+// messages, whose payload is encoded with mq.FrameParts: single-part payloads
+// are never decoded as multipart messages.
+// Connections start with a greeting carrying the type of the sockets, so
+// connections between incompatible sockets are rejected.
+//
+// Addresses are of the form "tcp://host:port" and "ipc:///path/to/socket".
+// Push, pull, pub, sub and pair sockets are supported, with the queues and
+// subscriptions of the mq/internal/queue package.
+//
+// Sockets dial their peers in the background, so they may connect to an
+// address before it is bound, and they reconnect when a connection is lost,
+// every OptionReconnectInterval.
+//
+// The driver is registered under the "stream" name.
+//
+// The "tls" driver secures the same connections with crypto/tls, using mutual
+// authentication: both peers present a certificate, verified against the
+// certificate authorities of the OptionTLSCA file. The OptionTLSCert and
+// OptionTLSKey files hold the certificate of the socket and its private key.
+// These options are required, and must be set before the socket is bound or
+// connected. Certificates of listening sockets must be valid for the host
+// their peers dial, or for localhost over ipc addresses.
+// GenerateCertificates creates throwaway certificates, for tests.
+package stream // import "github.com/alice-go/fer/mq/stream"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	"github.com/alice-go/fer/mq/internal/queue"
+	"golang.org/x/xerrors"
+)
+
+// handshakeTimeout is the maximum duration of the TLS and greeting exchanges.
+const handshakeTimeout = 5 * time.Second
+
+// greeting starts the connections, followed by the type of the socket.
+var greeting = []byte("FER\x00STREAM\x00\x02")
+
+// multipart marks the length of multipart messages.
+const multipart = 1 << 31
+
+type socket struct {
+	*queue.Socket
+
+	secure bool // secure reports whether connections are secured with TLS.
+
+	mu  sync.Mutex
+	tls *tls.Config // tls is the TLS configuration of secure sockets, loaded when they are started.
+}
+
+// conn is a connection of a socket to one of its peers.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// ReadMsg reads the next message sent by the peer.
+func (c *conn) ReadMsg() ([][]byte, error) {
+	msg, multi, err := readMsg(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if !multi {
+		return [][]byte{msg}, nil
+	}
+	return mq.UnframeParts(msg)
+}
+
+// WriteMsg writes a message to the peer.
+// Multipart messages are framed with mq.FrameParts.
+func (c *conn) WriteMsg(parts [][]byte, flush bool) error {
+	var err error
+	switch len(parts) {
+	case 1:
+		err = writeMsg(c.w, parts[0], false)
+	default:
+		err = writeMsg(c.w, mq.FrameParts(parts), true)
+	}
+	if err == nil && flush {
+		err = c.w.Flush()
+	}
+	return err
+}
+
+func newSocket(typ mq.SocketType, secure bool) *socket {
+	name := "stream"
+	opts := map[string]interface{}{
+		mq.OptionTCPKeepAlive: true,
+	}
+	if secure {
+		name = "tls"
+		for _, opt := range []string{mq.OptionTLSCert, mq.OptionTLSKey, mq.OptionTLSCA} {
+			opts[opt] = ""
+		}
+	}
+	return &socket{
+		Socket: queue.New(name, typ, opts),
+		secure: secure,
+	}
+}
+
+func (s *socket) Listen(addr string) error {
+	network, address, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+	err = s.loadTLS()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return xerrors.Errorf("mq/stream: could not listen on %q: %w", addr, err)
+	}
+	return s.Start(ln, func() { s.accept(ln) })
+}
+
+// accept serves the connections accepted by the provided listener, until
+// the socket is closed.
+func (s *socket) accept(ln net.Listener) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		ok := s.Go(func() {
+			c, err := s.open(nc, true, "")
+			if err != nil {
+				nc.Close()
+				return
+			}
+			s.Serve(c)
+		})
+		if !ok {
+			nc.Close()
+		}
+	}
+}
+
+// Dial connects the socket to the provided address.
+// Dial returns immediately: the connection is established in the background
+// and re-established whenever it is lost.
+func (s *socket) Dial(addr string) error {
+	network, address, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+	err = s.loadTLS()
+	if err != nil {
+		return err
+	}
+
+	// the certificates of servers listening on Unix domain sockets are
+	// verified for localhost.
+	host := "localhost"
+	if network == "tcp" {
+		host, _, err = net.SplitHostPort(address)
+		if err != nil {
+			return xerrors.Errorf("mq/stream: invalid address %q: %w", addr, err)
+		}
+	}
+
+	var dialer net.Dialer
+	return s.Start(nil, func() {
+		s.Redial(func(ctx context.Context) (queue.Transport, error) {
+			nc, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			c, err := s.open(nc, false, host)
+			if err != nil {
+				nc.Close()
+				return nil, err
+			}
+			return c, nil
+		})
+	})
+}
+
+// open performs the handshake of a new connection.
+// server reports whether the connection was accepted by the socket, and host
+// is the name of the peer of dialed connections.
+func (s *socket) open(nc net.Conn, server bool, host string) (*conn, error) {
+	if tc, ok := nc.(*net.TCPConn); ok {
+		err := tc.SetKeepAlive(s.Opt(mq.OptionTCPKeepAlive).(bool))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.secure {
+		tc, err := s.startTLS(nc, server, host)
+		if err != nil {
+			return nil, err
+		}
+		nc = tc
+	}
+	err := s.handshake(nc)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+		w:    bufio.NewWriter(nc),
+	}, nil
+}
+
+// handshake exchanges the greetings of the socket and of its peer, and checks
+// their types are compatible.
+func (s *socket) handshake(nc net.Conn) error {
+	err := nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
+
+	hello := append(append([]byte(nil), greeting...), byte(s.Type()))
+	_, err = nc.Write(hello)
+	if err != nil {
+		return xerrors.Errorf("mq/stream: could not send greeting: %w", err)
+	}
+	peer := make([]byte, len(hello))
+	_, err = io.ReadFull(nc, peer)
+	if err != nil {
+		return xerrors.Errorf("mq/stream: could not receive greeting: %w", err)
+	}
+	if !bytes.HasPrefix(peer, greeting) {
+		return xerrors.Errorf("mq/stream: invalid greeting")
+	}
+	typ := mq.SocketType(peer[len(greeting)])
+	if !compatible(s.Type(), typ) {
+		return xerrors.Errorf("mq/stream: %v socket can not connect to %v socket", s.Type(), typ)
+	}
+
+	return nc.SetDeadline(time.Time{})
+}
+
+// readMsg reads a message, and reports whether it is a multipart message.
+func readMsg(r io.Reader) ([]byte, bool, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, false, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	multi := n&multipart != 0
+	n &^= multipart
+	if n > queue.MaxMsgSize {
+		return nil, false, xerrors.Errorf("mq/stream: message size %d exceeds maximum size %d", n, queue.MaxMsgSize)
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, false, err
+	}
+	return msg, multi, nil
+}
+
+// writeMsg writes a message, marked as a multipart message if multi is true.
+func writeMsg(w io.Writer, msg []byte, multi bool) error {
+	n := uint32(len(msg))
+	if multi {
+		n |= multipart
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], n)
+	_, err := w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// compatible returns whether sockets of the provided types can be connected.
+func compatible(a, b mq.SocketType) bool {
+	switch a {
+	case mq.Push:
+		return b == mq.Pull
+	case mq.Pull:
+		return b == mq.Push
+	case mq.Pub:
+		return b == mq.Sub
+	case mq.Sub:
+		return b == mq.Pub
+	case mq.Pair:
+		return b == mq.Pair
+	}
+	return false
+}
+
+// splitAddr returns the network and the address of a tcp:// or ipc://
+// address.
+func splitAddr(addr string) (network, address string, err error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "", "", xerrors.Errorf("mq/stream: invalid address %q", addr)
+	}
+	scheme, rest := addr[:i], addr[i+len("://"):]
+	switch scheme {
+	case "tcp":
+		if strings.HasPrefix(rest, "*:") {
+			rest = rest[len("*"):]
+		}
+		return "tcp", rest, nil
+	case "ipc":
+		return "unix", rest, nil
+	}
+	return "", "", xerrors.Errorf("mq/stream: unsupported transport %q (address=%q)", scheme, addr)
+}
+
+type driver struct{}
+
+func (driver) Name() string {
+	return "stream"
+}
+
+func (driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	switch typ {
+	case mq.Push, mq.Pull, mq.Pub, mq.Sub, mq.Pair:
+		return newSocket(typ, false), nil
+	}
+	return nil, xerrors.Errorf("mq/stream: socket type %v not supported", typ)
+}
+
+func init() {
+	mq.Register("stream", driver{})
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	"golang.org/x/xerrors"
+)
+
+// loadTLS loads the TLS configuration of secure sockets, from the files of
+// their TLS options.
+func (s *socket) loadTLS() error {
+	if !s.secure {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tls != nil {
+		return nil
+	}
+
+	var (
+		cert = s.Opt(mq.OptionTLSCert).(string)
+		key  = s.Opt(mq.OptionTLSKey).(string)
+		ca   = s.Opt(mq.OptionTLSCA).(string)
+	)
+	if cert == "" || key == "" || ca == "" {
+		return xerrors.Errorf(
+			"mq/tls: options %q, %q and %q are required",
+			mq.OptionTLSCert, mq.OptionTLSKey, mq.OptionTLSCA,
+		)
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return xerrors.Errorf("mq/tls: could not load certificate: %w", err)
+	}
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return xerrors.Errorf("mq/tls: could not load certificate authorities: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return xerrors.Errorf("mq/tls: no certificate authority in %q", ca)
+	}
+
+	s.tls = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// startTLS performs the TLS handshake of a connection, authenticating the
+// peer with the certificate authorities of the socket.
+func (s *socket) startTLS(nc net.Conn, server bool, host string) (net.Conn, error) {
+	err := nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	var tc *tls.Conn
+	switch {
+	case server:
+		tc = tls.Server(nc, s.tls)
+	default:
+		cfg := s.tls.Clone()
+		cfg.ServerName = host
+		tc = tls.Client(nc, cfg)
+	}
+	err = tc.Handshake()
+	if err != nil {
+		return nil, xerrors.Errorf("mq/tls: handshake failed: %w", err)
+	}
+	return tc, nil
+}
+
+type tlsDriver struct{}
+
+func (tlsDriver) Name() string {
+	return "tls"
+}
+
+func (tlsDriver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	switch typ {
+	case mq.Push, mq.Pull, mq.Pub, mq.Sub, mq.Pair:
+		return newSocket(typ, true), nil
+	}
+	return nil, xerrors.Errorf("mq/tls: socket type %v not supported", typ)
+}
+
+func init() {
+	mq.Register("tls", tlsDriver{})
+}
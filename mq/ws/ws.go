@@ -0,0 +1,355 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ws implements the mq.Driver interface and allows
+// to use mq.Sockets via WebSocket connections, so channels can be served to
+// web browsers and command-line WebSocket clients.
+//
+// Addresses are of the form "ws://host:port/path". Bound sockets serve
+// WebSocket connections on the path of their address, and connecting
+// sockets dial it.
+// Each message is sent as a binary WebSocket message.
+//
+// Sockets of the driver negotiate the "fer.mq.v1.<type>" subprotocol with
+// their peers, where <type> is the type of the connecting socket (e.g.
+// "fer.mq.v1.push"), and the first byte of each message tells whether it is a
+// single-part message (0) or a multipart message (1), encoded with
+// mq.FrameParts.
+// Bound sockets reject the connections of sockets of incompatible types.
+// Other clients, e.g. browsers, receive messages as is, and the multipart
+// messages encoded with mq.FrameParts. Their binary and text messages are
+// received as single-part messages.
+//
+// Push, pull, pub and sub sockets are supported, with the queues and
+// subscriptions of the mq/internal/queue package.
+// Browsers connect to bound pub and push sockets to receive their messages,
+// e.g. with:
+//  new WebSocket("ws://host:port/path").binaryType = "arraybuffer";
+// WebSocket clients are not authenticated, but bound sockets only accept the
+// browsers of pages served from their own host and port, or from one of the
+// origins listed in OptionOrigins (e.g. "http://localhost:8080").
+//
+// Sockets dial their peers in the background, so they may connect to an
+// address before it is bound, and they reconnect when a connection is lost,
+// every OptionReconnectInterval.
+//
+// The driver is registered under the "ws" name.
+package ws // import "github.com/alice-go/fer/mq/ws"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	"github.com/alice-go/fer/mq/internal/queue"
+	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
+)
+
+// Options of the ws sockets.
+const (
+	OptionOrigins = "ws-origins" // origins allowed to connect to bound sockets, besides their own ([]string).
+)
+
+const (
+	// handshakeTimeout is the maximum duration of the WebSocket handshake.
+	handshakeTimeout = 5 * time.Second
+
+	// closeTimeout is the maximum duration of the sending of the close
+	// message of a connection.
+	closeTimeout = time.Second
+)
+
+// protocol is the prefix of the WebSocket subprotocols of the connections
+// between sockets of the driver.
+const protocol = "fer.mq.v1."
+
+// subprotocol returns the WebSocket subprotocol of the connections of
+// sockets of the provided type.
+func subprotocol(typ mq.SocketType) string {
+	return protocol + typ.String()
+}
+
+// peerType returns the type of the socket of the driver offering the
+// provided subprotocols, if any.
+func peerType(protos []string) (mq.SocketType, bool) {
+	for _, p := range protos {
+		if strings.HasPrefix(p, protocol) {
+			return mq.SocketTypeFrom(strings.TrimPrefix(p, protocol)), true
+		}
+	}
+	return mq.Invalid, false
+}
+
+// compatible returns whether sockets of the provided types can be connected.
+func compatible(a, b mq.SocketType) bool {
+	switch a {
+	case mq.Push:
+		return b == mq.Pull
+	case mq.Pull:
+		return b == mq.Push
+	case mq.Pub:
+		return b == mq.Sub
+	case mq.Sub:
+		return b == mq.Pub
+	}
+	return false
+}
+
+// Markers of the messages of the subprotocol.
+const (
+	singlePart byte = 0
+	multiPart  byte = 1
+)
+
+type socket struct {
+	*queue.Socket
+	upgrader websocket.Upgrader
+}
+
+// conn is a connection of a socket to one of its peers.
+type conn struct {
+	ws     *websocket.Conn
+	marked bool // marked reports whether messages are marked with the subprotocol.
+	once   sync.Once
+}
+
+// ReadMsg reads the next message sent by the peer.
+func (c *conn) ReadMsg() ([][]byte, error) {
+	_, msg, err := c.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if !c.marked {
+		return [][]byte{msg}, nil
+	}
+	if len(msg) == 0 {
+		return nil, xerrors.Errorf("mq/ws: missing message marker")
+	}
+	switch msg[0] {
+	case singlePart:
+		return [][]byte{msg[1:]}, nil
+	case multiPart:
+		return mq.UnframeParts(msg[1:])
+	}
+	return nil, xerrors.Errorf("mq/ws: invalid message marker %d", msg[0])
+}
+
+// WriteMsg writes a message to the peer, as a binary message.
+// Multipart messages are framed with mq.FrameParts.
+func (c *conn) WriteMsg(parts [][]byte, flush bool) error {
+	w, err := c.ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !c.marked && len(parts) == 1:
+		_, err = w.Write(parts[0])
+	case !c.marked:
+		_, err = w.Write(mq.FrameParts(parts))
+	case len(parts) == 1:
+		_, err = w.Write([]byte{singlePart})
+		if err == nil {
+			_, err = w.Write(parts[0])
+		}
+	default:
+		_, err = w.Write([]byte{multiPart})
+		if err == nil {
+			_, err = w.Write(mq.FrameParts(parts))
+		}
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Close sends a close message to the peer and closes the connection.
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(closeTimeout),
+		)
+		c.ws.Close()
+	})
+	return nil
+}
+
+func newConn(ws *websocket.Conn) *conn {
+	ws.SetReadLimit(queue.MaxMsgSize + 1)
+	return &conn{
+		ws:     ws,
+		marked: strings.HasPrefix(ws.Subprotocol(), protocol),
+	}
+}
+
+func newSocket(typ mq.SocketType) *socket {
+	return &socket{
+		Socket: queue.New("ws", typ, map[string]interface{}{
+			OptionOrigins: []string(nil),
+		}),
+	}
+}
+
+// SetOption sets an option of the socket.
+// OptionOrigins must be set before the socket is bound.
+func (s *socket) SetOption(name string, value interface{}) error {
+	if name == OptionOrigins {
+		// origins are lists of strings, like the allow option.
+		v, err := mq.OptionValue(mq.OptionAllow, value)
+		if err != nil {
+			return xerrors.Errorf("mq/ws: invalid value %v (type %T) for option %q", value, value, name)
+		}
+		value = v
+	}
+	return s.Socket.SetOption(name, value)
+}
+
+// Listen serves the WebSocket connections to the provided address.
+func (s *socket) Listen(addr string) error {
+	host, path, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", host)
+	if err != nil {
+		return xerrors.Errorf("mq/ws: could not listen on %q: %w", addr, err)
+	}
+
+	var protos []string
+	for _, typ := range []mq.SocketType{mq.Push, mq.Pull, mq.Pub, mq.Sub} {
+		if compatible(s.Type(), typ) {
+			protos = append(protos, subprotocol(typ))
+		}
+	}
+	s.upgrader = websocket.Upgrader{
+		HandshakeTimeout: handshakeTimeout,
+		Subprotocols:     protos,
+	}
+	if origins := s.Opt(OptionOrigins).([]string); len(origins) > 0 {
+		s.upgrader.CheckOrigin = checkOrigin(origins)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.handle)
+	srv := &http.Server{Handler: mux}
+	err = s.Start(srv, func() { srv.Serve(ln) })
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	return nil
+}
+
+// checkOrigin returns a function accepting the WebSocket handshakes of
+// clients without an origin, from the same origin as the socket, or from
+// one of the provided origins. The "*" origin accepts all the clients.
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// handle upgrades an HTTP request to a WebSocket connection and serves it.
+func (s *socket) handle(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.Context().Done():
+		http.Error(w, "mq/ws: socket closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	if typ, ok := peerType(websocket.Subprotocols(r)); ok && !compatible(s.Type(), typ) {
+		http.Error(w, fmt.Sprintf("mq/ws: %v socket can not connect to %v socket", typ, s.Type()), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader replied to the client.
+	}
+	c := newConn(ws)
+	if !s.Go(func() { s.Serve(c) }) {
+		c.Close()
+	}
+}
+
+// Dial connects the socket to the provided address.
+// Dial returns immediately: the connection is established in the background
+// and re-established whenever it is lost.
+func (s *socket) Dial(addr string) error {
+	_, _, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		Subprotocols:     []string{subprotocol(s.Type())},
+	}
+	return s.Start(nil, func() {
+		s.Redial(func(ctx context.Context) (queue.Transport, error) {
+			ws, _, err := dialer.DialContext(ctx, addr, nil)
+			if err != nil {
+				return nil, err
+			}
+			return newConn(ws), nil
+		})
+	})
+}
+
+// splitAddr splits a WebSocket address into the host and port to listen
+// on, and the path of the WebSocket endpoint.
+func splitAddr(addr string) (host, path string, err error) {
+	u, err := url.Parse(strings.Replace(addr, "//*:", "//:", 1))
+	if err != nil {
+		return "", "", xerrors.Errorf("mq/ws: invalid address %q: %w", addr, err)
+	}
+	if u.Scheme != "ws" {
+		return "", "", xerrors.Errorf("mq/ws: unsupported transport %q (address=%q)", u.Scheme, addr)
+	}
+	path = u.Path
+	if path == "" {
+		path = "/"
+	}
+	return u.Host, path, nil
+}
+
+type driver struct{}
+
+func (driver) Name() string {
+	return "ws"
+}
+
+func (driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
+	switch typ {
+	case mq.Push, mq.Pull, mq.Pub, mq.Sub:
+		return newSocket(typ), nil
+	}
+	return nil, xerrors.Errorf("mq/ws: socket type %v not supported", typ)
+}
+
+func init() {
+	mq.Register("ws", driver{})
+}
@@ -0,0 +1,558 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zeromq
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alice-go/fer/mq"
+	"github.com/go-zeromq/zmq4"
+	"github.com/go-zeromq/zmq4/security/null"
+	"golang.org/x/xerrors"
+)
+
+// handshakeTimeout is the maximum duration of the handshake of the peers of
+// secured sockets.
+const handshakeTimeout = 5 * time.Second
+
+// ZMTP metadata properties of the peers.
+const (
+	metaSocketType = "Socket-Type"
+	metaIdentity   = "Identity"
+)
+
+// security holds the security options of a socket and implements the
+// security mechanism of its ZeroMQ socket.
+//
+// go-zeromq/zmq4 neither authenticates PLAIN clients nor filters its peers,
+// and it panics when the handshake of an accepted connection fails.
+// Secured sockets thus accept their peers with a listener of their own, which
+// authenticates them and forwards their connections to the ZeroMQ socket,
+// bound to a private ipc endpoint. The handshake of these trusted connections
+// only exchanges the metadata of the peers.
+type security struct {
+	mu      sync.Mutex
+	started bool // started reports whether the socket is bound or connected.
+	server  bool
+	user    string
+	pass    string
+	allow   []string
+	nets    []*net.IPNet // nets are the parsed allow-list.
+}
+
+// secured reports whether the listeners of the socket must authenticate or
+// filter their peers.
+func (sec *security) secured() bool {
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	return sec.server || sec.user != "" || len(sec.nets) > 0
+}
+
+// get returns the value of a security option.
+func (sec *security) get(name string) interface{} {
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	switch name {
+	case mq.OptionPlainServer:
+		return sec.server
+	case mq.OptionPlainUsername:
+		return sec.user
+	case mq.OptionPlainPassword:
+		return sec.pass
+	default:
+		return append([]string(nil), sec.allow...)
+	}
+}
+
+// set sets a security option.
+// Security options must be set before the socket is bound or connected.
+func (sec *security) set(name string, value interface{}) error {
+	v, err := mq.OptionValue(name, value)
+	if err != nil {
+		return err
+	}
+
+	if s, ok := v.(string); ok && len(s) > 255 {
+		return xerrors.Errorf("mq/zeromq: option %q is longer than 255 bytes", name)
+	}
+
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	if sec.started {
+		return xerrors.Errorf("mq/zeromq: option %q must be set before connecting", name)
+	}
+	switch name {
+	case mq.OptionPlainServer:
+		sec.server = v.(bool)
+	case mq.OptionPlainUsername:
+		sec.user = v.(string)
+	case mq.OptionPlainPassword:
+		sec.pass = v.(string)
+	case mq.OptionAllow:
+		nets, err := parseAllow(v.([]string))
+		if err != nil {
+			return err
+		}
+		sec.allow = v.([]string)
+		sec.nets = nets
+	}
+	return nil
+}
+
+// start marks the socket as bound or connected, and checks the consistency
+// of its security options.
+func (sec *security) start(dial bool) error {
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	sec.started = true
+	switch {
+	case sec.server && sec.user == "":
+		return xerrors.Errorf("mq/zeromq: PLAIN servers require option %q", mq.OptionPlainUsername)
+	case sec.server && dial:
+		return xerrors.Errorf("mq/zeromq: PLAIN servers can not connect to their peers")
+	}
+	return nil
+}
+
+// Type returns the security mechanism type.
+func (sec *security) Type() zmq4.SecurityType {
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	if sec.user == "" {
+		return zmq4.NullSecurity
+	}
+	return zmq4.PlainSecurity
+}
+
+// Handshake implements the ZMTP security handshake of the ZeroMQ socket.
+// Accepted connections are either unsecured or trusted.
+func (sec *security) Handshake(conn *zmq4.Conn, server bool) error {
+	sec.mu.Lock()
+	user, pass := sec.user, sec.pass
+	sec.mu.Unlock()
+
+	if server || user == "" {
+		return null.Security().Handshake(conn, server)
+	}
+	return plain{user: user, pass: pass}.Handshake(conn, server)
+}
+
+// Encrypt writes the encrypted form of data to w.
+func (*security) Encrypt(w io.Writer, data []byte) (int, error) {
+	return w.Write(data)
+}
+
+// Decrypt writes the decrypted form of data to w.
+func (*security) Decrypt(w io.Writer, data []byte) (int, error) {
+	return w.Write(data)
+}
+
+// plain implements the PLAIN security mechanism, as specified by:
+// https://rfc.zeromq.org/spec:24/ZMTP-PLAIN/
+// PLAIN servers only accept the clients presenting their credentials.
+type plain struct {
+	user string
+	pass string
+}
+
+// Type returns the security mechanism type.
+func (plain) Type() zmq4.SecurityType {
+	return zmq4.PlainSecurity
+}
+
+// Handshake implements the ZMTP security handshake of the PLAIN mechanism.
+func (sec plain) Handshake(conn *zmq4.Conn, server bool) error {
+	if !server {
+		return sec.hello(conn)
+	}
+
+	cmd, err := conn.RecvCmd()
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not receive HELLO from client: %w", err)
+	}
+	if cmd.Name != zmq4.CmdHello {
+		return xerrors.Errorf("mq/zeromq: expected a HELLO command from client (got=%q)", cmd.Name)
+	}
+	if !sec.valid(cmd.Body) {
+		conn.SendCmd(zmq4.CmdError, errorReason("invalid credentials"))
+		return xerrors.Errorf("mq/zeromq: invalid credentials")
+	}
+	err = conn.SendCmd(zmq4.CmdWelcome, nil)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not send WELCOME to client: %w", err)
+	}
+
+	cmd, err = conn.RecvCmd()
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not receive INITIATE from client: %w", err)
+	}
+	if cmd.Name != zmq4.CmdInitiate {
+		return xerrors.Errorf("mq/zeromq: expected an INITIATE command from client (got=%q)", cmd.Name)
+	}
+	err = conn.Peer.Meta.UnmarshalZMTP(cmd.Body)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not unmarshal peer metadata: %w", err)
+	}
+	raw, err := conn.Meta.MarshalZMTP()
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not marshal metadata: %w", err)
+	}
+	err = conn.SendCmd(zmq4.CmdReady, raw)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not send READY to client: %w", err)
+	}
+	return nil
+}
+
+// hello performs the client side of the handshake.
+func (sec plain) hello(conn *zmq4.Conn) error {
+	hello := make([]byte, 0, len(sec.user)+len(sec.pass)+2)
+	hello = append(hello, byte(len(sec.user)))
+	hello = append(hello, sec.user...)
+	hello = append(hello, byte(len(sec.pass)))
+	hello = append(hello, sec.pass...)
+	err := conn.SendCmd(zmq4.CmdHello, hello)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not send HELLO to server: %w", err)
+	}
+
+	cmd, err := conn.RecvCmd()
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not receive WELCOME from server: %w", err)
+	}
+	if cmd.Name != zmq4.CmdWelcome {
+		return xerrors.Errorf("mq/zeromq: expected a WELCOME command from server (got=%q)", cmd.Name)
+	}
+
+	raw, err := conn.Meta.MarshalZMTP()
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not marshal metadata: %w", err)
+	}
+	err = conn.SendCmd(zmq4.CmdInitiate, raw)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not send INITIATE to server: %w", err)
+	}
+
+	cmd, err = conn.RecvCmd()
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not receive READY from server: %w", err)
+	}
+	if cmd.Name != zmq4.CmdReady {
+		return xerrors.Errorf("mq/zeromq: expected a READY command from server (got=%q)", cmd.Name)
+	}
+	err = conn.Peer.Meta.UnmarshalZMTP(cmd.Body)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not unmarshal peer metadata: %w", err)
+	}
+	return nil
+}
+
+// valid reports whether the body of a HELLO command holds the credentials of
+// the server.
+func (sec plain) valid(body []byte) bool {
+	field := func() []byte {
+		if len(body) == 0 || len(body) < 1+int(body[0]) {
+			return nil
+		}
+		v := body[1 : 1+int(body[0])]
+		body = body[1+int(body[0]):]
+		return v
+	}
+	user := field()
+	pass := field()
+	if user == nil || pass == nil || len(body) != 0 {
+		return false
+	}
+	okUser := subtle.ConstantTimeCompare(user, []byte(sec.user)) == 1
+	okPass := subtle.ConstantTimeCompare(pass, []byte(sec.pass)) == 1
+	return okUser && okPass
+}
+
+// Encrypt writes the encrypted form of data to w.
+func (plain) Encrypt(w io.Writer, data []byte) (int, error) {
+	return w.Write(data)
+}
+
+// Decrypt writes the decrypted form of data to w.
+func (plain) Decrypt(w io.Writer, data []byte) (int, error) {
+	return w.Write(data)
+}
+
+// trusted is the security mechanism of the connections forwarded by the
+// listeners of secured sockets to their ZeroMQ socket.
+type trusted zmq4.SecurityType
+
+// Type returns the security mechanism type.
+func (sec trusted) Type() zmq4.SecurityType {
+	return zmq4.SecurityType(sec)
+}
+
+// Handshake exchanges the metadata of the peers.
+func (trusted) Handshake(conn *zmq4.Conn, server bool) error {
+	return null.Security().Handshake(conn, server)
+}
+
+// Encrypt writes the encrypted form of data to w.
+func (trusted) Encrypt(w io.Writer, data []byte) (int, error) {
+	return w.Write(data)
+}
+
+// Decrypt writes the decrypted form of data to w.
+func (trusted) Decrypt(w io.Writer, data []byte) (int, error) {
+	return w.Write(data)
+}
+
+// listen binds a secured socket to the provided address, with a listener
+// authenticating its peers.
+func (s *socket) listen(addr string) error {
+	var network, address string
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "ipc://"):
+		network, address = "unix", strings.TrimPrefix(addr, "ipc://")
+	default:
+		return xerrors.Errorf("mq/zeromq: secured sockets can not listen to %q", addr)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		dir, err := ioutil.TempDir("", "fer-zeromq-")
+		if err != nil {
+			return xerrors.Errorf("mq/zeromq: could not create private endpoint: %w", err)
+		}
+		err = s.zmq.Listen("ipc://" + filepath.Join(dir, "zmq.sock"))
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		s.dir = dir
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return xerrors.Errorf("mq/zeromq: could not listen to %q: %w", addr, err)
+	}
+	l, err := newListener(ln, s.zmq.Type(), s.sec, filepath.Join(s.dir, "zmq.sock"))
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	s.lns = append(s.lns, l)
+	l.wg.Add(1)
+	go l.accept()
+	return nil
+}
+
+// listener accepts the peers of a secured socket, authenticates them and
+// forwards their connections to the ZeroMQ socket of the socket.
+type listener struct {
+	ln   net.Listener
+	typ  zmq4.SocketType
+	id   zmq4.SocketIdentity
+	sec  zmq4.Security // sec is the security mechanism of the peers.
+	fwd  zmq4.Security // fwd is the security mechanism of forwarded connections.
+	nets []*net.IPNet
+	path string // path is the private ipc endpoint of the ZeroMQ socket.
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newListener(ln net.Listener, typ zmq4.SocketType, sec *security, path string) (*listener, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, xerrors.Errorf("mq/zeromq: could not generate socket identity: %w", err)
+	}
+
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	l := &listener{
+		ln:    ln,
+		typ:   typ,
+		id:    zmq4.SocketIdentity(hex.EncodeToString(id)),
+		sec:   null.Security(),
+		fwd:   trusted(zmq4.NullSecurity),
+		nets:  sec.nets,
+		path:  path,
+		conns: make(map[net.Conn]struct{}),
+	}
+	if sec.user != "" {
+		l.fwd = trusted(zmq4.PlainSecurity)
+	}
+	if sec.server {
+		l.sec = plain{user: sec.user, pass: sec.pass}
+	}
+	return l, nil
+}
+
+// accept accepts the peers of the socket until the listener is closed.
+func (l *listener) accept() {
+	defer l.wg.Done()
+	for {
+		nc, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		if !l.allowed(nc.RemoteAddr()) || !l.track(nc) {
+			nc.Close()
+			continue
+		}
+		l.wg.Add(1)
+		go l.serve(nc)
+	}
+}
+
+// serve authenticates a peer and forwards its connection to the ZeroMQ
+// socket.
+func (l *listener) serve(nc net.Conn) {
+	defer l.wg.Done()
+	defer l.untrack(nc)
+
+	err := nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		nc.Close()
+		return
+	}
+	peer, err := zmq4.Open(nc, l.sec, l.typ, l.id, true)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	err = nc.SetDeadline(time.Time{})
+	if err != nil {
+		nc.Close()
+		return
+	}
+
+	fc, err := net.DialTimeout("unix", l.path, handshakeTimeout)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	// forwarded connections are not closed before their handshake completes,
+	// as go-zeromq/zmq4 panics if it fails.
+	_, err = zmq4.Open(
+		fc, l.fwd,
+		zmq4.SocketType(peer.Peer.Meta[metaSocketType]),
+		zmq4.SocketIdentity(peer.Peer.Meta[metaIdentity]),
+		false,
+	)
+	if err != nil || !l.track(fc) {
+		nc.Close()
+		fc.Close()
+		return
+	}
+	defer l.untrack(fc)
+
+	// the handshakes are done: the ZMTP frames of the peers go through
+	// unchanged.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(fc, nc)
+		fc.Close()
+		nc.Close()
+	}()
+	io.Copy(nc, fc)
+	nc.Close()
+	fc.Close()
+	<-done
+}
+
+// allowed reports whether a peer is allowed to connect.
+// Peers connected over ipc endpoints are always allowed.
+func (l *listener) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || len(l.nets) == 0 {
+		return true
+	}
+	for _, n := range l.nets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// track adds a connection to the connections closed with the listener.
+// track returns false if the listener is closed.
+func (l *listener) track(c net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[c] = struct{}{}
+	return true
+}
+
+func (l *listener) untrack(c net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c)
+}
+
+// Close stops accepting peers and closes the connections of the listener.
+func (l *listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	err := l.ln.Close()
+	for c := range l.conns {
+		c.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return err
+}
+
+// parseAllow parses a list of IP addresses and networks.
+func parseAllow(allow []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(allow))
+	for _, v := range allow {
+		if strings.Contains(v, "/") {
+			_, n, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, xerrors.Errorf("mq/zeromq: invalid network %q: %w", v, err)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, xerrors.Errorf("mq/zeromq: invalid IP address %q", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// errorReason returns the body of a ZMTP ERROR command.
+func errorReason(reason string) []byte {
+	return append([]byte{byte(len(reason))}, reason...)
+}
@@ -4,53 +4,331 @@
 
 // Package zeromq implements the mq.Driver interface and allows
 // to use mq.Sockets via ZeroMQ sockets.
+//
+// Router sockets prefix the messages they receive with the identity of the
+// sending peer, and route the messages they send to the peer identified by
+// their first part.
+// Rep sockets strip the envelope of the requests they receive (the parts up
+// to the empty delimiter part) and put it back on the replies they send, so
+// they serve req as well as dealer peers.
+// XPub sockets receive the (un)subscriptions of their peers as messages made
+// of a 1 (or 0) byte followed by the topic.
+//
+// Sockets use the NULL security mechanism by default.
+// Bound sockets with OptionPlainServer only accept the peers authenticated
+// with the PLAIN mechanism and the OptionPlainUsername and
+// OptionPlainPassword credentials of the socket, and connecting sockets with
+// these credentials present them to their peers. Bound sockets with
+// OptionAllow only accept TCP peers from the listed IP addresses and networks.
+// Secured sockets can only be bound to tcp and ipc addresses.
+//
+// OptionReconnectInterval sets the delay between two failed attempts at
+// dialing an endpoint, and must be set before the socket is bound or
+// connected. go-zeromq/zmq4 gives up dialing after 10 attempts, and does not
+// reconnect lost connections.
 package zeromq // import "github.com/alice-go/fer/mq/zeromq"
 
 import (
 	"context"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alice-go/fer/mq"
 	"github.com/go-zeromq/zmq4"
 	"golang.org/x/xerrors"
 )
 
+// defaultRetry is the default delay of go-zeromq/zmq4 between two attempts
+// at dialing an endpoint.
+const defaultRetry = 250 * time.Millisecond
+
 type socket struct {
-	zmq zmq4.Socket
-	typ mq.SocketType
+	zmq  zmq4.Socket
+	typ  mq.SocketType
+	once sync.Once
+
+	// newZMQ creates the underlying ZeroMQ socket.
+	// go-zeromq/zmq4 only configures the dial retry delay of a socket at its
+	// creation, so the socket is created anew when the delay is set.
+	newZMQ  func(ctx context.Context, opts ...zmq4.Option) zmq4.Socket
+	retry   time.Duration
+	opts    []option // opts are the options forwarded to zmq4.
+	started bool     // started reports whether the socket was bound or connected.
+
+	// topics holds the subscriptions of a XSub socket.
+	// go-zeromq/zmq4 leaves subscriptions of XSub sockets to the user, so
+	// they are sent to the publishers each time the socket dials one.
+	mu     sync.Mutex
+	topics map[string]struct{}
+	dialed bool // dialed reports whether the socket dialed a publisher.
+
+	// env holds the envelope of the last request received by a Rep socket,
+	// prefixed with the identity of the requesting peer.
+	// Rep sockets are implemented with ZeroMQ router sockets, as zmq4 rep
+	// sockets drop the envelope of the requests of dealer peers.
+	env [][]byte
+
+	sec *security   // sec holds the security options of the socket.
+	lns []*listener // lns are the listeners of secured sockets.
+	dir string      // dir holds the private ipc endpoint of secured sockets.
 }
 
+// Close closes the underlying ZeroMQ socket.
+// Sending or receiving data on a closed socket returns an error.
 func (s *socket) Close() error {
-	if s.zmq != nil {
+	s.once.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, l := range s.lns {
+			l.Close()
+		}
 		s.zmq.Close()
-		s.zmq = nil
-	}
+		if s.dir != "" {
+			os.RemoveAll(s.dir)
+		}
+	})
 	return nil
 }
 
 func (s *socket) Send(data []byte) error {
-	return s.zmq.Send(zmq4.NewMsg(data))
+	return s.send([][]byte{data})
 }
 
 func (s *socket) Recv() ([]byte, error) {
-	msg, err := s.zmq.Recv()
+	msg, err := s.recv()
 	return msg.Bytes(), err
 }
 
+func (s *socket) SendMulti(parts [][]byte) error {
+	return s.send(parts)
+}
+
+// send sends a message through the ZeroMQ socket.
+// Rep sockets send the message back to the peer of the last request
+// received.
+func (s *socket) send(parts [][]byte) error {
+	if s.typ == mq.Rep {
+		s.mu.Lock()
+		env := s.env
+		s.env = nil
+		s.mu.Unlock()
+		if env == nil {
+			return xerrors.Errorf("mq/zeromq: no request to reply to")
+		}
+		parts = append(env, parts...)
+	}
+	return s.zmq.Send(zmq4.NewMsgFrom(parts...))
+}
+
+func (s *socket) RecvMulti() ([][]byte, error) {
+	msg, err := s.recv()
+	return msg.Frames, err
+}
+
+var errClosed = xerrors.New("mq/zeromq: socket closed")
+
+// recv receives a message from the ZeroMQ socket.
+// Closed zmq4 sockets that had peers return empty messages, without error:
+// these are reported as errClosed.
+// Rep sockets record the envelope of the request, and drop the requests
+// without one.
+func (s *socket) recv() (zmq4.Msg, error) {
+	for {
+		msg, err := s.zmq.Recv()
+		if err == nil && len(msg.Frames) == 0 {
+			return msg, errClosed
+		}
+		if err != nil || s.typ != mq.Rep {
+			return msg, err
+		}
+
+		n := 1
+		for n < len(msg.Frames) && len(msg.Frames[n]) > 0 {
+			n++
+		}
+		if n == len(msg.Frames) {
+			continue // no envelope delimiter.
+		}
+		s.mu.Lock()
+		s.env = msg.Frames[: n+1 : n+1]
+		s.mu.Unlock()
+		msg.Frames = msg.Frames[n+1:]
+		return msg, nil
+	}
+}
+
 func (s *socket) Listen(addr string) error {
+	s.start()
+	err := s.sec.start(false)
+	if err != nil {
+		return err
+	}
 	addr = globAddr(addr)
+	if s.sec.secured() {
+		return s.listen(addr)
+	}
 	return s.zmq.Listen(addr)
 }
 
 func (s *socket) Dial(addr string) error {
+	s.start()
+	err := s.sec.start(true)
+	if err != nil {
+		return err
+	}
 	addr = globAddr(addr)
-	return s.zmq.Dial(addr)
+	err = s.zmq.Dial(addr)
+	if err != nil || s.typ != mq.XSub {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialed = true
+	for topic := range s.topics {
+		err = s.zmq.Send(zmq4.NewMsg(append([]byte{1}, topic...)))
+		if err != nil {
+			return xerrors.Errorf("mq/zeromq: could not send subscription: %w", err)
+		}
+	}
+	return nil
+}
+
+// start records that the socket was bound or connected.
+func (s *socket) start() {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
 }
 
 func (s *socket) Type() mq.SocketType {
 	return s.typ
 }
 
+// GetOption retrieves an option of the socket.
+// Options not defined by the mq package are forwarded to zmq4.
+func (s *socket) GetOption(name string) (interface{}, error) {
+	switch name {
+	case mq.OptionSendHWM, mq.OptionRecvHWM,
+		mq.OptionLinger, mq.OptionSendTimeout, mq.OptionRecvTimeout,
+		mq.OptionTCPKeepAlive,
+		mq.OptionSubscribe, mq.OptionUnsubscribe,
+		mq.OptionTLSCert, mq.OptionTLSKey, mq.OptionTLSCA:
+		return nil, &mq.UnsupportedOptionError{Driver: "zeromq", Option: name}
+	case mq.OptionReconnectInterval:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.retry, nil
+	case mq.OptionPlainServer, mq.OptionPlainUsername, mq.OptionPlainPassword, mq.OptionAllow:
+		return s.sec.get(name), nil
+	}
+	return s.zmq.GetOption(name)
+}
+
+// SetOption sets an option of the socket.
+// Options not defined by the mq package are forwarded to zmq4.
+// The PLAIN, allow and reconnect-interval options must be set before the
+// socket is bound or connected.
+func (s *socket) SetOption(name string, value interface{}) error {
+	switch name {
+	case mq.OptionPlainServer, mq.OptionPlainUsername, mq.OptionPlainPassword, mq.OptionAllow:
+		return s.sec.set(name, value)
+	case mq.OptionSubscribe, mq.OptionUnsubscribe:
+		if s.typ != mq.Sub && s.typ != mq.XSub {
+			return &mq.UnsupportedOptionError{Driver: "zeromq", Option: name}
+		}
+		v, err := mq.OptionValue(name, value)
+		if err != nil {
+			return err
+		}
+		if s.typ == mq.XSub {
+			return s.subscribe(v.(string), name == mq.OptionSubscribe)
+		}
+		opt := zmq4.OptionSubscribe
+		if name == mq.OptionUnsubscribe {
+			opt = zmq4.OptionUnsubscribe
+		}
+		return s.setZMQ(opt, v)
+	case mq.OptionReconnectInterval:
+		v, err := mq.OptionValue(name, value)
+		if err != nil {
+			return err
+		}
+		return s.setRetry(v.(time.Duration))
+	case mq.OptionSendHWM, mq.OptionRecvHWM,
+		mq.OptionLinger, mq.OptionSendTimeout, mq.OptionRecvTimeout,
+		mq.OptionTCPKeepAlive,
+		mq.OptionTLSCert, mq.OptionTLSKey, mq.OptionTLSCA:
+		// FIXME: go-zeromq/zmq4 does not support these options.
+		return &mq.UnsupportedOptionError{Driver: "zeromq", Option: name}
+	}
+	return s.setZMQ(name, value)
+}
+
+// option is an option forwarded to zmq4.
+type option struct {
+	name  string
+	value interface{}
+}
+
+// setZMQ sets an option of the underlying ZeroMQ socket, and records it for
+// the sockets created anew by setRetry.
+func (s *socket) setZMQ(name string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.zmq.SetOption(name, value)
+	if err != nil {
+		return err
+	}
+	s.opts = append(s.opts, option{name, value})
+	return nil
+}
+
+// setRetry creates the underlying ZeroMQ socket anew, with the provided
+// delay between two attempts at dialing an endpoint.
+func (s *socket) setRetry(retry time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return xerrors.Errorf("mq/zeromq: option %q must be set before the socket is bound or connected", mq.OptionReconnectInterval)
+	}
+
+	zmq := s.newZMQ(context.Background(), zmq4.WithSecurity(s.sec), zmq4.WithDialerRetry(retry))
+	for _, opt := range s.opts {
+		err := zmq.SetOption(opt.name, opt.value)
+		if err != nil {
+			zmq.Close()
+			return xerrors.Errorf("mq/zeromq: could not set option %q: %w", opt.name, err)
+		}
+	}
+	s.zmq.Close()
+	s.zmq = zmq
+	s.retry = retry
+	return nil
+}
+
+// subscribe updates the subscriptions of a XSub socket and forwards the
+// (un)subscription to the publishers it is connected to.
+func (s *socket) subscribe(topic string, sub bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var flag byte
+	switch {
+	case sub:
+		flag = 1
+		s.topics[topic] = struct{}{}
+	default:
+		delete(s.topics, topic)
+	}
+	if !s.dialed {
+		return nil
+	}
+	return s.zmq.Send(zmq4.NewMsg(append([]byte{flag}, topic...)))
+}
+
 func globAddr(addr string) string {
 	addr = strings.Replace(addr, "//*:", "//0.0.0.0:", 1)
 	addr = strings.Replace(addr, ":*", ":0", 1)
@@ -65,58 +343,65 @@ func (driver) Name() string {
 
 func (drv driver) NewSocket(typ mq.SocketType) (mq.Socket, error) {
 	var (
-		sck = socket{typ: typ}
-		err error
-		ctx = context.Background()
+		sck  = socket{typ: typ, sec: new(security), retry: defaultRetry}
+		err  error
+		ctx  = context.Background()
+		opts = []zmq4.Option{zmq4.WithSecurity(sck.sec)}
 	)
 
 	switch typ {
 	case mq.Sub:
-		sck.zmq = zmq4.NewSub(ctx)
+		sck.newZMQ = zmq4.NewSub
 
 	case mq.XSub:
-		return nil, xerrors.Errorf("mq/zeromq: mq.XSub not implemented")
+		sck.newZMQ = zmq4.NewXSub
+		sck.topics = make(map[string]struct{})
 
 	case mq.Pub:
-		sck.zmq = zmq4.NewPub(ctx)
+		sck.newZMQ = zmq4.NewPub
 
 	case mq.XPub:
-		return nil, xerrors.Errorf("mq/zeromq: mq.XPub not implemented")
+		sck.newZMQ = zmq4.NewXPub
 
 	case mq.Push:
-		sck.zmq = zmq4.NewPush(ctx)
+		sck.newZMQ = zmq4.NewPush
 
 	case mq.Pull:
-		sck.zmq = zmq4.NewPull(ctx)
+		sck.newZMQ = zmq4.NewPull
 
 	case mq.Req:
-		sck.zmq = zmq4.NewReq(ctx)
+		sck.newZMQ = zmq4.NewReq
 
 	case mq.Dealer:
-		return nil, xerrors.Errorf("mq/zeromq: mq.Dealer not implemented")
+		sck.newZMQ = zmq4.NewDealer
 
 	case mq.Rep:
-		sck.zmq = zmq4.NewRep(ctx)
+		sck.newZMQ = zmq4.NewRouter
 
 	case mq.Router:
-		return nil, xerrors.Errorf("mq/zeromq: mq.Router not implemented")
+		sck.newZMQ = zmq4.NewRouter
 
 	case mq.Pair:
-		return nil, xerrors.Errorf("mq/zeromq: mq.Pair not implemented")
+		sck.newZMQ = zmq4.NewPair
 
-	case mq.Bus:
-		return nil, xerrors.Errorf("mq/zeromq: mq.Bus not implemented")
+	case mq.Bus, mq.Surveyor, mq.Respondent, mq.Star:
+		// these nanomsg patterns have no ZeroMQ equivalent.
+		return nil, xerrors.Errorf("mq/zeromq: %v sockets not supported", typ)
 
 	default:
 		return nil, xerrors.Errorf("mq/zeromq: invalid socket type %v (%d)", typ, int(typ))
 	}
 
+	sck.zmq = sck.newZMQ(ctx, opts...)
+
 	switch typ {
-	case mq.Sub, mq.XSub:
-		err = sck.zmq.SetOption(zmq4.OptionSubscribe, "")
+	case mq.Sub:
+		err = sck.setZMQ(zmq4.OptionSubscribe, "")
 		if err != nil {
 			return nil, err
 		}
+	case mq.XSub:
+		sck.topics[""] = struct{}{}
 	}
 
 	return &sck, err
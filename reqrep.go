@@ -0,0 +1,338 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/alice-go/fer/mq"
+	"golang.org/x/xerrors"
+)
+
+// Handler handles a request received on a rep or router channel and returns
+// the reply to send back to the requester.
+type Handler func(ctx context.Context, req Msg) (Msg, error)
+
+// request is a request in flight on a req/dealer or rep/router channel.
+type request struct {
+	ctx context.Context // ctx is the context of the requester.
+	msg Msg
+	rep chan Msg // rep receives the reply to the request.
+}
+
+// requests sends the requests of the device through a req or dealer socket
+// and delivers the corresponding replies.
+func (ch *channel) requests(quit chan struct{}) {
+	if ch.sck.Type() == mq.Dealer {
+		ch.pipeline(quit)
+		return
+	}
+	ch.lockstep(quit)
+}
+
+// lockstep sends requests through a req socket, one at a time.
+//
+// The reply to a cancelled request is still received, and discarded, before
+// the next request is sent: req sockets deliver replies in order and may not
+// have more than one request in flight.
+func (ch *channel) lockstep(quit chan struct{}) {
+	var (
+		next = make(chan struct{}) // next asks for the reply to the last request.
+		reps = make(chan Msg)
+	)
+	go func() {
+		for {
+			select {
+			case <-next:
+			case <-quit:
+				return
+			}
+			rep := ch.recv()
+			if rep.Err != nil {
+				rep.Err = ch.error("recv", rep.Err)
+			}
+			select {
+			case reps <- rep:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	stale := false
+	for {
+		var req request
+		select {
+		case req = <-ch.reqs:
+		case <-quit:
+			return
+		}
+
+		if stale {
+			select {
+			case rep := <-reps:
+				ch.log.Debugf("discarding reply to cancelled request (err=%v)\n", rep.Err)
+				stale = false
+			case <-req.ctx.Done():
+				continue
+			case <-quit:
+				return
+			}
+		}
+
+		err := ch.send(req.msg)
+		if err != nil {
+			req.rep <- Msg{Err: ch.error("send", err)}
+			continue
+		}
+
+		select {
+		case next <- struct{}{}:
+		case <-quit:
+			return
+		}
+
+		select {
+		case rep := <-reps:
+			req.rep <- rep
+		case <-req.ctx.Done():
+			stale = true
+		case <-quit:
+			return
+		}
+	}
+}
+
+// pipeline sends requests through a dealer socket, without waiting for the
+// replies to the previous requests.
+//
+// Dealer sockets follow the ZeroMQ envelope conventions: requests are
+// prefixed with a request identifier and an empty delimiter part, which the
+// replying peer sends back and which are stripped from replies.
+// Replies are matched to requests with that identifier, so they may come
+// back in any order.
+// Replies to cancelled requests are discarded.
+func (ch *channel) pipeline(quit chan struct{}) {
+	var (
+		mu      sync.Mutex
+		pending = make(map[string]request)
+	)
+
+	go func() {
+		for {
+			rep := ch.recv()
+			if rep.Err != nil {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				mu.Lock()
+				reqs := pending
+				pending = make(map[string]request)
+				mu.Unlock()
+				if len(reqs) == 0 {
+					ch.log.Debugf("no request in flight: %v\n", rep.Err)
+					continue
+				}
+				err := ch.error("recv", rep.Err)
+				for _, req := range reqs {
+					req.rep <- Msg{Err: err}
+				}
+				continue
+			}
+
+			parts := rep.parts()
+			if len(parts) < 2 || len(parts[1]) != 0 {
+				ch.log.Warnf("dropping reply without request identifier\n")
+				continue
+			}
+			mu.Lock()
+			req, ok := pending[string(parts[0])]
+			delete(pending, string(parts[0]))
+			mu.Unlock()
+			if !ok {
+				ch.log.Debugf("discarding reply to cancelled request\n")
+				continue
+			}
+			req.rep <- msgFrom(parts[2:])
+		}
+	}()
+
+	var seq uint64
+	for {
+		var req request
+		select {
+		case req = <-ch.reqs:
+		case <-quit:
+			return
+		}
+
+		seq++
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, seq)
+
+		mu.Lock()
+		for k, v := range pending {
+			if v.ctx.Err() != nil {
+				delete(pending, k)
+			}
+		}
+		pending[string(id)] = req
+		mu.Unlock()
+
+		err := ch.send(msgFrom(append([][]byte{id, {}}, req.msg.parts()...)))
+		if err != nil {
+			mu.Lock()
+			delete(pending, string(id))
+			mu.Unlock()
+			req.rep <- Msg{Err: ch.error("send", err)}
+		}
+	}
+}
+
+// replies receives requests from a rep or router socket, hands them to the
+// device and sends back the corresponding replies.
+//
+// Router sockets receive requests prefixed with the identity of the peer,
+// followed by the envelope of the request up to an empty delimiter part
+// (following the ZeroMQ envelope conventions.)
+// Replies are routed back to the requesting peer using that envelope.
+// Requests the device failed to handle are not replied to.
+func (ch *channel) replies(quit chan struct{}) {
+	router := ch.sck.Type() == mq.Router
+	for {
+		msg := ch.recv()
+		if msg.Err != nil {
+			if !ch.handle(quit, "recv", msg.Err) {
+				return
+			}
+			continue
+		}
+
+		var env [][]byte
+		if router {
+			parts := msg.parts()
+			n := 1
+			for i := 1; i < len(parts); i++ {
+				if len(parts[i]) == 0 {
+					n = i + 1
+					break
+				}
+			}
+			if len(parts[0]) == 0 {
+				ch.log.Warnf("dropping request without peer identity\n")
+				continue
+			}
+			env, msg = parts[:n:n], msgFrom(parts[n:])
+		}
+
+		req := request{ctx: context.Background(), msg: msg, rep: make(chan Msg, 1)}
+		select {
+		case ch.reqs <- req:
+		case <-quit:
+			return
+		}
+
+		var rep Msg
+		select {
+		case rep = <-req.rep:
+		case <-quit:
+			return
+		}
+		if rep.Err != nil {
+			ch.log.Warnf("not replying to request: %v\n", rep.Err)
+			continue
+		}
+
+		if router {
+			rep = msgFrom(append(env, rep.parts()...))
+		}
+		err := ch.send(rep)
+		if err != nil && !ch.handle(quit, "send", err) {
+			return
+		}
+	}
+}
+
+// reqChannel returns the i-th socket of the named channel, checking it is
+// one of the provided types.
+func (dev *device) reqChannel(name string, i int, types ...mq.SocketType) (*channel, error) {
+	chans := dev.chans[name]
+	if i < 0 || i >= len(chans) {
+		return nil, xerrors.Errorf("fer: no such channel (name=%q index=%d)", name, i)
+	}
+	ch := &chans[i]
+	typ := ch.sck.Type()
+	for _, t := range types {
+		if typ == t {
+			return ch, nil
+		}
+	}
+	return nil, xerrors.Errorf("fer: invalid socket type %v for channel (name=%q index=%d)", typ, name, i)
+}
+
+func (dev *device) Request(ctx context.Context, name string, i int, msg Msg) (Msg, error) {
+	ch, err := dev.reqChannel(name, i, mq.Req, mq.Dealer)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	req := request{ctx: ctx, msg: msg, rep: make(chan Msg, 1)}
+	select {
+	case ch.reqs <- req:
+	case <-ctx.Done():
+		return Msg{}, ctx.Err()
+	}
+
+	select {
+	case rep := <-req.rep:
+		return rep, rep.Err
+	case <-ctx.Done():
+		return Msg{}, ctx.Err()
+	}
+}
+
+func (dev *device) Serve(ctx context.Context, name string, i int, h Handler) error {
+	ch, err := dev.reqChannel(name, i, mq.Rep, mq.Router)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var req request
+		select {
+		case req = <-ch.reqs:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		rep, err := h(ctx, req.msg)
+		if err != nil {
+			err = xerrors.Errorf("fer: could not handle request on channel %q: %w", name, err)
+			req.rep <- Msg{Err: err}
+			return err
+		}
+		req.rep <- rep
+	}
+}
+
+// parts returns the parts of the message.
+func (msg Msg) parts() [][]byte {
+	if len(msg.Parts) == 0 {
+		return [][]byte{msg.Data}
+	}
+	return msg.Parts
+}
+
+// msgFrom returns a message made of the provided parts.
+func msgFrom(parts [][]byte) Msg {
+	if len(parts) == 1 {
+		return Msg{Data: parts[0]}
+	}
+	return Msg{Parts: parts}
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// script is a sequence of control statements driving a device.
+//
+// A script holds one statement per line.
+// Empty lines and lines starting with '#' are ignored.
+// A statement is either a command of the interactive console (init, run,
+// pause, stop, reset, end, state, ...) or one of:
+//  wait-state STATE [TIMEOUT]  waits until the device reaches STATE,
+//  sleep DURATION              waits for DURATION,
+//  run-for DURATION            runs the device for DURATION and then stops it.
+//
+// e.g.:
+//  init
+//  wait-state READY 10s
+//  run-for 30s
+//  end
+//
+// Once all the statements have been executed, the device is stopped, reset
+// and ended, if the script did not do so already.
+type script struct {
+	name  string
+	stmts []scriptStmt
+}
+
+type scriptStmt struct {
+	line int           // line number of the statement in the script.
+	op   string        // op is the operation of the statement.
+	st   State         // st is the state to wait for (wait-state).
+	dt   time.Duration // dt is the timeout (wait-state) or the duration (sleep, run-for).
+}
+
+// isScript returns whether the provided control mode is a script.
+func isScript(ctl string) bool {
+	return strings.HasPrefix(ctl, "script:")
+}
+
+func openScript(fname string) (*script, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, xerrors.Errorf("fer: could not open control script: %w", err)
+	}
+	defer f.Close()
+	return parseScript(fname, f)
+}
+
+func parseScript(name string, r io.Reader) (*script, error) {
+	var (
+		sc   = &script{name: name}
+		scan = bufio.NewScanner(r)
+		cons = newConsole(nil, nil)
+		line = 0
+	)
+
+	for scan.Scan() {
+		line++
+		txt := strings.TrimSpace(scan.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		toks := strings.Fields(txt)
+		stmt := scriptStmt{line: line, op: strings.ToLower(toks[0])}
+		args := toks[1:]
+		switch stmt.op {
+		case "wait-state":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, xerrors.Errorf("fer: %s:%d: wait-state expects a state and an optional timeout", name, line)
+			}
+			err := stmt.st.UnmarshalText([]byte(args[0]))
+			if err != nil {
+				return nil, xerrors.Errorf("fer: %s:%d: %w", name, line, err)
+			}
+			if len(args) == 2 {
+				stmt.dt, err = time.ParseDuration(args[1])
+				if err != nil {
+					return nil, xerrors.Errorf("fer: %s:%d: invalid timeout: %w", name, line, err)
+				}
+			}
+		case "sleep", "run-for":
+			if len(args) != 1 {
+				return nil, xerrors.Errorf("fer: %s:%d: %s expects a duration", name, line, stmt.op)
+			}
+			dt, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, xerrors.Errorf("fer: %s:%d: invalid duration: %w", name, line, err)
+			}
+			stmt.dt = dt
+		default:
+			cmd, ok := cons.lookup(stmt.op)
+			if !ok || cmd.name == "history" {
+				return nil, xerrors.Errorf("fer: %s:%d: unknown statement %q", name, line, toks[0])
+			}
+			if len(args) != 0 {
+				return nil, xerrors.Errorf("fer: %s:%d: %s expects no argument", name, line, stmt.op)
+			}
+			stmt.op = cmd.name
+		}
+		sc.stmts = append(sc.stmts, stmt)
+	}
+
+	err := scan.Err()
+	if err != nil {
+		return nil, xerrors.Errorf("fer: could not read control script %s: %w", name, err)
+	}
+
+	return sc, nil
+}
+
+// runScript drives the device with the provided script.
+// The device is aborted if any of the statements of the script fails.
+func (dev *device) runScript(ctx context.Context, sc *script, w io.Writer) {
+	cons := newConsole(dev, w)
+	for _, stmt := range sc.stmts {
+		quit, err := sc.exec(ctx, cons, stmt)
+		if err != nil {
+			_ = dev.abort(xerrors.Errorf("fer: %s:%d: %s: %w", sc.name, stmt.line, stmt.op, err))
+			return
+		}
+		if quit {
+			return
+		}
+	}
+
+	_, err := cons.end()
+	if err != nil {
+		_ = dev.abort(xerrors.Errorf("fer: %s: could not end device: %w", sc.name, err))
+	}
+}
+
+func (sc *script) exec(ctx context.Context, cons *console, stmt scriptStmt) (bool, error) {
+	dev := cons.dev
+	switch stmt.op {
+	case "wait-state":
+		return false, dev.waitState(ctx, stmt.st, stmt.dt)
+
+	case "sleep":
+		return false, dev.sleep(ctx, stmt.dt)
+
+	case "run-for":
+		err := cons.exec(CmdRun)
+		if err != nil {
+			return false, err
+		}
+		err = dev.waitState(ctx, StateReady, stmt.dt)
+		switch {
+		case err == nil:
+			// the device stopped on its own.
+			return false, nil
+		case xerrors.Is(err, errTimeout):
+			return false, cons.exec(CmdStop)
+		default:
+			return false, err
+		}
+
+	default:
+		cmd, _ := cons.lookup(stmt.op)
+		return cmd.run(cons)
+	}
+}
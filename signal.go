@@ -0,0 +1,77 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+var osExit = os.Exit
+
+// handleSignals performs the orderly shutdown of the device upon reception of
+// a first signal, and forces the exit of the process upon reception of a
+// second one.
+func (dev *device) handleSignals(sigc <-chan os.Signal, timeout time.Duration) {
+	var sig os.Signal
+	select {
+	case sig = <-sigc:
+	case <-dev.exit:
+		return
+	}
+
+	dev.msg.Warnf("received signal %v: shutting down (timeout=%v)...\n", sig, timeout)
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.shutdown()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			dev.stop(xerrors.Errorf("fer: could not shut down device %q: %w", dev.name, err))
+		}
+	case <-timer.C:
+		dev.stop(xerrors.Errorf(
+			"fer: could not shut down device %q after %v (state=%v): %w",
+			dev.name, timeout, dev.State(), errTimeout,
+		))
+	case sig = <-sigc:
+		dev.msg.Warnf("received signal %v: forcing exit\n", sig)
+		code := 1
+		if sig, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(sig)
+		}
+		osExit(code)
+	}
+}
+
+// shutdown stops, resets and ends the device.
+// The shutdown sequence is re-evaluated after each command, as the device may
+// change state concurrently (e.g. when the Run method returns on its own.)
+func (dev *device) shutdown() error {
+	for {
+		st := dev.State()
+		if st == StateExiting {
+			return nil
+		}
+		seq := endSequence(st)
+		if seq == nil {
+			return xerrors.Errorf("fer: no shutdown sequence from state %v", st)
+		}
+		err := dev.exec(seq[0])
+		if cur := dev.State(); err != nil && (cur == st || endSequence(cur) == nil) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChannelStats describes the traffic that went through a socket of a channel.
+type ChannelStats struct {
+	Channel string // Channel is the name of the channel.
+	Socket  int    // Socket is the index of the socket in the channel.
+
+	MsgsIn   int64 // MsgsIn is the number of messages received.
+	MsgsOut  int64 // MsgsOut is the number of messages sent.
+	BytesIn  int64 // BytesIn is the number of bytes received.
+	BytesOut int64 // BytesOut is the number of bytes sent.
+
+	// Rates, in messages and bytes per second, measured over the last
+	// rate logging interval.
+	// Rates are only measured for channels with a rateLogging interval.
+	MsgRateIn   float64
+	MsgRateOut  float64
+	ByteRateIn  float64
+	ByteRateOut float64
+}
+
+// chanStats holds the number of messages and bytes that went through a channel.
+type chanStats struct {
+	msgsIn   int64
+	msgsOut  int64
+	bytesIn  int64
+	bytesOut int64
+
+	mu    sync.Mutex
+	last  chanCounts // last holds the counters at the last rate measurement.
+	rates chanRates
+}
+
+// chanCounts is a snapshot of the counters of a channel.
+type chanCounts struct {
+	msgsIn   int64
+	msgsOut  int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+// chanRates holds the rates of a channel, per second.
+type chanRates struct {
+	msgsIn   float64
+	msgsOut  float64
+	bytesIn  float64
+	bytesOut float64
+}
+
+func (st *chanStats) counts() chanCounts {
+	return chanCounts{
+		msgsIn:   atomic.LoadInt64(&st.msgsIn),
+		msgsOut:  atomic.LoadInt64(&st.msgsOut),
+		bytesIn:  atomic.LoadInt64(&st.bytesIn),
+		bytesOut: atomic.LoadInt64(&st.bytesOut),
+	}
+}
+
+// measure updates the rates of the channel with the traffic that went through
+// it during the last dt interval.
+func (st *chanStats) measure(dt time.Duration) chanRates {
+	cur := st.counts()
+	sec := dt.Seconds()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.rates = chanRates{
+		msgsIn:   float64(cur.msgsIn-st.last.msgsIn) / sec,
+		msgsOut:  float64(cur.msgsOut-st.last.msgsOut) / sec,
+		bytesIn:  float64(cur.bytesIn-st.last.bytesIn) / sec,
+		bytesOut: float64(cur.bytesOut-st.last.bytesOut) / sec,
+	}
+	st.last = cur
+	return st.rates
+}
+
+// rateLoggingUnit is the unit of the rateLogging interval of channels.
+var rateLoggingUnit = time.Second
+
+// rateLogging returns the interval at which the rates of the channel are
+// measured and logged, if any.
+// The rateLogging value of the socket takes precedence over the one of the
+// channel.
+func (ch *channel) rateLogging() time.Duration {
+	n := ch.socket().RateLogging
+	if n <= 0 {
+		n = ch.cfg.RateLogging
+	}
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(n) * rateLoggingUnit
+}
+
+// logRates periodically measures and logs the rates of the channel, until
+// quit is closed.
+func (ch *channel) logRates(dt time.Duration, quit chan struct{}) {
+	ticker := time.NewTicker(dt)
+	defer ticker.Stop()
+
+	beg := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			r := ch.stats.measure(now.Sub(beg))
+			beg = now
+			ch.log.Infof(
+				"in: %.1f msg/s (%.3f MB/s), out: %.1f msg/s (%.3f MB/s)\n",
+				r.msgsIn, r.bytesIn/1e6, r.msgsOut, r.bytesOut/1e6,
+			)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Stats returns the statistics of all the sockets of all the channels of the
+// device, sorted by channel name and socket index.
+func (dev *device) Stats() []ChannelStats {
+	var o []ChannelStats
+	for _, name := range dev.chanNames() {
+		for i := range dev.chans[name] {
+			st := dev.chans[name][i].stats
+			cur := st.counts()
+			st.mu.Lock()
+			r := st.rates
+			st.mu.Unlock()
+			o = append(o, ChannelStats{
+				Channel:     name,
+				Socket:      i,
+				MsgsIn:      cur.msgsIn,
+				MsgsOut:     cur.msgsOut,
+				BytesIn:     cur.bytesIn,
+				BytesOut:    cur.bytesOut,
+				MsgRateIn:   r.msgsIn,
+				MsgRateOut:  r.msgsOut,
+				ByteRateIn:  r.bytesIn,
+				ByteRateOut: r.bytesOut,
+			})
+		}
+	}
+	return o
+}
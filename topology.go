@@ -0,0 +1,225 @@
+// Copyright 2019 The fer Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fer
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alice-go/fer/config"
+	"github.com/alice-go/fer/mq/gochan"
+	"golang.org/x/xerrors"
+)
+
+// InProc is the name of the transport instructing RunTopology to connect the
+// devices of a topology in memory.
+//
+// The devices are connected with the go-chan driver, which pairs the original
+// bind and connect addresses of the sockets (e.g. "tcp://*:5555" and
+// "tcp://localhost:5555"), so the same configuration can be used with a
+// network transport or in memory.
+const InProc = "inproc"
+
+// inprocDriver is the message queue driver used to implement the InProc
+// transport.
+const inprocDriver = "go-chan"
+
+// TopologyError collects the errors reported by the devices of a topology.
+type TopologyError struct {
+	Errs map[string]error // Errs maps the ID of a failing device to its error.
+}
+
+func (err *TopologyError) Error() string {
+	ids := make([]string, 0, len(err.Errs))
+	for id := range err.Errs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = "device " + id + ": " + err.Errs[id].Error()
+	}
+	return "fer: topology failed: " + strings.Join(msgs, "; ")
+}
+
+// RunTopology runs, within the current process, all the devices described by
+// the provided configuration.
+// devs maps the ID of each device of the configuration to its implementation.
+//
+// RunTopology initializes and runs all the devices together, until either ctx
+// is done or one of the devices fails.
+// All the devices are then stopped, reset and ended.
+// The shutdown of the topology is bounded by cfg.ShutdownTimeout.
+//
+// RunTopology returns a *TopologyError holding the errors of the failing
+// devices, if any.
+// The cancellation of ctx is the regular way to end a topology and is not
+// reported as an error.
+//
+// If cfg.Transport is InProc, the devices exchange data in memory.
+// In-memory topologies may not bind an endpoint twice, nor connect to a given
+// port of different hosts.
+func RunTopology(ctx context.Context, cfg config.Config, devs map[string]Device, w io.Writer) error {
+	cfg.Control = "static"
+	if cfg.Transport == InProc {
+		cfg.Transport = inprocDriver
+		err := checkEndpoints(cfg.Options.Devices)
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := make(map[string]bool, len(cfg.Options.Devices))
+	for _, dcfg := range cfg.Options.Devices {
+		id := dcfg.Name()
+		ids[id] = true
+		if _, ok := devs[id]; !ok {
+			return xerrors.Errorf("fer: no implementation for device %q", id)
+		}
+	}
+	for id := range devs {
+		if !ids[id] {
+			return xerrors.Errorf("fer: no such device %q", id)
+		}
+	}
+
+	// devices run with their own context, so the cancellation of ctx
+	// triggers their orderly shutdown.
+	dctx, dcancel := context.WithCancel(context.Background())
+	defer dcancel()
+
+	type result struct {
+		id  string
+		err error
+	}
+
+	var (
+		sys  = make([]*device, 0, len(cfg.Options.Devices))
+		errc = make(chan result, len(cfg.Options.Devices))
+		errs = make(map[string]error)
+	)
+
+	for _, dcfg := range cfg.Options.Devices {
+		cfg := cfg
+		cfg.ID = dcfg.Name()
+		dev, err := newDevice(dctx, cfg, devs[cfg.ID], nil, w)
+		if err != nil {
+			dcancel()
+			for range sys {
+				<-errc
+			}
+			return xerrors.Errorf("fer: could not create device %q: %w", cfg.ID, err)
+		}
+		sys = append(sys, dev)
+		go func() {
+			errc <- result{dev.name, dev.run(dctx)}
+		}()
+	}
+
+	running := len(sys)
+	collect := func(res result) {
+		running--
+		if res.err != nil {
+			errs[res.id] = res.err
+		}
+	}
+
+init:
+	for _, cmd := range []Cmd{CmdInitDevice, CmdInitTask, CmdRun} {
+		for _, dev := range sys {
+			err := dev.exec(cmd)
+			if err != nil {
+				errs[dev.name] = err
+				break init
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		select {
+		case <-ctx.Done():
+		case res := <-errc:
+			collect(res)
+		}
+	}
+
+	timeout := cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, dev := range sys {
+		go func(dev *device) {
+			err := dev.shutdown()
+			if err != nil {
+				dev.stop(err)
+			}
+		}(dev)
+	}
+
+	for running > 0 {
+		select {
+		case res := <-errc:
+			collect(res)
+		case <-timer.C:
+			dcancel()
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &TopologyError{Errs: errs}
+}
+
+// checkEndpoints checks that the sockets of an in-memory topology designate
+// unambiguous endpoints.
+// The host part of tcp addresses is not part of in-memory endpoints, so
+// addresses of a given port on different hosts would otherwise be silently
+// connected together.
+func checkEndpoints(devs []config.Device) error {
+	type use struct {
+		dev  string
+		addr string
+		host string
+	}
+	var (
+		binds = make(map[string]use)
+		dials = make(map[string]use)
+	)
+	for _, dev := range devs {
+		for _, ch := range dev.Channels {
+			for _, sck := range ch.Sockets {
+				ep, host := gochan.Endpoint(sck.Address)
+				cur := use{dev: dev.Name(), addr: sck.Address, host: host}
+				switch strings.ToLower(sck.Method) {
+				case "bind":
+					if prev, dup := binds[ep]; dup {
+						return xerrors.Errorf(
+							"fer: address %q of device %q and address %q of device %q bind the same in-process endpoint",
+							prev.addr, prev.dev, cur.addr, cur.dev,
+						)
+					}
+					binds[ep] = cur
+				case "connect":
+					if prev, dup := dials[ep]; dup && prev.host != cur.host {
+						return xerrors.Errorf(
+							"fer: address %q of device %q and address %q of device %q connect to the same in-process endpoint",
+							prev.addr, prev.dev, cur.addr, cur.dev,
+						)
+					}
+					dials[ep] = cur
+				}
+			}
+		}
+	}
+	return nil
+}